@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jeremybumsted/bksprites/internal/config"
+	"github.com/jeremybumsted/bksprites/internal/pool"
+)
+
+// loadConfig reads the config file, if any, and applies the flags and env
+// vars that were set on top of it
+func (c *ControllerCmd) loadConfig() (*config.Config, error) {
+	cfg := config.Default()
+	if c.Config != "" {
+		var err error
+		if cfg, err = config.Load(c.Config); err != nil {
+			return nil, err
+		}
+	}
+
+	setString(&cfg.StackKey, c.StackKey)
+	setString(&cfg.StateDir, c.StateDir)
+	setString(&cfg.MetricsAddr, c.MetricsAddr)
+	setString(&cfg.HealthAddr, c.HealthAddr)
+	setString(&cfg.LogLevel, c.LogLevel)
+	setString(&cfg.Backend, c.Backend)
+	setValue(&cfg.MaxConcurrency, c.MaxConcurrency)
+	setValue(&cfg.PollInterval, c.PollInterval)
+	setValue(&cfg.ReservationExpiry, c.ReservationExpiry)
+	setValue(&cfg.PriorityAging, c.PriorityAging)
+	setValue(&cfg.ScaleInterval, c.ScaleInterval)
+	setValue(&cfg.AffinityWait, c.AffinityWait)
+	setValue(&cfg.Timeouts.Acquire, c.AcquireTimeout)
+	setValue(&cfg.Timeouts.Job, c.JobTimeout)
+	setValue(&cfg.Timeouts.CancelGrace, c.CancelGrace)
+	setValue(&cfg.Timeouts.Drain, c.DrainTimeout)
+	setValue(&cfg.Timeouts.Stall, c.StallTimeout)
+	setValue(&cfg.Timeouts.PollFailure, c.PollFailureThreshold)
+
+	if len(c.Queue) > 0 {
+		cfg.Queues = make([]config.Queue, 0, len(c.Queue))
+		for _, key := range c.Queue {
+			cfg.Queues = append(cfg.Queues, config.Queue{Key: key})
+		}
+	}
+
+	if len(c.Sprites) > 0 {
+		p := config.Pool{Name: "default"}
+		for _, spec := range c.Sprites {
+			name, tags, err := pool.ParseSpriteSpec(spec)
+			if err != nil {
+				return nil, fmt.Errorf("--sprites: %w", err)
+			}
+			p.Sprites = append(p.Sprites, config.Sprite{Name: name, Tags: tags})
+		}
+		cfg.Pools = []config.Pool{p}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+func setString(dst *string, flag string) {
+	if flag != "" {
+		*dst = flag
+	}
+}
+
+func setValue[T int | time.Duration](dst *T, flag *T) {
+	if flag != nil {
+		*dst = *flag
+	}
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/config"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bksprites.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+stack_key: from-file
+max_concurrency: 4
+poll_interval: 5s
+queues:
+  - key: file-queue
+pools:
+  - name: linux
+    sprites: ["bk-1:os=linux"]
+`), 0o600))
+
+	zero := 0
+	interval := 2 * time.Second
+
+	t.Run("file values", func(t *testing.T) {
+		cmd := &ControllerCmd{Config: path}
+		cfg, err := cmd.loadConfig()
+		require.NoError(t, err)
+
+		assert.Equal(t, "from-file", cfg.StackKey)
+		assert.Equal(t, 4, cfg.MaxConcurrency)
+		assert.Equal(t, 5*time.Second, cfg.PollInterval)
+		assert.Equal(t, "file-queue", cfg.Queues[0].Key)
+		assert.Equal(t, "linux", cfg.Pools[0].Name)
+	})
+
+	t.Run("flags override the file", func(t *testing.T) {
+		cmd := &ControllerCmd{
+			Config:         path,
+			StackKey:       "from-flag",
+			Queue:          []string{"flag-queue"},
+			MaxConcurrency: &zero,
+			PollInterval:   &interval,
+			Sprites:        []string{"bk-a", "bk-b:os=mac"},
+			Backend:        "local",
+		}
+		cfg, err := cmd.loadConfig()
+		require.NoError(t, err)
+
+		assert.Equal(t, "from-flag", cfg.StackKey)
+		assert.Equal(t, 0, cfg.MaxConcurrency, "an explicit zero overrides the file")
+		assert.Equal(t, interval, cfg.PollInterval)
+		assert.Equal(t, config.BackendLocal, cfg.Backend)
+		assert.Equal(t, []config.Queue{{Key: "flag-queue"}}, cfg.Queues)
+		require.Len(t, cfg.Pools, 1)
+		assert.Equal(t, []config.Sprite{
+			{Name: "bk-a"},
+			{Name: "bk-b", Tags: map[string]string{"os": "mac"}},
+		}, cfg.Pools[0].Sprites)
+	})
+
+	t.Run("defaults without a file", func(t *testing.T) {
+		cfg, err := (&ControllerCmd{}).loadConfig()
+		require.NoError(t, err)
+		assert.Equal(t, config.Default(), cfg)
+	})
+
+	t.Run("invalid override", func(t *testing.T) {
+		negative := -1
+		_, err := (&ControllerCmd{Config: path, MaxConcurrency: &negative}).loadConfig()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "max_concurrency: must not be negative, got -1")
+	})
+}
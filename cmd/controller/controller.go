@@ -3,47 +3,94 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/buildkite/stacksapi"
 	"github.com/charmbracelet/log"
 
+	"github.com/jeremybumsted/bksprites/internal/agentversion"
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	"github.com/jeremybumsted/bksprites/internal/config"
+	"github.com/jeremybumsted/bksprites/internal/health"
+	"github.com/jeremybumsted/bksprites/internal/local"
+	"github.com/jeremybumsted/bksprites/internal/manager"
+	"github.com/jeremybumsted/bksprites/internal/metrics"
 	"github.com/jeremybumsted/bksprites/internal/monitor"
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/sprites"
+	"github.com/jeremybumsted/bksprites/internal/store"
 )
 
+// ControllerCmd runs the controller. Settings can come from a YAML file
+// given with --config, flags and env vars set override values from the file.
 type ControllerCmd struct {
-	AgentToken   string `help:"Buildkite agent token" env:"BUILDKITE_AGENT_TOKEN" required:""`
-	SpriteToken  string `help:"Sprites API token" env:"SPRITE_API_TOKEN" required:""`
-	StackKey     string `help:"unique stack key" default:"bk-sprites"`
-	Queue        string `help:"queue the stack will monitor" default:"default"`
-	PollInterval string `help:"Poll interval" default:"1s" env:"POLL_INTERVAL"`
-	LogLevel     string `help:"Log level (debug, info, warn, error)" default:"info" env:"LOG_LEVEL"`
+	Config         string         `help:"YAML config file, see examples/bksprites.yaml" env:"BKSPRITES_CONFIG" type:"path"`
+	AgentToken     string         `help:"Buildkite agent token" env:"BUILDKITE_AGENT_TOKEN" required:""`
+	SpriteToken    string         `help:"Sprites API token, required by the sprites backend" env:"SPRITE_API_TOKEN"`
+	Backend        string         `help:"where jobs' agents run: sprites, or local to run them as processes on this machine (default sprites)" env:"BKSPRITES_BACKEND"`
+	StackKey       string         `help:"unique stack key (default bk-sprites)"`
+	Queue          []string       `help:"queues to monitor, may be repeated, replaces any queues in the config file (default default)"`
+	PollInterval   *time.Duration `help:"Poll interval (default 1s)" env:"POLL_INTERVAL"`
+	Sprites        []string       `help:"sprites the stack can run jobs on, with optional tags e.g. bk-1:os=linux,docker=true;bk-2, replaces any pools in the config file (default bk-test-1)" env:"SPRITES" sep:";"`
+	MaxConcurrency *int           `help:"maximum number of jobs to run at once, 0 limits only by the number of sprites" env:"MAX_CONCURRENCY"`
+	StateDir       string         `help:"directory to persist job state in, state is kept in memory if unset" env:"STATE_DIR" type:"path"`
+	MetricsAddr    string         `help:"address to serve Prometheus metrics on, e.g. :9090, disabled if unset" env:"METRICS_ADDR"`
+	HealthAddr     string         `help:"address to serve /healthz and /readyz on, e.g. :8080, disabled if unset" env:"HEALTH_ADDR"`
+	LogLevel       string         `help:"Log level (debug, info, warn, error) (default info)" env:"LOG_LEVEL"`
+
+	ReservationExpiry    *time.Duration `help:"how long a reservation is held while the agent starts (default 30s)" env:"RESERVATION_EXPIRY"`
+	PriorityAging        *time.Duration `help:"how long a job waits before it is dispatched as if it had one priority level higher, 0 disables aging (default 5m)" env:"PRIORITY_AGING"`
+	ScaleInterval        *time.Duration `help:"how often pools with a provision script are checked for sprites to create (default 10s)" env:"SCALE_INTERVAL"`
+	AffinityWait         *time.Duration `help:"how long a job waits for a busy sprite that recently ran its pipeline before taking any free one (default 0s)" env:"AFFINITY_WAIT"`
+	AcquireTimeout       *time.Duration `help:"how long a job's agent may take to acquire the job (default 5m)" env:"ACQUIRE_TIMEOUT"`
+	JobTimeout           *time.Duration `help:"how long a job's agent may run on a sprite, 0 for no limit (default 0s)" env:"JOB_TIMEOUT"`
+	CancelGrace          *time.Duration `help:"how long the agent of a job cancelled on Buildkite has to stop before it's killed (default 30s)" env:"CANCEL_GRACE"`
+	DrainTimeout         *time.Duration `help:"how long to wait for running jobs to finish when shutting down (default 5m)" env:"DRAIN_TIMEOUT"`
+	StallTimeout         *time.Duration `help:"how long the poll loop can go without running before /healthz fails (default 2m)" env:"STALL_TIMEOUT"`
+	PollFailureThreshold *time.Duration `help:"how long polling can keep failing before /readyz fails (default 1m)" env:"POLL_FAILURE_THRESHOLD"`
 }
 
 func (c *ControllerCmd) Run() error {
+	cfg, err := c.loadConfig()
+	if err != nil {
+		return err
+	}
+
 	// Set log level
-	level, err := log.ParseLevel(c.LogLevel)
+	level, err := log.ParseLevel(cfg.LogLevel)
 	if err != nil {
-		log.Warn("Invalid log level, using info", "level", c.LogLevel)
-		level = log.InfoLevel
+		return err
 	}
 	log.SetLevel(level)
 
 	ctx := context.Background()
 	log.Info("Starting controller")
-	log.Info(fmt.Sprintf("Stack Key: %v", c.StackKey))
-	log.Info(fmt.Sprintf("Queue: %v", c.Queue))
+	if c.Config != "" {
+		log.Info(fmt.Sprintf("Config: %v", c.Config))
+	}
+	for _, q := range cfg.Queues {
+		log.Info(fmt.Sprintf("Queue: %v (stack %v)", q.Key, cfg.QueueStackKey(q)))
+	}
+
+	log.Info(fmt.Sprintf("Backend: %v", cfg.Backend))
 
 	// Verify sprite token is set
-	if c.SpriteToken == "" {
-		log.Error("SPRITE_API_TOKEN is empty - sprites authentication will fail")
-		os.Exit(1)
+	if cfg.Backend == config.BackendSprites {
+		if c.SpriteToken == "" {
+			log.Error("SPRITE_API_TOKEN is empty - sprites authentication will fail")
+			os.Exit(1)
+		}
+		log.Debug("Sprite token configured", "tokenLength", len(c.SpriteToken))
 	}
-	log.Debug("Sprite token configured", "tokenLength", len(c.SpriteToken))
 
 	client, err := stacksapi.NewClient(c.AgentToken)
 	if err != nil {
@@ -51,47 +98,355 @@ func (c *ControllerCmd) Run() error {
 		os.Exit(1)
 	}
 
-	stack, _, err := client.RegisterStack(context.Background(), stacksapi.RegisterStackRequest{
-		Key:      c.StackKey,
-		Type:     stacksapi.StackTypeCustom,
-		QueueKey: c.Queue,
-		Metadata: map[string]string{
-			"test": "true",
-		},
-	})
+	registry := pool.NewRegistry()
+	var checkCheckpoint func(ctx context.Context, sprite string, name string) error
+	if cfg.Backend == config.BackendSprites {
+		handler := sprites.NewSpriteHandlerWithToken(c.SpriteToken)
+		checkCheckpoint = func(ctx context.Context, sprite string, name string) error {
+			return handler.NewAgentSprite(sprite).CheckCheckpoint(ctx, name)
+		}
+	}
+	pools, err := setupPools(ctx, cfg, registry, checkCheckpoint)
+	if err != nil {
+		return err
+	}
+	provisionScripts := pools.provisionScripts
+
+	// Pools that can provision sprites are kept warm and grown for waiting jobs
+	var poolManager *manager.Manager
+	if len(pools.managed) > 0 {
+		poolManager = manager.NewManager(registry, c.SpriteToken, c.AgentToken, pools.managed, manager.WithInterval(cfg.ScaleInterval))
+		if err := poolManager.Adopt(ctx); err != nil {
+			return fmt.Errorf("adopting sprites from a previous run: %w", err)
+		}
+	}
+
+	// Sprites report their agent version, and are moved to the pool's pinned one while idle
+	var versionEnforcer *agentversion.Enforcer
+	if len(pools.versioned) > 0 {
+		versionEnforcer = agentversion.NewEnforcer(registry, c.SpriteToken, pools.versioned)
+	}
+
+	compute := c.newBackend(cfg)
+	opts := []monitor.Option{
+		monitor.WithMaxConcurrency(cfg.MaxConcurrency),
+		monitor.WithPoolReservationExpiry(cfg.PoolReservationExpiries()),
+		monitor.WithPriorityAging(cfg.PriorityAging),
+		monitor.WithAffinityWait(cfg.AffinityWait),
+		monitor.WithAcquireTimeout(cfg.Timeouts.Acquire),
+		monitor.WithJobTimeout(cfg.Timeouts.Job),
+		monitor.WithPoolJobTimeout(cfg.PoolJobTimeouts()),
+		monitor.WithPipelineJobTimeout(cfg.PipelineJobTimeouts()),
+		monitor.WithCancelGrace(cfg.Timeouts.CancelGrace),
+		monitor.WithPools(cfg.Templates()),
+		monitor.WithProvisioning(c.AgentToken, provisionScripts),
+		monitor.WithManager(poolManager),
+	}
+
+	// Queues compete for the same sprites, so divide them up by weight
+	if len(cfg.Queues) > 1 {
+		shares := pool.NewShares(registry, cfg.MaxConcurrency)
+		for _, q := range cfg.Queues {
+			shares.SetWeight(q.Key, q.Weight)
+		}
+		opts = append(opts, monitor.WithShares(shares))
+	}
+
+	// Metrics and health can share a listener when they're given the same address
+	muxes := make(map[string]*http.ServeMux)
+	muxFor := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if cfg.MetricsAddr != "" {
+		if err := metrics.RegisterPool(registry); err != nil {
+			return fmt.Errorf("registering pool metrics: %w", err)
+		}
+		muxFor(cfg.MetricsAddr).Handle("/metrics", metrics.Handler())
+		log.Info(fmt.Sprintf("Metrics: http://%v/metrics", cfg.MetricsAddr))
+	}
+
+	var checker *health.Checker
+	if cfg.HealthAddr != "" {
+		checker = health.NewChecker(cfg.Timeouts.Stall, cfg.Timeouts.PollFailure)
+		checker.Register(muxFor(cfg.HealthAddr))
+		log.Info(fmt.Sprintf("Health: http://%v%v", cfg.HealthAddr, health.ReadinessPath))
+	}
+
+	for addr, mux := range muxes {
+		server := serve(addr, mux)
+		defer server.Close()
+	}
+
+	stacks, err := registerStacks(ctx, client, cfg)
 	if err != nil {
 		log.Error("There was an error registering the stack", "error", err)
 		os.Exit(1)
 	}
+	checker.SetRegistered(true)
 
-	pollInterval, err := time.ParseDuration(c.PollInterval)
-	if err != nil {
-		return err
+	if cfg.StateDir != "" {
+		s, err := store.NewFileStore(cfg.StateDir)
+		if err != nil {
+			return fmt.Errorf("opening state directory: %w", err)
+		}
+		defer s.Close()
+
+		log.Info(fmt.Sprintf("State Dir: %v", cfg.StateDir))
+		opts = append(opts, monitor.WithJobStore(store.NewJobStore(s)))
 	}
 
-	queueMonitor := monitor.NewMonitor(client, c.StackKey, c.Queue, pollInterval, c.SpriteToken)
-	go func() {
-		if err := queueMonitor.Start(ctx); err != nil && err != context.Canceled {
-			log.Error("There was a monitor error", "error", err)
+	monitors := make([]*monitor.Monitor, 0, len(cfg.Queues))
+	for _, q := range cfg.Queues {
+		queueOpts := append(slices.Clone(opts),
+			monitor.WithQueuePools(q.Pools),
+			monitor.WithReservationExpiry(cfg.QueueReservationExpiry(q)),
+			monitor.WithHealth(checker.Loop(q.Key)),
+		)
+		queueMonitor := monitor.NewMonitor(client, cfg.QueueStackKey(q), q.Key, cfg.QueuePollInterval(q), compute, registry, queueOpts...)
+		if err := queueMonitor.Reconcile(ctx); err != nil {
+			return fmt.Errorf("reconciling jobs from a previous run on queue %s: %w", q.Key, err)
 		}
-	}()
+		monitors = append(monitors, queueMonitor)
+	}
+
+	// The pool manager and agent version enforcer finish what they're doing
+	// when stopped, but give up once the drain ends
+	managerCtx, stopManager := context.WithCancel(ctx)
+	monitorCtx, stopMonitors := context.WithCancel(ctx)
+	drainCtx, endDrain := context.WithCancel(ctx)
+	defer endDrain()
+	var managerDone, monitorsDone sync.WaitGroup
+	if poolManager != nil {
+		managerDone.Add(1)
+		go func() {
+			defer managerDone.Done()
+			if err := poolManager.Start(managerCtx, drainCtx); err != nil && err != context.Canceled {
+				log.Error("There was a pool manager error", "error", err)
+			}
+		}()
+	}
+	if versionEnforcer != nil {
+		monitorsDone.Add(1)
+		go func() {
+			defer monitorsDone.Done()
+			if err := versionEnforcer.Start(monitorCtx, drainCtx); err != nil && err != context.Canceled {
+				log.Error("There was an agent version error", "error", err)
+			}
+		}()
+	}
+	for _, queueMonitor := range monitors {
+		monitorsDone.Add(1)
+		go func() {
+			defer monitorsDone.Done()
+			if err := queueMonitor.Start(monitorCtx); err != nil && err != context.Canceled {
+				log.Error("There was a monitor error", "error", err)
+			}
+		}()
+	}
 
-	signalChan := make(chan os.Signal, 1)
+	signalChan := make(chan os.Signal, 2)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	<-signalChan
+	sig := <-signalChan
+	log.Info("Received signal, draining", "signal", sig, "timeout", cfg.Timeouts.Drain)
 
-	log.Info(fmt.Sprintf("Deregistering stack %v...", stack.Key))
-	_, err = client.DeregisterStack(context.Background(), stack.Key)
-	if err != nil {
+	// A second signal skips the drain
+	go func() {
+		sig := <-signalChan
+		log.Warn("Received second signal, forcing exit", "signal", sig)
+		os.Exit(1)
+	}()
+
+	// Stop scaling, polling and reserving, then give running jobs a chance to
+	// finish. The drain timeout covers waiting for sprites being created and
+	// for the monitors too.
+	drainTimer := time.AfterFunc(cfg.Timeouts.Drain, endDrain)
+	stopManager()
+	stopMonitors()
+	managerDone.Wait()
+	monitorsDone.Wait()
+
+	remaining := 0
+	for _, queueMonitor := range monitors {
+		for jobUUID, spriteName := range queueMonitor.Drain(drainCtx) {
+			log.Warn("Job still running after drain timeout", "jobUUID", jobUUID, "sprite", spriteName)
+			remaining++
+		}
+	}
+	drainTimer.Stop()
+	endDrain()
+
+	if remaining == 0 {
+		log.Info("All jobs finished")
+	}
+
+	checker.SetRegistered(false)
+	if err := deregisterStacks(client, stacks); err != nil {
 		log.Error("There was an error deregistering the stack", "error", err)
 		os.Exit(1)
 	}
 
 	log.Info("Shutting down now, buh-bye!")
-
-	//TODO, add the following
-	// - Finish a job:
-	//
 	return nil
 }
+
+// pools are the configured pools' provision scripts, keyed by pool name,
+// and the pools the pool manager and agent version enforcer look after
+type pools struct {
+	provisionScripts map[string][]byte
+	managed          []manager.Pool
+	versioned        []agentversion.Pool
+}
+
+// setupPools adds the configured pools to the registry. The pool manager
+// and the agent version enforcer work on sprites through the Sprites API,
+// so neither is given any pools on the local backend. Sprites are checked
+// for their pool's checkpoint with checkCheckpoint, so a missing one fails
+// here rather than after every job.
+func setupPools(ctx context.Context, cfg *config.Config, registry *pool.Registry, checkCheckpoint func(ctx context.Context, sprite string, name string) error) (pools, error) {
+	p := pools{provisionScripts: make(map[string][]byte)}
+	for _, pc := range cfg.Pools {
+		if pc.ProvisionScript != "" {
+			script, err := os.ReadFile(pc.ProvisionScript)
+			if err != nil {
+				return pools{}, fmt.Errorf("reading provision script for pool %s: %w", pc.Name, err)
+			}
+			p.provisionScripts[pc.Name] = script
+		}
+
+		if pc.Ephemeral() {
+			if err := registry.AddEphemeralPool(pc.Name, pc.Tags, pc.MaxAgents); err != nil {
+				return pools{}, fmt.Errorf("registering pool %s: %w", pc.Name, err)
+			}
+			log.Info(fmt.Sprintf("Pool %v: up to %v ephemeral sprites", pc.Name, pc.MaxAgents))
+			if cfg.Backend == config.BackendSprites {
+				// Their sprites' versions are reported, the provision script installs the pinned one
+				p.versioned = append(p.versioned, agentversion.Pool{Name: pc.Name, Version: pc.Agent.Version})
+			}
+			continue
+		}
+
+		names := make([]string, 0, len(pc.Sprites))
+		for _, s := range pc.Sprites {
+			if err := registry.AddToPool(pc.Name, s.Name, s.Tags); err != nil {
+				return pools{}, fmt.Errorf("registering sprite %s: %w", s.Name, err)
+			}
+			names = append(names, s.Name)
+		}
+		log.Info(fmt.Sprintf("Pool %v: %v", pc.Name, names))
+
+		if cfg.Backend != config.BackendSprites {
+			continue
+		}
+
+		if pc.Checkpoint != "" {
+			for _, name := range names {
+				if err := checkCheckpoint(ctx, name, pc.Checkpoint); err != nil {
+					return pools{}, fmt.Errorf("checking checkpoint for pool %s: %w", pc.Name, err)
+				}
+			}
+		}
+
+		p.versioned = append(p.versioned, agentversion.Pool{
+			Name:       pc.Name,
+			Version:    pc.Agent.Version,
+			Checkpoint: pc.Checkpoint,
+		})
+
+		if script, ok := p.provisionScripts[pc.Name]; ok {
+			p.managed = append(p.managed, manager.Pool{
+				Name:            pc.Name,
+				MinAgents:       pc.MinAgents,
+				MaxAgents:       pc.MaxAgents,
+				Tags:            pc.Tags,
+				AgentVersion:    pc.Agent.Version,
+				ProvisionScript: script,
+				Checkpoint:      pc.Checkpoint,
+				IdleTimeout:     pc.IdleTimeout,
+				MaxJobs:         pc.MaxJobs,
+				MaxAge:          pc.MaxAge,
+			})
+		}
+	}
+	return p, nil
+}
+
+// newBackend returns the backend the configuration runs jobs' agents on
+func (c *ControllerCmd) newBackend(cfg *config.Config) backend.Backend {
+	if cfg.Backend == config.BackendLocal {
+		dir := cfg.Local.Dir
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "bksprites")
+		}
+		opts := []local.Option{local.WithAgentToken(c.AgentToken)}
+		if cfg.Local.AgentPath != "" {
+			opts = append(opts, local.WithAgentPath(cfg.Local.AgentPath))
+		}
+		log.Info(fmt.Sprintf("Local Dir: %v", dir))
+		return local.NewBackend(dir, opts...)
+	}
+
+	b := sprites.NewBackend(c.SpriteToken)
+	b.RetryPolicy = &sprites.RetryPolicy{
+		MaxAttempts: cfg.Retry.MaxAttempts,
+		BaseDelay:   cfg.Retry.BaseDelay,
+		MaxDelay:    cfg.Retry.MaxDelay,
+		Jitter:      cfg.Retry.Jitter,
+	}
+	return b
+}
+
+// registerStacks registers a stack for each queue. If any registration
+// fails, the stacks already registered are deregistered again.
+func registerStacks(ctx context.Context, client *stacksapi.Client, cfg *config.Config) ([]string, error) {
+	var stacks []string
+	for _, q := range cfg.Queues {
+		stack, _, err := client.RegisterStack(ctx, stacksapi.RegisterStackRequest{
+			Key:      cfg.QueueStackKey(q),
+			Type:     stacksapi.StackTypeCustom,
+			QueueKey: q.Key,
+			Metadata: map[string]string{
+				"test": "true",
+			},
+		})
+		if err != nil {
+			if err := deregisterStacks(client, stacks); err != nil {
+				log.Error("There was an error deregistering the stack", "error", err)
+			}
+			return nil, fmt.Errorf("registering stack for queue %s: %w", q.Key, err)
+		}
+		stacks = append(stacks, stack.Key)
+	}
+	return stacks, nil
+}
+
+// deregisterStacks deregisters every stack, returning the errors from any that failed
+func deregisterStacks(client *stacksapi.Client, stacks []string) error {
+	var errs []error
+	for _, key := range stacks {
+		log.Info(fmt.Sprintf("Deregistering stack %v...", key))
+		if _, err := client.DeregisterStack(context.Background(), key); err != nil {
+			errs = append(errs, fmt.Errorf("deregistering stack %s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serve starts an HTTP server on addr in the background
+func serve(addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("HTTP server error", "addr", addr, "error", err)
+		}
+	}()
+	return server
+}
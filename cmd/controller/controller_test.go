@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/config"
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/sprites"
+)
+
+func TestSetupPools(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "provision.sh")
+	require.NoError(t, os.WriteFile(script, []byte("echo provisioned"), 0o755))
+
+	tests := []struct {
+		name          string
+		backend       string
+		wantManaged   []string
+		wantVersioned []string
+	}{
+		{
+			name:          "sprites",
+			backend:       config.BackendSprites,
+			wantManaged:   []string{"managed"},
+			wantVersioned: []string{"managed", "static", "clean"},
+		},
+		{
+			name:    "local",
+			backend: config.BackendLocal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Backend: tt.backend,
+				Pools: []config.Pool{
+					{Name: "managed", ProvisionScript: script, MaxAgents: 2},
+					{Name: "static", Sprites: []config.Sprite{{Name: "bk-1"}}},
+					{Name: "clean", Mode: config.PoolModeEphemeral, ProvisionScript: script, MaxAgents: 2},
+				},
+			}
+			registry := pool.NewRegistry()
+
+			pools, err := setupPools(context.Background(), cfg, registry, nil)
+			require.NoError(t, err)
+
+			var managed, versioned []string
+			for _, p := range pools.managed {
+				managed = append(managed, p.Name)
+			}
+			for _, p := range pools.versioned {
+				versioned = append(versioned, p.Name)
+			}
+			assert.Equal(t, tt.wantManaged, managed)
+			assert.Equal(t, tt.wantVersioned, versioned)
+
+			// Every pool's sprites are registered and its script read whatever the backend
+			assert.Equal(t, 1, registry.Count(pool.StateIdle))
+			assert.Len(t, pools.provisionScripts, 2)
+		})
+	}
+}
+
+func TestSetupPools_Checkpoint(t *testing.T) {
+	checkpoints := map[string]string{"bk-1": "golden"}
+	checkCheckpoint := func(ctx context.Context, sprite string, name string) error {
+		if checkpoints[sprite] != name {
+			return fmt.Errorf("%w: %s on sprite %s", sprites.ErrCheckpointNotFound, name, sprite)
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		sprites []config.Sprite
+		wantErr string
+	}{
+		{
+			name:    "every sprite has the checkpoint",
+			sprites: []config.Sprite{{Name: "bk-1"}},
+		},
+		{
+			name:    "a sprite is missing the checkpoint",
+			sprites: []config.Sprite{{Name: "bk-1"}, {Name: "bk-2"}},
+			wantErr: "checking checkpoint for pool static: checkpoint not found: golden on sprite bk-2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Backend: config.BackendSprites,
+				Pools:   []config.Pool{{Name: "static", Checkpoint: "golden", Sprites: tt.sprites}},
+			}
+
+			_, err := setupPools(context.Background(), cfg, pool.NewRegistry(), checkCheckpoint)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				assert.ErrorIs(t, err, sprites.ErrCheckpointNotFound)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -1,7 +1,102 @@
+// Package create provides the kong command interface for provisioning a new agent sprite
 package create
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	"github.com/jeremybumsted/bksprites/internal/sprites"
+	"github.com/jeremybumsted/bksprites/internal/types"
+)
+
+// destroyTimeout bounds deleting a sprite that failed to provision
+const destroyTimeout = time.Minute
+
 type CreateCmd struct {
+	Name            string `help:"name of the sprite to create" required:""`
+	ProvisionScript string `help:"script used to install the buildkite-agent on the sprite" default:"examples/scripts/provision.sh" type:"path"`
+	AgentVersion    string `help:"buildkite-agent version to install, defaults to the latest release"`
+	Checkpoint      string `help:"name of a checkpoint to record once the sprite is provisioned, for pools that restore it after every job e.g. golden"`
+	AgentToken      string `help:"Buildkite agent token" env:"BUILDKITE_AGENT_TOKEN" required:""`
+	SpriteToken     string `help:"Sprites API token" env:"SPRITE_API_TOKEN" required:""`
+	LogLevel        string `help:"Log level (debug, info, warn, error)" default:"info" env:"LOG_LEVEL"`
 }
 
-func (c *CreateCmd) Run() {
+// Run creates and provisions the sprite, destroying it again if anything
+// fails so a half-built sprite isn't left behind
+func (c *CreateCmd) Run() (err error) {
+	level, err := log.ParseLevel(c.LogLevel)
+	if err != nil {
+		log.Warn("Invalid log level, using info", "level", c.LogLevel)
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+
+	script, err := os.ReadFile(c.ProvisionScript)
+	if err != nil {
+		return fmt.Errorf("reading provision script: %w", err)
+	}
+
+	ctx := context.Background()
+	handler := sprites.NewSpriteHandlerWithToken(c.SpriteToken)
+
+	log.Info("Creating sprite", "name", c.Name)
+	spr, err := handler.CreateAgentSprite(ctx, c.Name)
+	if err != nil {
+		return fmt.Errorf("creating sprite %s: %w", c.Name, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		log.Warn("Destroying sprite that failed to provision", "name", c.Name)
+		destroyCtx, cancel := context.WithTimeout(context.Background(), destroyTimeout)
+		defer cancel()
+		if destroyErr := spr.Destroy(destroyCtx); destroyErr != nil {
+			log.Error("failed to destroy sprite, it may have leaked", "sprite", c.Name, "error", destroyErr)
+		}
+	}()
+
+	env := backend.ProvisionEnv(c.AgentToken, c.AgentVersion)
+
+	log.Info("Provisioning sprite", "name", c.Name, "script", c.ProvisionScript)
+	if err := spr.Provision(ctx, script, env); err != nil {
+		return fmt.Errorf("provisioning sprite %s: %w", c.Name, err)
+	}
+
+	version, err := spr.AgentVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("verifying the agent on sprite %s: %w", c.Name, err)
+	}
+	if c.AgentVersion != "" && !sprites.SameAgentVersion(version, c.AgentVersion) {
+		return fmt.Errorf("sprite %s has buildkite-agent %s installed, not the requested %s", c.Name, version, c.AgentVersion)
+	}
+
+	if c.Checkpoint != "" {
+		log.Info("Recording checkpoint", "name", c.Name, "checkpoint", c.Checkpoint)
+		if err := spr.CreateCheckpoint(ctx, c.Checkpoint); err != nil {
+			return fmt.Errorf("checkpointing sprite %s: %w", c.Name, err)
+		}
+	}
+
+	now := time.Now()
+	agentSprite := types.AgentSprite{
+		Name: spr.Name,
+		URL:  spr.Address,
+		Agent: types.BuildkiteAgent{
+			Version: version,
+		},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	fmt.Printf("Created sprite %s\n", agentSprite.Name)
+	fmt.Printf("  url:   %s\n", agentSprite.URL)
+	fmt.Printf("  agent: %s\n", agentSprite.Agent.Version)
+	return nil
 }
@@ -0,0 +1,33 @@
+// Package healthcheck provides the kong command for probing a running controller,
+// for images that don't ship curl
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jeremybumsted/bksprites/internal/health"
+)
+
+type HealthcheckCmd struct {
+	Addr    string        `help:"address the controller serves health checks on" default:":8080" env:"HEALTH_ADDR"`
+	Ready   bool          `help:"check readiness (/readyz) instead of liveness (/healthz)"`
+	Timeout time.Duration `help:"how long to wait for a response" default:"5s"`
+}
+
+func (h *HealthcheckCmd) Run() error {
+	path := health.LivenessPath
+	if h.Ready {
+		path = health.ReadinessPath
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	if err := health.Probe(ctx, h.Addr, path); err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	fmt.Println("ok")
+	return nil
+}
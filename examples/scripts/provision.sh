@@ -1,19 +1,32 @@
 #!/bin/bash
+set -euo pipefail
 
 # This script will execute when scaling out your sprites
 # The controller will use this script as the provision script
 # by default, but you're free to provide your own provision
 # script to best suit your needs
+#
+# The following environment variables are passed in by bksprites:
+#   BUILDKITE_SPRITE_AGENT_TOKEN  the agent token used to register the agent
+#   BUILDKITE_AGENT_VERSION       (optional) pin the agent to a specific release
+#   BKSPRITES_INSTALL_AGENT       script that installs BUILDKITE_AGENT_VERSION
 
 # This script is used to configure a sprite to be ready to
 # Run our jobs to build bksprites :)
-echo "=== Installing Dependencies ===\n"
+echo "=== Installing Dependencies ==="
 
 # The Buildkite agent install uses the documented installation steps from
 # https://buildkite.com/docs/agent/self-hosted/install/linux
-echo "Configuring the buildkite Agent\n"
-TOKEN="${BUILDKITE_SPRITE_AGENT_TOKEN}" bash -c "$(curl -sL https://raw.githubusercontent.com/buildkite/agent/main/install.sh)"
+echo "Configuring the buildkite Agent"
+TOKEN="${BUILDKITE_SPRITE_AGENT_TOKEN}" bash -c "$(curl -fsSL https://raw.githubusercontent.com/buildkite/agent/main/install.sh)"
 
-echo "Configure mise-en-place\n"
-curl https://mise.run | sh
-mise --version
+# install.sh always installs the latest release, so swap in the pinned
+# release with the controller's own install script if a version was requested
+if [ -n "${BUILDKITE_AGENT_VERSION:-}" ]; then
+  echo "Pinning the buildkite-agent to ${BUILDKITE_AGENT_VERSION}"
+  bash "${BKSPRITES_INSTALL_AGENT}"
+fi
+
+echo "Configure mise-en-place"
+curl -fsSL https://mise.run | sh
+~/.local/bin/mise --version
@@ -0,0 +1,169 @@
+// Package agentversion reads the buildkite-agent version installed on each
+// sprite and replaces it on idle sprites whose pool pins another version
+package agentversion
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/sprites"
+)
+
+// interval is how often the sprites are checked
+const interval = time.Minute
+
+// Pool is a pool whose sprites' agent versions are enforced
+type Pool struct {
+	Name       string
+	Version    string // buildkite-agent version the pool's sprites should run, any if empty
+	Checkpoint string // checkpoint recorded again after a new agent is installed, if any
+}
+
+// Enforcer replaces the agent on idle sprites one at a time, so only one
+// sprite is out of rotation while its agent is replaced. Its methods do
+// nothing on a nil Enforcer.
+type Enforcer struct {
+	registry      *pool.Registry
+	spriteHandler *sprites.SpriteHandler
+	pools         map[string]Pool // by name
+
+	// version reads the agent version on a sprite and install replaces it,
+	// both replaced in tests
+	version func(ctx context.Context, name string) (string, error)
+	install func(ctx context.Context, name string, p Pool) error
+}
+
+func NewEnforcer(registry *pool.Registry, spriteToken string, pools []Pool) *Enforcer {
+	e := &Enforcer{
+		registry:      registry,
+		spriteHandler: sprites.NewSpriteHandlerWithToken(spriteToken),
+		pools:         make(map[string]Pool, len(pools)),
+	}
+	for _, p := range pools {
+		e.pools[p.Name] = p
+	}
+	e.version = e.readVersion
+	e.install = e.installAgent
+	return e
+}
+
+// Start checks the sprites every interval until ctx is cancelled. An
+// install in progress is finished first, so the sprite isn't left out of
+// rotation, unless drain is cancelled too.
+func (e *Enforcer) Start(ctx context.Context, drain context.Context) error {
+	if e == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		e.enforce(ctx, drain)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// enforce records the agent version of idle and busy sprites that haven't
+// been read yet, and installs the pinned version on idle sprites that don't
+// match. Busy sprites are replaced once they're idle, and sprites in
+// ephemeral pools are only reported. Installs are only given up on when
+// drain is cancelled.
+func (e *Enforcer) enforce(ctx context.Context, drain context.Context) {
+	for _, s := range e.registry.List() {
+		if ctx.Err() != nil {
+			return
+		}
+		p, ok := e.pools[s.Pool]
+		if !ok || (s.State != pool.StateIdle && s.State != pool.StateBusy) {
+			continue
+		}
+
+		read := false
+		if s.AgentVersion == "" {
+			version, err := e.version(ctx, s.Name)
+			if err != nil {
+				logFailure := log.Warn
+				if s.Ephemeral {
+					// It may not have been provisioned yet
+					logFailure = log.Debug
+				}
+				logFailure("failed to read the agent version on sprite", "sprite", s.Name, "error", err)
+				continue
+			}
+			if err := e.registry.SetAgentVersion(s.Name, version); err != nil {
+				continue
+			}
+			log.Info("Sprite agent version", "sprite", s.Name, "pool", s.Pool, "version", version)
+			s.AgentVersion, read = version, true
+		}
+
+		switch {
+		case p.Version == "" || sprites.SameAgentVersion(s.AgentVersion, p.Version):
+		case s.Ephemeral:
+			if read {
+				log.Warn("Ephemeral sprite isn't running its pool's agent version, check the provision script installs it",
+					"sprite", s.Name,
+					"pool", p.Name,
+					"version", s.AgentVersion,
+					"want", p.Version,
+				)
+			}
+		case s.State == pool.StateIdle:
+			e.replace(drain, s, p)
+		}
+	}
+}
+
+// replace installs the pool's agent version on an idle sprite, taking it
+// out of rotation until it's done. A failed install leaves the old agent,
+// and is tried again next time.
+func (e *Enforcer) replace(ctx context.Context, s pool.Sprite, p Pool) {
+	if err := e.registry.Upgrade(s.Name); err != nil {
+		// Handed a job since we listed the sprites
+		return
+	}
+	defer func() {
+		if err := e.registry.SetState(s.Name, pool.StateIdle); err != nil {
+			log.Error("failed to return sprite to the pool", "sprite", s.Name, "error", err)
+		}
+	}()
+
+	log.Info("Replacing agent on sprite", "sprite", s.Name, "pool", p.Name, "from", s.AgentVersion, "to", p.Version)
+	if err := e.install(ctx, s.Name, p); err != nil {
+		log.Error("failed to replace the agent on sprite", "sprite", s.Name, "version", p.Version, "error", err)
+		return
+	}
+	// Recorded as the agent reports it, without a leading v
+	if err := e.registry.SetAgentVersion(s.Name, strings.TrimPrefix(p.Version, "v")); err != nil {
+		log.Error("failed to record the sprite's agent version", "sprite", s.Name, "error", err)
+		return
+	}
+	log.Info("Replaced agent on sprite", "sprite", s.Name, "version", p.Version)
+}
+
+func (e *Enforcer) readVersion(ctx context.Context, name string) (string, error) {
+	return e.spriteHandler.NewAgentSprite(name).AgentVersion(ctx)
+}
+
+// installAgent installs the pool's agent version, then records the pool's
+// checkpoint again so restoring it after a job keeps the new agent
+func (e *Enforcer) installAgent(ctx context.Context, name string, p Pool) error {
+	spr := e.spriteHandler.NewAgentSprite(name)
+	if err := spr.InstallAgent(ctx, p.Version); err != nil {
+		return err
+	}
+	if p.Checkpoint != "" {
+		return spr.CreateCheckpoint(ctx, p.Checkpoint)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package agentversion
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/pool"
+)
+
+// fakeSprites stands in for reading and installing the agent on sprites
+type fakeSprites struct {
+	versions  map[string]string
+	installed []string
+	fail      bool
+	registry  *pool.Registry
+}
+
+func (f *fakeSprites) version(ctx context.Context, name string) (string, error) {
+	v, ok := f.versions[name]
+	if !ok {
+		return "", errors.New("buildkite-agent not found")
+	}
+	return v, nil
+}
+
+func (f *fakeSprites) install(ctx context.Context, name string, p Pool) error {
+	// The sprite is out of rotation while the agent is replaced
+	if s, _ := f.registry.Get(name); s.State != pool.StateUpgrading {
+		return errors.New("sprite is not upgrading")
+	}
+	f.installed = append(f.installed, name+"@"+p.Version)
+	if f.fail {
+		return errors.New("download failed")
+	}
+	f.versions[name] = p.Version
+	return nil
+}
+
+func newTestEnforcer(t *testing.T, registry *pool.Registry, versions map[string]string, pools ...Pool) (*Enforcer, *fakeSprites) {
+	t.Helper()
+
+	f := &fakeSprites{versions: versions, registry: registry}
+	e := NewEnforcer(registry, "test-token", pools)
+	e.version = f.version
+	e.install = f.install
+	return e, f
+}
+
+func TestEnforcer_Enforce(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "linux-1", nil))
+	require.NoError(t, registry.AddToPool("linux", "linux-2", nil))
+	require.NoError(t, registry.AddToPool("linux", "linux-3", nil))
+	require.NoError(t, registry.AddToPool("any", "any-1", nil))
+	require.NoError(t, registry.Claim("linux-3", "job-1"))
+	require.NoError(t, registry.AddEphemeralPool("clean", nil, 1))
+	ephemeral, err := registry.CheckoutFrom([]string{"clean"}, "job-2", nil)
+	require.NoError(t, err)
+
+	e, f := newTestEnforcer(t, registry,
+		map[string]string{"linux-1": "3.112.0", "linux-2": "3.120.0", "linux-3": "3.100.0", "any-1": "3.99.0", ephemeral.Name: "3.100.0"},
+		Pool{Name: "linux", Version: "v3.112.0"},
+		Pool{Name: "any"},
+		Pool{Name: "clean", Version: "3.112.0"},
+	)
+
+	e.enforce(context.Background(), context.Background())
+
+	// Idle sprites on another version are moved to the pinned one, busy
+	// sprites are read but wait until they're idle, and unpinned pools and
+	// ephemeral sprites only report
+	assert.Equal(t, []string{"linux-2@v3.112.0"}, f.installed)
+	for name, want := range map[string]string{"linux-1": "3.112.0", "linux-2": "3.112.0", "linux-3": "3.100.0", "any-1": "3.99.0", ephemeral.Name: "3.100.0"} {
+		s, ok := registry.Get(name)
+		require.True(t, ok)
+		assert.Equal(t, want, s.AgentVersion, name)
+	}
+	s, _ := registry.Get("linux-2")
+	assert.Equal(t, pool.StateIdle, s.State)
+
+	require.NoError(t, registry.Return("linux-3"))
+	e.enforce(context.Background(), context.Background())
+	assert.Equal(t, []string{"linux-2@v3.112.0", "linux-3@v3.112.0"}, f.installed)
+}
+
+func TestEnforcer_InstallFailed(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "linux-1", nil))
+
+	e, f := newTestEnforcer(t, registry, map[string]string{"linux-1": "3.100.0"}, Pool{Name: "linux", Version: "3.112.0"})
+	f.fail = true
+
+	e.enforce(context.Background(), context.Background())
+
+	// The old agent is still there, the sprite goes back into rotation and
+	// the install is tried again next time
+	s, _ := registry.Get("linux-1")
+	assert.Equal(t, pool.StateIdle, s.State)
+	assert.Equal(t, "3.100.0", s.AgentVersion)
+
+	e.enforce(context.Background(), context.Background())
+	assert.Len(t, f.installed, 2)
+}
+
+func TestEnforcer_Start_DrainEnds(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "linux-1", nil))
+
+	e, _ := newTestEnforcer(t, registry, map[string]string{"linux-1": "3.100.0"}, Pool{Name: "linux", Version: "3.112.0"})
+
+	ctx, stop := context.WithCancel(context.Background())
+	drain, endDrain := context.WithCancel(context.Background())
+	e.install = func(ctx context.Context, name string, p Pool) error {
+		// Stopping the enforcer leaves the install running until the drain ends
+		stop()
+		assert.NoError(t, ctx.Err())
+		time.AfterFunc(10*time.Millisecond, endDrain)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	assert.NoError(t, e.Start(ctx, drain))
+
+	s, _ := registry.Get("linux-1")
+	assert.Equal(t, pool.StateIdle, s.State)
+	assert.Equal(t, "3.100.0", s.AgentVersion)
+}
+
+func TestEnforcer_UnreadableVersion(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "linux-1", nil))
+
+	e, f := newTestEnforcer(t, registry, map[string]string{}, Pool{Name: "linux", Version: "3.112.0"})
+	e.enforce(context.Background(), context.Background())
+
+	// Nothing is installed on a sprite whose agent can't be read, the health
+	// check deals with sprites missing their agent
+	assert.Empty(t, f.installed)
+	s, _ := registry.Get("linux-1")
+	assert.Empty(t, s.AgentVersion)
+}
+
+func TestEnforcer_Nil(t *testing.T) {
+	var e *Enforcer
+	assert.NoError(t, e.Start(context.Background(), context.Background()))
+}
@@ -0,0 +1,144 @@
+// Package backend defines the compute backends the controller runs jobs'
+// agents on, e.g. Fly.io Sprites or processes on the controller's machine
+package backend
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Backend runs jobs' agents on workers, the sprites or other machines named
+// in the pool registry. Jobs are cancelled through their Handle rather than
+// a method here: only the RunJob or AttachJob call waiting on the agent has
+// its process or session to signal, and the Handle lets it share that
+// without every backend keeping its own table of running jobs.
+type Backend interface {
+	// Provision creates the worker for a job in an ephemeral pool and runs
+	// the provision script on it with the given environment, see
+	// ProvisionEnv. Failures are a *RunError.
+	Provision(ctx context.Context, worker string, script []byte, env []string) error
+
+	// CheckHealth is a quick check that the worker can run a job, the error
+	// says which check failed. Failing to reach the worker at all is a
+	// *RunError with CategorySpriteUnreachable, see Unreachable.
+	CheckHealth(ctx context.Context, worker string) error
+
+	// RunJob runs the job's agent on its worker and waits for it to exit. It
+	// gives up with ErrDispatchDeadline rather than starting the agent after
+	// deadline, a zero deadline never passes. Failures are a *RunError.
+	RunJob(job Job, deadline time.Time) error
+
+	// FindJob returns the session of the agent a previous controller process
+	// started for the job, or "" if it isn't running any more
+	FindJob(ctx context.Context, worker string, jobUUID string) (string, error)
+
+	// AttachJob waits for the agent running in a session returned by FindJob,
+	// watching the job's timeouts as RunJob does. Failures are a *RunError.
+	AttachJob(ctx context.Context, job Job, session string) error
+
+	// RestoreCheckpoint restores the worker to the newest checkpoint named name
+	RestoreCheckpoint(ctx context.Context, worker string, name string) error
+
+	// Destroy deletes a worker created by Provision. A worker that doesn't
+	// exist is already gone, so that isn't an error.
+	Destroy(ctx context.Context, worker string) error
+}
+
+// Job is a job to run an agent for, and the settings of the worker's pool
+type Job struct {
+	UUID   string
+	Worker string // the sprite or other worker the agent runs on
+
+	AgentFlags []string // extra flags passed to buildkite-agent start
+	ConfigFile string   // buildkite-agent config file on the worker, if any
+
+	// AcquireTimeout is how long the agent may take to acquire the job,
+	// DefaultAcquireTimeout if unset. JobTimeout is how long the agent may
+	// run once started, 0 for no limit.
+	AcquireTimeout time.Duration
+	JobTimeout     time.Duration
+
+	// Acquired reports whether Buildkite has handed the job to the agent. If
+	// it's nil or fails, a started agent is assumed to have acquired the job,
+	// so it's never killed for being slow to acquire it or run a second time.
+	Acquired func(ctx context.Context) (bool, error)
+
+	// Started is called once the agent has been started, before it's waited
+	// on, if set. Backends that retry only call it for the first start.
+	Started func()
+
+	Handle *Handle // tracks the running agent so the job can be cancelled, if set
+}
+
+var (
+	// ErrDispatchDeadline is returned when the agent couldn't be started
+	// before the job's reservation ran out
+	ErrDispatchDeadline = errors.New("dispatch deadline passed")
+
+	// ErrAcquireTimeout is returned when the agent was stopped because it
+	// didn't acquire the job within the acquire timeout
+	ErrAcquireTimeout = errors.New("agent didn't acquire the job in time")
+
+	// ErrJobTimeout is returned when the agent was stopped because the job
+	// ran for longer than the job timeout
+	ErrJobTimeout = errors.New("job ran past its timeout")
+
+	// ErrJobCanceled is returned when the agent was stopped because the job
+	// was cancelled on Buildkite
+	ErrJobCanceled = errors.New("job was cancelled")
+)
+
+// AgentBinaryPath is where the agent's install.sh puts buildkite-agent,
+// relative to the home directory
+const AgentBinaryPath = ".buildkite-agent/bin/buildkite-agent"
+
+// InstallAgentEnv is the environment variable provision scripts find
+// InstallAgentScript's path on the worker in, so a pinned agent is
+// installed the same way by the script and the controller
+const InstallAgentEnv = "BKSPRITES_INSTALL_AGENT"
+
+// InstallAgentScript replaces the agent binary with the release named by
+// BUILDKITE_AGENT_VERSION. The binary is only swapped once the download has
+// succeeded, so a failed install leaves the old agent in place.
+const InstallAgentScript = `#!/bin/bash
+set -euo pipefail
+case "$(uname -m)" in
+  x86_64) ARCH=amd64 ;;
+  aarch64 | arm64) ARCH=arm64 ;;
+  *) echo "unsupported architecture $(uname -m)" >&2; exit 1 ;;
+esac
+VERSION="${BUILDKITE_AGENT_VERSION#v}"
+DOWNLOAD_DIR="$(mktemp -d)"
+trap 'rm -rf "$DOWNLOAD_DIR"' EXIT
+curl -fsSL "https://github.com/buildkite/agent/releases/download/v${VERSION}/buildkite-agent-linux-${ARCH}-${VERSION}.tar.gz" \
+  | tar -xz -C "$DOWNLOAD_DIR"
+mv "$DOWNLOAD_DIR/buildkite-agent" "$HOME/` + AgentBinaryPath + `"
+`
+
+// ProvisionEnv returns the environment the provision script is run with
+// to install the given agent version, or the latest release if empty.
+// Backends add InstallAgentEnv.
+func ProvisionEnv(agentToken string, agentVersion string) []string {
+	env := []string{"BUILDKITE_SPRITE_AGENT_TOKEN=" + agentToken}
+	if agentVersion != "" {
+		env = append(env, "BUILDKITE_AGENT_VERSION="+agentVersion)
+	}
+	return env
+}
+
+// MarkStarted calls the Started hook, if there is one
+func (j Job) MarkStarted() {
+	if j.Started != nil {
+		j.Started()
+	}
+}
+
+// AgentStartArgs returns the arguments to buildkite-agent to acquire and run the job
+func (j Job) AgentStartArgs() []string {
+	args := []string{"start", "--acquire-job", j.UUID, "--name", "bk-sprites-" + j.UUID}
+	if j.ConfigFile != "" {
+		args = append(args, "--config", j.ConfigFile)
+	}
+	return append(args, j.AgentFlags...)
+}
@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJob_WatchTimeouts(t *testing.T) {
+	tests := []struct {
+		name      string
+		job       Job
+		wantCause error
+	}{
+		{
+			name: "job not acquired in time",
+			job: Job{
+				AcquireTimeout: 10 * time.Millisecond,
+				Acquired:       func(context.Context) (bool, error) { return false, nil },
+			},
+			wantCause: ErrAcquireTimeout,
+		},
+		{
+			name: "job acquired, no job timeout",
+			job: Job{
+				AcquireTimeout: 10 * time.Millisecond,
+				Acquired:       func(context.Context) (bool, error) { return true, nil },
+			},
+		},
+		{
+			name: "acquisition unknown",
+			job: Job{
+				AcquireTimeout: 10 * time.Millisecond,
+				Acquired:       func(context.Context) (bool, error) { return false, errors.New("stacks API unavailable") },
+			},
+		},
+		{
+			name: "job ran past its timeout",
+			job: Job{
+				AcquireTimeout: 10 * time.Millisecond,
+				JobTimeout:     50 * time.Millisecond,
+				Acquired:       func(context.Context) (bool, error) { return true, nil },
+			},
+			wantCause: ErrJobTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+
+			stop := tt.job.WatchTimeouts(ctx, cancel)
+			defer stop()
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(200 * time.Millisecond):
+			}
+			if tt.wantCause == nil {
+				assert.NoError(t, context.Cause(ctx))
+				return
+			}
+			assert.ErrorIs(t, context.Cause(ctx), tt.wantCause)
+		})
+	}
+}
+
+func TestHandle_Cancel(t *testing.T) {
+	var nilHandle *Handle
+	assert.False(t, nilHandle.Canceled())
+	nilHandle.Cancel(time.Second)
+
+	// Cancelling a job whose agent isn't running returns straight away
+	h := &Handle{}
+	h.Cancel(time.Minute)
+	assert.True(t, h.Canceled())
+	h.Cancel(time.Minute)
+	assert.True(t, h.Canceled())
+}
+
+// fakeProcess records the signals it's sent, and exits on the one named by exitOn
+type fakeProcess struct {
+	mu      sync.Mutex
+	signals []string
+	exitOn  string
+	h       *Handle
+}
+
+func (p *fakeProcess) Signal(sig string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.signals = append(p.signals, sig)
+	if sig == p.exitOn {
+		go p.h.Detach()
+	}
+	return nil
+}
+
+func TestHandle_Cancel_Running(t *testing.T) {
+	tests := []struct {
+		name   string
+		exitOn string
+		want   []string
+	}{
+		{name: "agent stops on TERM", exitOn: "TERM", want: []string{"TERM"}},
+		{name: "agent killed after the grace period", exitOn: "KILL", want: []string{"TERM", "KILL"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handle{}
+			proc := &fakeProcess{exitOn: tt.exitOn, h: h}
+			ctx, stop := context.WithCancelCause(context.Background())
+			defer stop(nil)
+			h.Attach(proc, stop, log.Default())
+
+			h.Cancel(10 * time.Millisecond)
+
+			proc.mu.Lock()
+			defer proc.mu.Unlock()
+			assert.Equal(t, tt.want, proc.signals)
+			assert.NoError(t, context.Cause(ctx))
+		})
+	}
+}
+
+func TestJob_AgentStartArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		job  Job
+		want []string
+	}{
+		{
+			name: "defaults",
+			job:  Job{UUID: "job-1"},
+			want: []string{"start", "--acquire-job", "job-1", "--name", "bk-sprites-job-1"},
+		},
+		{
+			name: "config file and flags",
+			job: Job{
+				UUID:       "job-1",
+				ConfigFile: "/etc/buildkite-agent.cfg",
+				AgentFlags: []string{"--tags=os=linux", "--debug"},
+			},
+			want: []string{
+				"start", "--acquire-job", "job-1", "--name", "bk-sprites-job-1",
+				"--config", "/etc/buildkite-agent.cfg",
+				"--tags=os=linux", "--debug",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.job.AgentStartArgs())
+		})
+	}
+}
+
+func TestProvisionEnv(t *testing.T) {
+	assert.Equal(t, []string{"BUILDKITE_SPRITE_AGENT_TOKEN=token"}, ProvisionEnv("token", ""))
+	assert.Equal(t, []string{"BUILDKITE_SPRITE_AGENT_TOKEN=token", "BUILDKITE_AGENT_VERSION=3.112.0"}, ProvisionEnv("token", "3.112.0"))
+}
@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"errors"
+	"time"
+)
+
+// Category says what went wrong when a job's agent failed, in terms of
+// what whoever runs the job can do about it
+type Category string
+
+const (
+	CategorySpriteUnreachable Category = "sprite unreachable" // the Sprites API or the sprite couldn't be reached
+	CategoryAgentMissing      Category = "agent missing"      // buildkite-agent isn't installed on the worker
+	CategoryAcquireRejected   Category = "acquire rejected"   // the agent ran but Buildkite didn't give it the job
+	CategoryTimeout           Category = "timeout"            // the agent was stopped for taking too long
+	CategoryAgentFailed       Category = "agent failed"       // anything else
+)
+
+// RunError is returned by RunJob when the job's agent failed, with what's
+// known about why
+type RunError struct {
+	Category Category
+	ExitCode int       // the agent's exit status, -1 if it didn't exit
+	Stderr   []string  // the last lines the agent wrote to stderr
+	Attempts []Attempt // each try at running the agent, for backends that retry
+	Err      error
+}
+
+func (e *RunError) Error() string { return e.Err.Error() }
+
+func (e *RunError) Unwrap() error { return e.Err }
+
+// Unreachable reports whether err is a *RunError for a worker that couldn't
+// be reached, which says nothing about the worker itself
+func Unreachable(err error) bool {
+	var runErr *RunError
+	return errors.As(err, &runErr) && runErr.Category == CategorySpriteUnreachable
+}
+
+// Attempt records one try at running a job's agent
+type Attempt struct {
+	Number int
+	Err    error         // nil if the attempt succeeded
+	Retry  bool          // whether the error was worth another attempt
+	Reason string        // why the error was or wasn't worth another attempt
+	Delay  time.Duration // wait before the next attempt, if there was one
+}
@@ -0,0 +1,121 @@
+package backend
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// killTimeout is how long a killed agent has to exit before it's given up on
+const killTimeout = 10 * time.Second
+
+// Process is a running agent that can be sent signals by name, e.g. "TERM"
+type Process interface {
+	Signal(sig string) error
+}
+
+// Handle tracks the agent process running a job, so the job can be
+// cancelled while a backend waits on it. The zero value is ready to use,
+// and its methods do nothing on a nil Handle.
+type Handle struct {
+	mu       sync.Mutex
+	proc     Process
+	stop     context.CancelCauseFunc // stops waiting for the process
+	done     chan struct{}           // closed once the process has exited
+	log      *log.Logger
+	canceled bool
+	grace    time.Duration
+}
+
+// Canceled reports whether Cancel has been called
+func (h *Handle) Canceled() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.canceled
+}
+
+// Cancel stops the job's agent. It's sent TERM so it can stop the job and
+// clean up, then KILL if it's still running after grace, and it's given up
+// on if even that doesn't stop it. Cancel returns once the agent has
+// stopped, and no agent is started for the job after.
+func (h *Handle) Cancel(grace time.Duration) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	if h.canceled {
+		h.mu.Unlock()
+		return
+	}
+	h.canceled = true
+	h.grace = grace
+	proc, stop, done, logger := h.proc, h.stop, h.done, h.log
+	h.mu.Unlock()
+
+	if proc != nil {
+		terminate(proc, stop, done, grace, logger)
+	}
+}
+
+// Attach records the process running the job, stop is called to give up
+// waiting for it. A job that was cancelled while the process was starting
+// has it stopped straight away.
+func (h *Handle) Attach(proc Process, stop context.CancelCauseFunc, logger *log.Logger) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.proc, h.stop, h.done, h.log = proc, stop, make(chan struct{}), logger
+	if h.canceled {
+		go terminate(proc, stop, h.done, h.grace, logger)
+	}
+}
+
+// Detach forgets the process once it has exited
+func (h *Handle) Detach() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done != nil {
+		close(h.done)
+	}
+	h.proc, h.stop, h.done, h.log = nil, nil, nil, nil
+}
+
+// terminate sends TERM to the process, then KILL once grace has passed,
+// and finally stops waiting for it
+func terminate(proc Process, stop context.CancelCauseFunc, done <-chan struct{}, grace time.Duration, logger *log.Logger) {
+	logger.Info("Job was cancelled, stopping the agent", "grace", grace)
+	if err := proc.Signal("TERM"); err != nil {
+		logger.Warn("failed to send TERM to the agent", "error", err)
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	logger.Warn("Agent still running after the grace period, killing it", "grace", grace)
+	if err := proc.Signal("KILL"); err != nil {
+		logger.Warn("failed to send KILL to the agent", "error", err)
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(killTimeout):
+	}
+
+	logger.Error("Agent didn't exit after being killed, giving up on it")
+	stop(ErrJobCanceled)
+}
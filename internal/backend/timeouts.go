@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// DefaultAcquireTimeout matches how long buildkite-agent itself keeps
+	// trying to acquire a job
+	DefaultAcquireTimeout = 5 * time.Minute
+	acquiredCheckTimeout  = 30 * time.Second
+)
+
+// WatchTimeouts stops the agent with ErrAcquireTimeout if it hasn't acquired
+// the job within the acquire timeout, or with ErrJobTimeout once it has run
+// for longer than the job timeout. The returned func stops watching.
+func (j Job) WatchTimeouts(ctx context.Context, cancel context.CancelCauseFunc) (stop func()) {
+	acquireTimeout := j.AcquireTimeout
+	if acquireTimeout == 0 {
+		acquireTimeout = DefaultAcquireTimeout
+	}
+
+	timers := []*time.Timer{
+		time.AfterFunc(acquireTimeout, func() {
+			if ctx.Err() == nil && !j.CheckAcquired() {
+				cancel(fmt.Errorf("%w after %s", ErrAcquireTimeout, acquireTimeout))
+			}
+		}),
+	}
+	if j.JobTimeout > 0 {
+		timers = append(timers, time.AfterFunc(j.JobTimeout, func() {
+			cancel(fmt.Errorf("%w of %s", ErrJobTimeout, j.JobTimeout))
+		}))
+	}
+
+	return func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}
+}
+
+// CheckAcquired reports whether the started agent has acquired its job,
+// assuming it has unless the Acquired hook says otherwise
+func (j Job) CheckAcquired() bool {
+	if j.Acquired == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), acquiredCheckTimeout)
+	defer cancel()
+
+	acquired, err := j.Acquired(ctx)
+	if err != nil {
+		log.Warn("failed to check whether the agent acquired its job, assuming it did", "worker", j.Worker, "jobUUID", j.UUID, "error", err)
+		return true
+	}
+	return acquired
+}
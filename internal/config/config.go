@@ -0,0 +1,532 @@
+// Package config loads the controller configuration from a YAML file
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/types"
+)
+
+// Config is the full controller configuration. Durations are written as
+// Go duration strings, e.g. 30s or 5m.
+type Config struct {
+	StackKey          string        `yaml:"stack_key"`
+	PollInterval      time.Duration `yaml:"poll_interval"`
+	ReservationExpiry time.Duration `yaml:"reservation_expiry"`
+	PriorityAging     time.Duration `yaml:"priority_aging"` // waiting time that raises a job's priority by one, 0 disables aging
+	ScaleInterval     time.Duration `yaml:"scale_interval"` // how often pools with a provision_script are checked for sprites to create
+	AffinityWait      time.Duration `yaml:"affinity_wait"`  // how long a job waits for a busy sprite that recently ran its pipeline, 0 takes any free sprite
+	MaxConcurrency    int           `yaml:"max_concurrency"`
+	StateDir          string        `yaml:"state_dir"`
+	MetricsAddr       string        `yaml:"metrics_addr"`
+	HealthAddr        string        `yaml:"health_addr"`
+	LogLevel          string        `yaml:"log_level"`
+	Backend           string        `yaml:"backend"` // where jobs' agents run, sprites or local
+	Local             Local         `yaml:"local"`
+	Queues            []Queue       `yaml:"queues"`
+	Pools             []Pool        `yaml:"pools"`
+	Pipelines         []Pipeline    `yaml:"pipelines"`
+	Timeouts          Timeouts      `yaml:"timeouts"`
+	Retry             Retry         `yaml:"retry"`
+}
+
+// Backends
+const (
+	BackendSprites = "sprites" // agents run on Fly.io Sprites
+	BackendLocal   = "local"   // agents run as processes on the controller's machine
+)
+
+// Local configures the local backend. Each sprite in a pool is a directory
+// the agent runs builds in rather than a Fly.io Sprite.
+type Local struct {
+	Dir       string `yaml:"dir"`        // sprites' directories are made under this, defaults to a temporary directory
+	AgentPath string `yaml:"agent_path"` // buildkite-agent binary, defaults to the one on PATH
+}
+
+// Queue is a cluster queue monitored by the controller. Each queue is
+// registered as its own stack.
+type Queue struct {
+	Key               string        `yaml:"key"`
+	StackKey          string        `yaml:"stack_key"`          // defaults to stack_key, suffixed with the queue key when there are several queues
+	PollInterval      time.Duration `yaml:"poll_interval"`      // defaults to the top level poll_interval
+	ReservationExpiry time.Duration `yaml:"reservation_expiry"` // defaults to the top level reservation_expiry
+	Pools             []string      `yaml:"pools"`              // pools the queue's jobs can run in, all pools if empty
+	Weight            int           `yaml:"weight"`             // share of the sprites when queues compete for them, defaults to 1
+}
+
+// Pool modes
+const (
+	PoolModeStatic    = "static"    // jobs run on the sprites listed in the pool
+	PoolModeEphemeral = "ephemeral" // each job runs on a sprite created for it and destroyed afterwards
+)
+
+// EphemeralReservationExpiry is the reservation expiry of ephemeral pools
+// that don't set one. Their sprites are provisioned while the job is
+// reserved, which takes far longer than the queue's expiry allows for.
+const EphemeralReservationExpiry = 10 * time.Minute
+
+// Pool is a group of sprites that share agent configuration
+type Pool struct {
+	Name              string            `yaml:"name"`
+	Mode              string            `yaml:"mode"`               // static or ephemeral, defaults to static
+	ConfigFile        string            `yaml:"config_file"`        // buildkite-agent config file on the sprite
+	ProvisionScript   string            `yaml:"provision_script"`   // script that installs the agent on new sprites, sprites are only created for pools with one
+	Checkpoint        string            `yaml:"checkpoint"`         // checkpoint each sprite is restored to after every job
+	ReservationExpiry time.Duration     `yaml:"reservation_expiry"` // overrides the queue's expiry for jobs placed in the pool, ephemeral pools default to EphemeralReservationExpiry
+	MinAgents         int               `yaml:"min_agents"`         // idle sprites kept ready
+	MaxAgents         int               `yaml:"max_agents"`         // most sprites the pool may have, 0 means no sprites are created for waiting jobs
+	IdleTimeout       time.Duration     `yaml:"idle_timeout"`       // created sprites idle this long are destroyed down to min_agents, 0 keeps them
+	MaxJobs           int               `yaml:"max_jobs"`           // created sprites are destroyed after this many jobs, 0 for no limit
+	MaxAge            time.Duration     `yaml:"max_age"`            // created sprites are destroyed once this old, 0 for no limit
+	JobTimeout        *time.Duration    `yaml:"job_timeout"`        // overrides timeouts.job for jobs placed in the pool, 0 for no limit
+	Tags              map[string]string `yaml:"tags"`               // tags of the sprites created for the pool
+	Agent             Agent             `yaml:"agent"`
+	Sprites           []Sprite          `yaml:"sprites"`
+}
+
+// Agent configures the buildkite-agent run on each sprite in a pool
+type Agent struct {
+	Version string   `yaml:"version"`
+	Flags   []string `yaml:"flags"` // extra flags passed to buildkite-agent start
+}
+
+// Sprite is a sprite in a pool. It can be written as a mapping with a
+// name and tags, or in the same name:key=value,... form as --sprites.
+type Sprite struct {
+	Name string            `yaml:"name"`
+	Tags map[string]string `yaml:"tags"`
+}
+
+// Pipeline overrides settings for the jobs of one pipeline
+type Pipeline struct {
+	Slug       string         `yaml:"slug"`
+	JobTimeout *time.Duration `yaml:"job_timeout"` // overrides the pool's job timeout, 0 for no limit
+}
+
+// Timeouts bounds how long the controller waits on things
+type Timeouts struct {
+	Acquire     time.Duration `yaml:"acquire"`      // how long a job's agent may take to acquire it
+	Job         time.Duration `yaml:"job"`          // how long a job's agent may run on a sprite, 0 for no limit
+	CancelGrace time.Duration `yaml:"cancel_grace"` // how long a cancelled job's agent has to stop after TERM before it's killed
+	Drain       time.Duration `yaml:"drain"`        // how long to wait for running jobs, agent installs and sprite creations and deletions when shutting down
+	Stall       time.Duration `yaml:"stall"`        // how long the poll loop can go without running before /healthz fails
+	PollFailure time.Duration `yaml:"poll_failure"` // how long polling can keep failing before /readyz fails
+}
+
+// Retry is how starting the agent on a sprite is retried when it fails
+// for a reason that's worth another attempt, e.g. the connection dropping
+type Retry struct {
+	MaxAttempts int           `yaml:"max_attempts"` // attempts including the first, 1 never retries
+	BaseDelay   time.Duration `yaml:"base_delay"`   // wait before the first retry, doubled for each one after
+	MaxDelay    time.Duration `yaml:"max_delay"`    // longest wait between attempts
+	Jitter      float64       `yaml:"jitter"`       // fraction of the wait randomly added or taken away
+}
+
+// Default returns the configuration used for anything not set in a file or by flags
+func Default() *Config {
+	return &Config{
+		StackKey:          "bk-sprites",
+		PollInterval:      time.Second,
+		ReservationExpiry: 30 * time.Second,
+		PriorityAging:     5 * time.Minute,
+		ScaleInterval:     10 * time.Second,
+		LogLevel:          "info",
+		Backend:           BackendSprites,
+		Queues:            []Queue{{Key: "default"}},
+		Pools: []Pool{
+			{Name: "default", Sprites: []Sprite{{Name: "bk-test-1"}}},
+		},
+		Timeouts: Timeouts{
+			Acquire:     5 * time.Minute,
+			CancelGrace: 30 * time.Second,
+			Drain:       5 * time.Minute,
+			Stall:       2 * time.Minute,
+			PollFailure: time.Minute,
+		},
+		Retry: Retry{
+			MaxAttempts: 3,
+			BaseDelay:   2 * time.Second,
+			MaxDelay:    30 * time.Second,
+			Jitter:      0.2,
+		},
+	}
+}
+
+// Load reads the config file at path on top of the defaults. The result
+// should be validated once any overrides have been applied.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening config file: %w", err)
+	}
+	defer f.Close()
+
+	cfg, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func parse(r io.Reader) (*Config, error) {
+	cfg := Default()
+
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// UnmarshalYAML accepts either a mapping or a name:key=value,... string
+func (s *Sprite) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		name, tags, err := pool.ParseSpriteSpec(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		s.Name, s.Tags = name, tags
+		return nil
+	}
+
+	// A distinct type so decoding the mapping doesn't recurse back into this method
+	type plain Sprite
+	return node.Decode((*plain)(s))
+}
+
+// Validate checks the configuration, returning every problem found
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.StackKey == "" {
+		fail("stack_key", "is required")
+	}
+	if c.PollInterval <= 0 {
+		fail("poll_interval", "must be positive, got %s", c.PollInterval)
+	}
+	if c.ReservationExpiry < time.Second {
+		fail("reservation_expiry", "must be at least 1s, got %s", c.ReservationExpiry)
+	}
+	if c.PriorityAging < 0 {
+		fail("priority_aging", "must not be negative, got %s", c.PriorityAging)
+	}
+	if c.ScaleInterval <= 0 {
+		fail("scale_interval", "must be positive, got %s", c.ScaleInterval)
+	}
+	if c.AffinityWait < 0 {
+		fail("affinity_wait", "must not be negative, got %s", c.AffinityWait)
+	}
+	if c.MaxConcurrency < 0 {
+		fail("max_concurrency", "must not be negative, got %d", c.MaxConcurrency)
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		fail("log_level", "%q is not one of debug, info, warn, error", c.LogLevel)
+	}
+	if c.Backend != BackendSprites && c.Backend != BackendLocal {
+		fail("backend", "%q is not one of %s, %s", c.Backend, BackendSprites, BackendLocal)
+	}
+
+	if len(c.Queues) == 0 {
+		fail("queues", "at least one queue is required")
+	}
+	queues := make(map[string]bool)
+	stackKeys := make(map[string]bool)
+	for i, q := range c.Queues {
+		field := fmt.Sprintf("queues[%d]", i)
+		switch {
+		case q.Key == "":
+			fail(field+".key", "is required")
+		case queues[q.Key]:
+			fail(field+".key", "duplicate queue %q", q.Key)
+		}
+		queues[q.Key] = true
+
+		if stackKey := c.QueueStackKey(q); stackKeys[stackKey] {
+			fail(field+".stack_key", "stack %q is already used by another queue", stackKey)
+		} else {
+			stackKeys[stackKey] = true
+		}
+		if q.PollInterval < 0 {
+			fail(field+".poll_interval", "must not be negative, got %s", q.PollInterval)
+		}
+		if q.ReservationExpiry != 0 && q.ReservationExpiry < time.Second {
+			fail(field+".reservation_expiry", "must be at least 1s, got %s", q.ReservationExpiry)
+		}
+		if q.Weight < 0 {
+			fail(field+".weight", "must not be negative, got %d", q.Weight)
+		}
+		for j, name := range q.Pools {
+			if !slices.ContainsFunc(c.Pools, func(p Pool) bool { return p.Name == name }) {
+				fail(fmt.Sprintf("%s.pools[%d]", field, j), "no pool named %q", name)
+			}
+		}
+		if stall := c.Timeouts.Stall; stall > 0 && stall <= c.QueuePollInterval(q) {
+			fail("timeouts.stall", "%s must be longer than the poll interval of queue %q (%s)", stall, q.Key, c.QueuePollInterval(q))
+		}
+	}
+	if len(c.Pools) == 0 {
+		fail("pools", "at least one pool is required")
+	}
+	pools := make(map[string]bool)
+	sprites := make(map[string]string) // sprite name -> field it was first seen at
+	for i, p := range c.Pools {
+		field := fmt.Sprintf("pools[%d]", i)
+		switch {
+		case p.Name == "":
+			fail(field+".name", "is required")
+		case pools[p.Name]:
+			fail(field+".name", "duplicate pool %q", p.Name)
+		}
+		pools[p.Name] = true
+
+		if p.ReservationExpiry != 0 && p.ReservationExpiry < time.Second {
+			fail(field+".reservation_expiry", "must be at least 1s, got %s", p.ReservationExpiry)
+		}
+		if p.MinAgents < 0 {
+			fail(field+".min_agents", "must not be negative, got %d", p.MinAgents)
+		}
+		if p.MaxAgents < 0 {
+			fail(field+".max_agents", "must not be negative, got %d", p.MaxAgents)
+		}
+		if p.MaxAgents > 0 && p.MinAgents > p.MaxAgents {
+			fail(field+".min_agents", "%d is greater than max_agents (%d)", p.MinAgents, p.MaxAgents)
+		}
+		if p.IdleTimeout < 0 {
+			fail(field+".idle_timeout", "must not be negative, got %s", p.IdleTimeout)
+		}
+		if p.MaxJobs < 0 {
+			fail(field+".max_jobs", "must not be negative, got %d", p.MaxJobs)
+		}
+		if p.MaxAge < 0 {
+			fail(field+".max_age", "must not be negative, got %s", p.MaxAge)
+		}
+		if p.JobTimeout != nil && *p.JobTimeout < 0 {
+			fail(field+".job_timeout", "must not be negative, got %s", *p.JobTimeout)
+		}
+		for key := range p.Tags {
+			if key == "" {
+				fail(field+".tags", "tag keys must not be empty")
+			}
+		}
+		switch p.Mode {
+		case "", PoolModeStatic:
+			if p.MinAgents > len(p.Sprites) && p.ProvisionScript == "" {
+				fail(field+".provision_script", "is required to create sprites up to min_agents (%d)", p.MinAgents)
+			}
+			if p.ProvisionScript == "" && (p.IdleTimeout > 0 || p.MaxJobs > 0 || p.MaxAge > 0) {
+				fail(field+".provision_script", "is required to retire sprites, only sprites created for the pool are destroyed")
+			}
+		case PoolModeEphemeral:
+			if len(p.Sprites) > 0 {
+				fail(field+".sprites", "ephemeral pools create a sprite for each job and can't list sprites")
+			}
+			if p.MaxAgents == 0 {
+				fail(field+".max_agents", "is required for ephemeral pools")
+			}
+			if p.ProvisionScript == "" {
+				fail(field+".provision_script", "is required for ephemeral pools")
+			}
+			if p.Checkpoint != "" {
+				fail(field+".checkpoint", "ephemeral pools destroy their sprites after every job and can't restore a checkpoint")
+			}
+			if p.IdleTimeout > 0 || p.MaxJobs > 0 || p.MaxAge > 0 {
+				fail(field, "ephemeral pools destroy their sprites after every job, idle_timeout, max_jobs and max_age don't apply")
+			}
+		default:
+			fail(field+".mode", "%q is not one of %s, %s", p.Mode, PoolModeStatic, PoolModeEphemeral)
+		}
+		if c.Backend == BackendLocal {
+			if p.Checkpoint != "" {
+				fail(field+".checkpoint", "checkpoints aren't supported by the local backend")
+			}
+			if !p.Ephemeral() && p.ProvisionScript != "" {
+				fail(field+".provision_script", "the local backend only provisions sprites for ephemeral pools")
+			}
+			if !p.Ephemeral() && p.Agent.Version != "" {
+				fail(field+".agent.version", "the local backend runs the installed buildkite-agent and can't pin its version")
+			}
+		}
+		for j, flag := range p.Agent.Flags {
+			if !strings.HasPrefix(flag, "-") {
+				fail(fmt.Sprintf("%s.agent.flags[%d]", field, j), "%q is not a flag, values go in the same entry e.g. --tags=os=linux", flag)
+			}
+		}
+
+		for j, s := range p.Sprites {
+			spriteField := fmt.Sprintf("%s.sprites[%d]", field, j)
+			if s.Name == "" {
+				fail(spriteField+".name", "is required")
+				continue
+			}
+			if first, ok := sprites[s.Name]; ok {
+				fail(spriteField+".name", "sprite %q is already configured at %s", s.Name, first)
+				continue
+			}
+			sprites[s.Name] = spriteField
+			for key := range s.Tags {
+				if key == "" {
+					fail(spriteField+".tags", "tag keys must not be empty")
+				}
+			}
+		}
+	}
+
+	pipelines := make(map[string]bool)
+	for i, p := range c.Pipelines {
+		field := fmt.Sprintf("pipelines[%d]", i)
+		switch {
+		case p.Slug == "":
+			fail(field+".slug", "is required")
+		case pipelines[p.Slug]:
+			fail(field+".slug", "duplicate pipeline %q", p.Slug)
+		}
+		pipelines[p.Slug] = true
+
+		if p.JobTimeout != nil && *p.JobTimeout < 0 {
+			fail(field+".job_timeout", "must not be negative, got %s", *p.JobTimeout)
+		}
+	}
+
+	if c.Timeouts.Acquire <= 0 {
+		fail("timeouts.acquire", "must be positive, got %s", c.Timeouts.Acquire)
+	}
+	for _, t := range []struct {
+		field string
+		d     time.Duration
+	}{
+		{"timeouts.job", c.Timeouts.Job},
+		{"timeouts.cancel_grace", c.Timeouts.CancelGrace},
+		{"timeouts.drain", c.Timeouts.Drain},
+		{"timeouts.stall", c.Timeouts.Stall},
+		{"timeouts.poll_failure", c.Timeouts.PollFailure},
+	} {
+		if t.d < 0 {
+			fail(t.field, "must not be negative, got %s", t.d)
+		}
+	}
+
+	if c.Retry.MaxAttempts < 1 {
+		fail("retry.max_attempts", "must be at least 1, got %d", c.Retry.MaxAttempts)
+	}
+	if c.Retry.BaseDelay < 0 {
+		fail("retry.base_delay", "must not be negative, got %s", c.Retry.BaseDelay)
+	}
+	if c.Retry.MaxDelay < c.Retry.BaseDelay {
+		fail("retry.max_delay", "%s is shorter than base_delay (%s)", c.Retry.MaxDelay, c.Retry.BaseDelay)
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		fail("retry.jitter", "must be between 0 and 1, got %g", c.Retry.Jitter)
+	}
+	return errors.Join(errs...)
+}
+
+// QueueStackKey returns the key of the stack registered for the queue
+func (c *Config) QueueStackKey(q Queue) string {
+	switch {
+	case q.StackKey != "":
+		return q.StackKey
+	case len(c.Queues) > 1:
+		return c.StackKey + "-" + q.Key
+	default:
+		return c.StackKey
+	}
+}
+
+// QueuePollInterval returns how often the queue is polled
+func (c *Config) QueuePollInterval(q Queue) time.Duration {
+	if q.PollInterval > 0 {
+		return q.PollInterval
+	}
+	return c.PollInterval
+}
+
+// QueueReservationExpiry returns how long reservations on the queue are
+// held for, unless the pool a job is placed in overrides it
+func (c *Config) QueueReservationExpiry(q Queue) time.Duration {
+	if q.ReservationExpiry > 0 {
+		return q.ReservationExpiry
+	}
+	return c.ReservationExpiry
+}
+
+// PoolReservationExpiries returns the reservation expiry of every pool that
+// overrides it, keyed by pool name. Ephemeral pools always do, with
+// EphemeralReservationExpiry if they don't set one.
+func (c *Config) PoolReservationExpiries() map[string]time.Duration {
+	expiries := make(map[string]time.Duration)
+	for _, p := range c.Pools {
+		switch {
+		case p.ReservationExpiry > 0:
+			expiries[p.Name] = p.ReservationExpiry
+		case p.Ephemeral():
+			expiries[p.Name] = EphemeralReservationExpiry
+		}
+	}
+	return expiries
+}
+
+// PoolJobTimeouts returns the job timeout of every pool that overrides it,
+// keyed by pool name
+func (c *Config) PoolJobTimeouts() map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for _, p := range c.Pools {
+		if p.JobTimeout != nil {
+			timeouts[p.Name] = *p.JobTimeout
+		}
+	}
+	return timeouts
+}
+
+// PipelineJobTimeouts returns the job timeout of every pipeline that
+// overrides it, keyed by pipeline slug
+func (c *Config) PipelineJobTimeouts() map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for _, p := range c.Pipelines {
+		if p.JobTimeout != nil {
+			timeouts[p.Slug] = *p.JobTimeout
+		}
+	}
+	return timeouts
+}
+
+// Templates returns the agent settings of each pool, keyed by pool name
+func (c *Config) Templates() map[string]types.AgentSprite {
+	templates := make(map[string]types.AgentSprite, len(c.Pools))
+	for _, p := range c.Pools {
+		templates[p.Name] = p.Template()
+	}
+	return templates
+}
+
+// Ephemeral reports whether the pool creates a sprite for each job
+func (p Pool) Ephemeral() bool {
+	return p.Mode == PoolModeEphemeral
+}
+
+// Template returns the settings shared by every sprite in the pool
+func (p Pool) Template() types.AgentSprite {
+	return types.AgentSprite{
+		ConfigFile: p.ConfigFile,
+		Checkpoint: p.Checkpoint,
+		MinAgents:  p.MinAgents,
+		MaxAgents:  p.MaxAgents,
+		Agent: types.BuildkiteAgent{
+			Version: p.Agent.Version,
+			Flags:   p.Agent.Flags,
+		},
+	}
+}
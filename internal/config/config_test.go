@@ -0,0 +1,423 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefault(t *testing.T) {
+	cfg := Default()
+
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, "bk-sprites", cfg.StackKey)
+	assert.Equal(t, []Queue{{Key: "default"}}, cfg.Queues)
+	assert.Equal(t, "bk-test-1", cfg.Pools[0].Sprites[0].Name)
+}
+
+func TestParse(t *testing.T) {
+	input := `
+stack_key: my-stack
+poll_interval: 5s
+queues:
+  - key: sprites
+pools:
+  - name: linux
+    config_file: /etc/buildkite-agent.cfg
+    min_agents: 1
+    max_agents: 2
+    agent:
+      version: 3.112.0
+      flags: ["--tags-from-host"]
+    sprites:
+      - name: bk-1
+        tags:
+          os: linux
+      - bk-2:os=linux,docker=true
+timeouts:
+  job: 30m
+`
+	cfg, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	assert.Equal(t, "my-stack", cfg.StackKey)
+	assert.Equal(t, 5*time.Second, cfg.PollInterval)
+	assert.Equal(t, []Queue{{Key: "sprites"}}, cfg.Queues)
+
+	require.Len(t, cfg.Pools, 1)
+	p := cfg.Pools[0]
+	assert.Equal(t, "linux", p.Name)
+	assert.Equal(t, []Sprite{
+		{Name: "bk-1", Tags: map[string]string{"os": "linux"}},
+		{Name: "bk-2", Tags: map[string]string{"os": "linux", "docker": "true"}},
+	}, p.Sprites)
+
+	// Unset values keep their defaults
+	assert.Equal(t, 30*time.Second, cfg.ReservationExpiry)
+	assert.Equal(t, 30*time.Minute, cfg.Timeouts.Job)
+	assert.Equal(t, 5*time.Minute, cfg.Timeouts.Drain)
+
+	template := cfg.Templates()["linux"]
+	assert.Equal(t, "/etc/buildkite-agent.cfg", template.ConfigFile)
+	assert.Equal(t, 1, template.MinAgents)
+	assert.Equal(t, 2, template.MaxAgents)
+	assert.Equal(t, "3.112.0", template.Agent.Version)
+	assert.Equal(t, []string{"--tags-from-host"}, template.Agent.Flags)
+}
+
+func TestParse_Empty(t *testing.T) {
+	cfg, err := parse(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			input:   "stack_key: a\npoll_intervall: 1s\n",
+			wantErr: "line 2: field poll_intervall not found",
+		},
+		{
+			name:    "bad duration",
+			input:   "poll_interval: soon\n",
+			wantErr: "line 1: cannot unmarshal !!str `soon` into time.Duration",
+		},
+		{
+			name:    "bad sprite spec",
+			input:   "pools:\n  - name: a\n    sprites:\n      - \"bk-1:os\"\n",
+			wantErr: "line 4:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse(strings.NewReader(tt.input))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr []string
+	}{
+		{
+			name:    "missing stack key",
+			modify:  func(c *Config) { c.StackKey = "" },
+			wantErr: []string{"stack_key: is required"},
+		},
+		{
+			name:    "reservation expiry too short",
+			modify:  func(c *Config) { c.ReservationExpiry = 500 * time.Millisecond },
+			wantErr: []string{"reservation_expiry: must be at least 1s, got 500ms"},
+		},
+		{
+			name:    "bad log level",
+			modify:  func(c *Config) { c.LogLevel = "loud" },
+			wantErr: []string{`log_level: "loud" is not one of`},
+		},
+		{
+			name:    "unknown backend",
+			modify:  func(c *Config) { c.Backend = "kubernetes" },
+			wantErr: []string{`backend: "kubernetes" is not one of sprites, local`},
+		},
+		{
+			name: "local backend with sprite-only pool settings",
+			modify: func(c *Config) {
+				c.Backend = BackendLocal
+				c.Pools[0].Checkpoint = "golden"
+				c.Pools[0].ProvisionScript = "provision.sh"
+				c.Pools[0].Agent.Version = "3.112.0"
+			},
+			wantErr: []string{
+				"pools[0].checkpoint: checkpoints aren't supported by the local backend",
+				"pools[0].provision_script: the local backend only provisions sprites for ephemeral pools",
+				"pools[0].agent.version: the local backend runs the installed buildkite-agent and can't pin its version",
+			},
+		},
+		{
+			name:    "no queues",
+			modify:  func(c *Config) { c.Queues = nil },
+			wantErr: []string{"queues: at least one queue is required"},
+		},
+		{
+			name:    "duplicate queue",
+			modify:  func(c *Config) { c.Queues = []Queue{{Key: "a"}, {Key: "a"}} },
+			wantErr: []string{`queues[1].key: duplicate queue "a"`},
+		},
+		{
+			name:    "unknown pool",
+			modify:  func(c *Config) { c.Queues[0].Pools = []string{"default", "missing"} },
+			wantErr: []string{`queues[0].pools[1]: no pool named "missing"`},
+		},
+		{
+			name: "shared stack key",
+			modify: func(c *Config) {
+				c.Queues = []Queue{{Key: "a", StackKey: "shared"}, {Key: "b", StackKey: "shared"}}
+			},
+			wantErr: []string{`queues[1].stack_key: stack "shared" is already used by another queue`},
+		},
+		{
+			name:    "negative weight",
+			modify:  func(c *Config) { c.Queues[0].Weight = -1 },
+			wantErr: []string{"queues[0].weight: must not be negative, got -1"},
+		},
+		{
+			name: "stall timeout shorter than a queue poll interval",
+			modify: func(c *Config) {
+				c.Queues[0].PollInterval = 5 * time.Minute
+			},
+			wantErr: []string{`timeouts.stall: 2m0s must be longer than the poll interval of queue "default" (5m0s)`},
+		},
+		{
+			name: "min agents above max",
+			modify: func(c *Config) {
+				c.Pools[0].MinAgents = 3
+				c.Pools[0].MaxAgents = 2
+			},
+			wantErr: []string{"pools[0].min_agents: 3 is greater than max_agents (2)"},
+		},
+		{
+			name: "duplicate sprite across pools",
+			modify: func(c *Config) {
+				c.Pools = append(c.Pools, Pool{Name: "other", Sprites: []Sprite{{Name: "bk-test-1"}}})
+			},
+			wantErr: []string{`pools[1].sprites[0].name: sprite "bk-test-1" is already configured at pools[0].sprites[0]`},
+		},
+		{
+			name:    "flag value without a flag",
+			modify:  func(c *Config) { c.Pools[0].Agent.Flags = []string{"--tags", "os=linux"} },
+			wantErr: []string{`pools[0].agent.flags[1]: "os=linux" is not a flag`},
+		},
+		{
+			name:    "unknown pool mode",
+			modify:  func(c *Config) { c.Pools[0].Mode = "spot" },
+			wantErr: []string{`pools[0].mode: "spot" is not one of static, ephemeral`},
+		},
+		{
+			name: "ephemeral pool with sprites and no limit",
+			modify: func(c *Config) {
+				c.Pools[0].Mode = PoolModeEphemeral
+			},
+			wantErr: []string{
+				"pools[0].sprites: ephemeral pools create a sprite for each job and can't list sprites",
+				"pools[0].max_agents: is required for ephemeral pools",
+				"pools[0].provision_script: is required for ephemeral pools",
+			},
+		},
+		{
+			name: "checkpoint on an ephemeral pool",
+			modify: func(c *Config) {
+				c.Pools[0] = Pool{Name: "clean", Mode: PoolModeEphemeral, ProvisionScript: "provision.sh", MaxAgents: 1, Checkpoint: "golden"}
+			},
+			wantErr: []string{"pools[0].checkpoint: ephemeral pools destroy their sprites after every job"},
+		},
+		{
+			name:    "negative affinity wait",
+			modify:  func(c *Config) { c.AffinityWait = -time.Second },
+			wantErr: []string{"affinity_wait: must not be negative, got -1s"},
+		},
+		{
+			name: "invalid retry policy",
+			modify: func(c *Config) {
+				c.Retry.MaxAttempts = 0
+				c.Retry.MaxDelay = time.Second
+				c.Retry.Jitter = 1.5
+			},
+			wantErr: []string{
+				"retry.max_attempts: must be at least 1, got 0",
+				"retry.max_delay: 1s is shorter than base_delay (2s)",
+				"retry.jitter: must be between 0 and 1, got 1.5",
+			},
+		},
+		{
+			name:    "min agents without a provision script",
+			modify:  func(c *Config) { c.Pools[0].MinAgents = 2 },
+			wantErr: []string{"pools[0].provision_script: is required to create sprites up to min_agents (2)"},
+		},
+		{
+			name: "negative retirement limits",
+			modify: func(c *Config) {
+				c.Pools[0].ProvisionScript = "provision.sh"
+				c.Pools[0].IdleTimeout = -time.Minute
+				c.Pools[0].MaxJobs = -1
+				c.Pools[0].MaxAge = -time.Hour
+			},
+			wantErr: []string{
+				"pools[0].idle_timeout: must not be negative, got -1m0s",
+				"pools[0].max_jobs: must not be negative, got -1",
+				"pools[0].max_age: must not be negative, got -1h0m0s",
+			},
+		},
+		{
+			name:    "retirement without a provision script",
+			modify:  func(c *Config) { c.Pools[0].MaxJobs = 10 },
+			wantErr: []string{"pools[0].provision_script: is required to retire sprites"},
+		},
+		{
+			name: "retirement on an ephemeral pool",
+			modify: func(c *Config) {
+				c.Pools[0] = Pool{Name: "clean", Mode: PoolModeEphemeral, ProvisionScript: "provision.sh", MaxAgents: 1, IdleTimeout: time.Minute}
+			},
+			wantErr: []string{"pools[0]: ephemeral pools destroy their sprites after every job, idle_timeout"},
+		},
+		{
+			name: "invalid job timeouts",
+			modify: func(c *Config) {
+				negative := -time.Minute
+				c.Pools[0].JobTimeout = &negative
+				c.Pipelines = []Pipeline{{Slug: "nightly"}, {Slug: "nightly"}, {JobTimeout: &negative}}
+				c.Timeouts.Acquire = 0
+			},
+			wantErr: []string{
+				"pools[0].job_timeout: must not be negative, got -1m0s",
+				`pipelines[1].slug: duplicate pipeline "nightly"`,
+				"pipelines[2].slug: is required",
+				"pipelines[2].job_timeout: must not be negative, got -1m0s",
+				"timeouts.acquire: must be positive, got 0s",
+			},
+		},
+		{
+			name:    "stall timeout shorter than poll interval",
+			modify:  func(c *Config) { c.Timeouts.Stall = 500 * time.Millisecond },
+			wantErr: []string{`timeouts.stall: 500ms must be longer than the poll interval of queue "default" (1s)`},
+		},
+		{
+			name: "every problem is reported",
+			modify: func(c *Config) {
+				c.StackKey = ""
+				c.Pools[0].Name = ""
+				c.Timeouts.Job = -time.Second
+			},
+			wantErr: []string{
+				"stack_key: is required",
+				"pools[0].name: is required",
+				"timeouts.job: must not be negative, got -1s",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			require.Error(t, err)
+			for _, want := range tt.wantErr {
+				assert.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestValidate_LocalBackend(t *testing.T) {
+	cfg := Default()
+	cfg.Backend = BackendLocal
+	require.NoError(t, cfg.Validate())
+
+	// Ephemeral pools provision their directories with the pinned agent version
+	cfg.Pools = []Pool{{Name: "clean", Mode: PoolModeEphemeral, MaxAgents: 2, ProvisionScript: "provision.sh", Agent: Agent{Version: "3.112.0"}}}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestQueueSettings(t *testing.T) {
+	cfg := Default()
+	assert.Equal(t, "bk-sprites", cfg.QueueStackKey(cfg.Queues[0]))
+	assert.Equal(t, time.Second, cfg.QueuePollInterval(cfg.Queues[0]))
+
+	cfg.Queues = []Queue{
+		{Key: "builds"},
+		{Key: "deploys", StackKey: "deployer", PollInterval: 10 * time.Second},
+	}
+	require.NoError(t, cfg.Validate())
+
+	// Each queue gets its own stack when there are several
+	assert.Equal(t, "bk-sprites-builds", cfg.QueueStackKey(cfg.Queues[0]))
+	assert.Equal(t, "deployer", cfg.QueueStackKey(cfg.Queues[1]))
+	assert.Equal(t, time.Second, cfg.QueuePollInterval(cfg.Queues[0]))
+	assert.Equal(t, 10*time.Second, cfg.QueuePollInterval(cfg.Queues[1]))
+}
+
+func TestReservationExpiry(t *testing.T) {
+	cfg := Default()
+	cfg.Queues = []Queue{{Key: "builds"}, {Key: "deploys", ReservationExpiry: time.Minute}}
+	cfg.Pools = append(cfg.Pools,
+		Pool{Name: "slow", ReservationExpiry: 5 * time.Minute},
+		Pool{Name: "clean", Mode: PoolModeEphemeral, MaxAgents: 1, ProvisionScript: "provision.sh"},
+		Pool{Name: "quick", Mode: PoolModeEphemeral, MaxAgents: 1, ProvisionScript: "provision.sh", ReservationExpiry: 3 * time.Minute},
+	)
+	require.NoError(t, cfg.Validate())
+
+	assert.Equal(t, 30*time.Second, cfg.QueueReservationExpiry(cfg.Queues[0]))
+	assert.Equal(t, time.Minute, cfg.QueueReservationExpiry(cfg.Queues[1]))
+
+	// Ephemeral pools have time to provision a sprite unless they say otherwise
+	assert.Equal(t, map[string]time.Duration{
+		"slow":  5 * time.Minute,
+		"clean": EphemeralReservationExpiry,
+		"quick": 3 * time.Minute,
+	}, cfg.PoolReservationExpiries())
+
+	cfg.Pools[1].ReservationExpiry = time.Millisecond
+	assert.ErrorContains(t, cfg.Validate(), "pools[1].reservation_expiry: must be at least 1s, got 1ms")
+}
+
+func TestJobTimeouts(t *testing.T) {
+	input := `
+pools:
+  - name: linux
+    sprites: [bk-1]
+  - name: deploy
+    job_timeout: 0s
+    sprites: [bk-2]
+pipelines:
+  - slug: nightly
+    job_timeout: 3h
+  - slug: release
+timeouts:
+  job: 1h
+`
+	cfg, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	assert.Equal(t, time.Hour, cfg.Timeouts.Job)
+	assert.Equal(t, 5*time.Minute, cfg.Timeouts.Acquire)
+	// 0 lifts the limit rather than falling back to timeouts.job
+	assert.Equal(t, map[string]time.Duration{"deploy": 0}, cfg.PoolJobTimeouts())
+	assert.Equal(t, map[string]time.Duration{"nightly": 3 * time.Hour}, cfg.PipelineJobTimeouts())
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bksprites.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("stack_key: from-file\nbogus: true\n"), 0o600))
+
+	_, err := Load(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), path+": ")
+	assert.Contains(t, err.Error(), "line 2: field bogus not found")
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoad_Example(t *testing.T) {
+	cfg, err := Load("../../examples/bksprites.yaml")
+	require.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+}
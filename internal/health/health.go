@@ -0,0 +1,199 @@
+// Package health tracks whether the controller is alive and ready to take
+// jobs, and serves that state over HTTP for orchestrator probes
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+var (
+	ErrNotRegistered  = errors.New("stack is not registered")
+	ErrMonitorStopped = errors.New("monitor has stopped")
+)
+
+// Checker records the state of the controller as it runs. Liveness only
+// fails when a monitor loop has stalled, readiness additionally requires
+// the stacks to be registered and polling to be succeeding on every queue.
+type Checker struct {
+	mu         sync.Mutex
+	registered bool
+	loops      []*Loop
+
+	stallTimeout     time.Duration
+	failureThreshold time.Duration
+
+	now func() time.Time
+}
+
+// Loop tracks a single monitor loop. A nil Loop ignores updates, so
+// callers don't need to check whether health reporting is enabled.
+type Loop struct {
+	checker *Checker
+	name    string
+
+	// Guarded by checker.mu
+	running      bool
+	stopped      bool
+	lastTick     time.Time // start of the most recent loop iteration
+	failingSince time.Time // first poll failure since the last success, zero if polling is healthy
+	lastPollErr  error
+}
+
+// NewChecker returns a Checker that reports a monitor loop as stalled when
+// it hasn't ticked for stallTimeout, and not ready once its polling has been
+// failing for failureThreshold. A zero duration disables that check.
+func NewChecker(stallTimeout, failureThreshold time.Duration) *Checker {
+	return &Checker{
+		stallTimeout:     stallTimeout,
+		failureThreshold: failureThreshold,
+		now:              time.Now,
+	}
+}
+
+// SetRegistered records whether the stacks are currently registered with Buildkite
+func (c *Checker) SetRegistered(registered bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.registered = registered
+}
+
+// Loop returns a tracker for the named monitor loop, e.g. one per queue
+func (c *Checker) Loop(name string) *Loop {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := &Loop{checker: c, name: name}
+	c.loops = append(c.loops, l)
+	return l
+}
+
+// Started records that the loop has started
+func (l *Loop) Started() {
+	l.update(func(now time.Time) {
+		l.running = true
+		l.stopped = false
+		l.lastTick = now
+	})
+}
+
+// Stopped records that the loop has returned. A stopped loop is alive,
+// e.g. while draining, but no longer ready.
+func (l *Loop) Stopped() {
+	l.update(func(time.Time) {
+		l.running = false
+		l.stopped = true
+	})
+}
+
+// Tick records that the loop is making progress
+func (l *Loop) Tick() {
+	l.update(func(now time.Time) {
+		l.lastTick = now
+	})
+}
+
+// PollSucceeded records a successful poll of the queue
+func (l *Loop) PollSucceeded() {
+	l.update(func(time.Time) {
+		l.failingSince = time.Time{}
+		l.lastPollErr = nil
+	})
+}
+
+// PollFailed records a failed poll of the queue
+func (l *Loop) PollFailed(err error) {
+	l.update(func(now time.Time) {
+		if l.failingSince.IsZero() {
+			l.failingSince = now
+		}
+		l.lastPollErr = err
+	})
+}
+
+func (l *Loop) update(fn func(now time.Time)) {
+	if l == nil {
+		return
+	}
+	l.checker.mu.Lock()
+	defer l.checker.mu.Unlock()
+	fn(l.checker.now())
+}
+
+// Live returns an error if any monitor loop has stalled
+func (c *Checker) Live() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.live()
+}
+
+func (c *Checker) live() error {
+	if c.stallTimeout == 0 {
+		return nil
+	}
+	for _, l := range c.loops {
+		if !l.running {
+			continue
+		}
+		if since := c.now().Sub(l.lastTick); since > c.stallTimeout {
+			return fmt.Errorf("%s: monitor loop hasn't run for %s", l.name, since.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// Ready returns an error if the controller shouldn't be considered able to run jobs
+func (c *Checker) Ready() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.live(); err != nil {
+		return err
+	}
+	if !c.registered {
+		return ErrNotRegistered
+	}
+	for _, l := range c.loops {
+		if l.stopped {
+			return fmt.Errorf("%s: %w", l.name, ErrMonitorStopped)
+		}
+		if c.failureThreshold > 0 && !l.failingSince.IsZero() {
+			if since := c.now().Sub(l.failingSince); since > c.failureThreshold {
+				return fmt.Errorf("%s: polling has been failing for %s: %w", l.name, since.Round(time.Second), l.lastPollErr)
+			}
+		}
+	}
+	return nil
+}
+
+// Register adds the liveness and readiness endpoints to mux
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc(LivenessPath, probeHandler(c.Live))
+	mux.HandleFunc(ReadinessPath, probeHandler(c.Ready))
+}
+
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
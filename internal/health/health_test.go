@@ -0,0 +1,137 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestChecker returns a checker whose clock is controlled by the returned func
+func newTestChecker(stallTimeout, failureThreshold time.Duration) (*Checker, func(time.Duration)) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewChecker(stallTimeout, failureThreshold)
+	c.now = func() time.Time { return now }
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestChecker_Ready(t *testing.T) {
+	c, advance := newTestChecker(time.Minute, 30*time.Second)
+	builds := c.Loop("builds")
+	deploys := c.Loop("deploys")
+
+	// Not ready until the stack is registered
+	assert.ErrorIs(t, c.Ready(), ErrNotRegistered)
+	assert.NoError(t, c.Live())
+
+	c.SetRegistered(true)
+	builds.Started()
+	deploys.Started()
+	assert.NoError(t, c.Ready())
+
+	// Failures under the threshold are tolerated
+	builds.PollFailed(errors.New("boom"))
+	advance(20 * time.Second)
+	builds.Tick()
+	deploys.Tick()
+	assert.NoError(t, c.Ready())
+
+	builds.PollFailed(errors.New("boom"))
+	advance(20 * time.Second)
+	builds.Tick()
+	deploys.Tick()
+	err := c.Ready()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "builds: polling has been failing for 40s")
+
+	// A success resets the failure window
+	builds.PollSucceeded()
+	assert.NoError(t, c.Ready())
+
+	// Stopping a monitor, e.g. to drain, stops readiness but not liveness
+	deploys.Stopped()
+	assert.ErrorIs(t, c.Ready(), ErrMonitorStopped)
+	assert.Contains(t, c.Ready().Error(), "deploys")
+	builds.Stopped()
+	advance(time.Hour)
+	assert.NoError(t, c.Live())
+}
+
+func TestChecker_Live(t *testing.T) {
+	tests := []struct {
+		name         string
+		stallTimeout time.Duration
+		elapsed      time.Duration
+		wantErr      bool
+	}{
+		{name: "ticking", stallTimeout: time.Minute, elapsed: 30 * time.Second},
+		{name: "stalled", stallTimeout: time.Minute, elapsed: 2 * time.Minute, wantErr: true},
+		{name: "disabled", stallTimeout: 0, elapsed: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, advance := newTestChecker(tt.stallTimeout, 0)
+			c.SetRegistered(true)
+			c.Loop("builds").Started()
+			advance(tt.elapsed)
+
+			if tt.wantErr {
+				assert.Error(t, c.Live())
+				assert.Error(t, c.Ready(), "a stalled monitor is not ready either")
+			} else {
+				assert.NoError(t, c.Live())
+				assert.NoError(t, c.Ready())
+			}
+		})
+	}
+}
+
+func TestChecker_Nil(t *testing.T) {
+	var c *Checker
+
+	assert.NotPanics(t, func() {
+		c.SetRegistered(true)
+		l := c.Loop("builds")
+		l.Started()
+		l.Tick()
+		l.PollFailed(errors.New("boom"))
+		l.PollSucceeded()
+		l.Stopped()
+	})
+}
+
+func TestProbe(t *testing.T) {
+	c, _ := newTestChecker(time.Minute, time.Minute)
+	c.Loop("builds").Started()
+
+	mux := http.NewServeMux()
+	c.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	ctx := context.Background()
+
+	assert.NoError(t, Probe(ctx, addr, LivenessPath))
+
+	err := Probe(ctx, addr, ReadinessPath)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "503")
+	assert.Contains(t, err.Error(), ErrNotRegistered.Error())
+
+	c.SetRegistered(true)
+	assert.NoError(t, Probe(ctx, addr, ReadinessPath))
+
+	// Addresses without a host are probed on localhost
+	_, port, _ := strings.Cut(addr, ":")
+	assert.NoError(t, Probe(ctx, ":"+port, LivenessPath))
+
+	assert.Error(t, Probe(ctx, "not-an-address", LivenessPath))
+}
@@ -0,0 +1,284 @@
+// Package local runs jobs' agents as buildkite-agent processes on the
+// controller's own machine, so the controller can be run without Fly.io
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	logwriter "github.com/jeremybumsted/bksprites/internal/log"
+	"github.com/jeremybumsted/bksprites/internal/metrics"
+)
+
+const (
+	// stderrTailLines is how many of the agent's last stderr lines are kept
+	// to explain a failure
+	stderrTailLines = 20
+
+	agentVersionTimeout = 30 * time.Second
+
+	// waitDelay is how long the agent's output is read after it exits, in
+	// case something it started still holds it open
+	waitDelay = 10 * time.Second
+
+	provisionScriptName    = "provision.sh"
+	installAgentScriptName = "install-agent.sh"
+)
+
+// Backend runs jobs' agents as processes. Each worker is a directory under
+// the backend's, where its agent checks out and runs builds.
+type Backend struct {
+	dir       string
+	agentPath string
+	env       []string // added to the controller's environment for the agent
+}
+
+var _ backend.Backend = (*Backend)(nil)
+
+// Option configures optional Backend behaviour
+type Option func(*Backend)
+
+// WithAgentPath runs the given buildkite-agent binary rather than the one on PATH
+func WithAgentPath(path string) Option {
+	return func(b *Backend) {
+		b.agentPath = path
+	}
+}
+
+// WithAgentToken gives the agents the token to register with
+func WithAgentToken(token string) Option {
+	return func(b *Backend) {
+		b.env = append(b.env, "BUILDKITE_AGENT_TOKEN="+token)
+	}
+}
+
+// NewBackend returns a Backend whose workers are directories under dir
+func NewBackend(dir string, opts ...Option) *Backend {
+	b := &Backend{
+		dir:       dir,
+		agentPath: "buildkite-agent",
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// workerDir returns the directory the worker's builds are run in
+func (b *Backend) workerDir(worker string) string {
+	return filepath.Join(b.dir, worker)
+}
+
+// Provision makes the worker's directory and runs the provision script in
+// it with the given environment, writing the agent install script next to
+// it for the script to pin the agent
+func (b *Backend) Provision(ctx context.Context, worker string, script []byte, env []string) error {
+	if err := b.provision(ctx, worker, script, env); err != nil {
+		return &backend.RunError{Category: backend.CategoryAgentFailed, ExitCode: exitCode(err), Err: err}
+	}
+	return nil
+}
+
+func (b *Backend) provision(ctx context.Context, worker string, script []byte, env []string) error {
+	dir := b.workerDir(worker)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("making worker directory: %w", err)
+	}
+	if len(script) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(dir, provisionScriptName)
+	if err := os.WriteFile(path, script, 0o755); err != nil {
+		return fmt.Errorf("writing provision script: %w", err)
+	}
+	installPath := filepath.Join(dir, installAgentScriptName)
+	if err := os.WriteFile(installPath, []byte(backend.InstallAgentScript), 0o755); err != nil {
+		return fmt.Errorf("writing agent install script: %w", err)
+	}
+
+	provisionLogger := log.With(
+		"component", "provision",
+		"worker", worker,
+	)
+	stdoutWriter := logwriter.NewLogWriter(provisionLogger, log.InfoLevel)
+	stderrWriter := logwriter.NewLogWriter(provisionLogger, log.WarnLevel)
+
+	cmd := exec.CommandContext(ctx, "bash", path)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), env...), backend.InstallAgentEnv+"="+installPath)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	err := cmd.Run()
+	stdoutWriter.Flush()
+	stderrWriter.Flush()
+	if err != nil {
+		return fmt.Errorf("running provision script: %w", err)
+	}
+	return nil
+}
+
+// CheckHealth checks the agent runs
+func (b *Backend) CheckHealth(ctx context.Context, worker string) error {
+	ctx, cancel := context.WithTimeout(ctx, agentVersionTimeout)
+	defer cancel()
+
+	if out, err := exec.CommandContext(ctx, b.agentPath, "--version").CombinedOutput(); err != nil {
+		return fmt.Errorf("running %s --version: %w: %s", b.agentPath, err, out)
+	}
+	return nil
+}
+
+// RunJob runs the job's agent in the worker's directory. Nothing is tried
+// again, a process that fails to start would fail the same way next time.
+func (b *Backend) RunJob(job backend.Job, deadline time.Time) (err error) {
+	log.Info("We'll run this job", "uuid", job.UUID)
+
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return fmt.Errorf("%w before the agent could be started", backend.ErrDispatchDeadline)
+	}
+	if job.Handle.Canceled() {
+		return fmt.Errorf("%w before the agent could be started", backend.ErrJobCanceled)
+	}
+
+	defer func() {
+		if err != nil && !errors.Is(err, backend.ErrJobCanceled) {
+			metrics.JobsDispatchFailed.Inc()
+		}
+	}()
+
+	dir := b.workerDir(job.Worker)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return &backend.RunError{Category: backend.CategoryAgentFailed, ExitCode: -1, Err: fmt.Errorf("making worker directory: %w", err)}
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	args := append(job.AgentStartArgs(), "--build-path", filepath.Join(dir, "builds"))
+	cmd := exec.CommandContext(ctx, b.agentPath, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), b.env...)
+	cmd.WaitDelay = waitDelay
+	cmd.SysProcAttr = agentProcAttr()
+
+	agentLogger := log.With(
+		"component", "buildkite-agent",
+		"jobUUID", job.UUID,
+		"worker", job.Worker,
+	)
+	stdoutWriter := logwriter.NewLogWriter(agentLogger, log.DebugLevel)
+	stderrWriter := logwriter.NewLogWriter(agentLogger, log.WarnLevel, logwriter.WithTail(stderrTailLines))
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	if err := cmd.Start(); err != nil {
+		return &backend.RunError{Category: categorize(err, nil), ExitCode: -1, Err: fmt.Errorf("starting %s: %w", b.agentPath, err)}
+	}
+	metrics.JobsDispatched.Inc()
+	job.MarkStarted()
+
+	job.Handle.Attach(process{cmd.Process}, cancel, agentLogger)
+	stop := job.WatchTimeouts(ctx, cancel)
+	err = cmd.Wait()
+	stop()
+	job.Handle.Detach()
+
+	stdoutWriter.Flush()
+	stderrWriter.Flush()
+
+	if cause := context.Cause(ctx); err != nil && cause != nil {
+		err = fmt.Errorf("%w: %w", cause, err)
+	}
+	if err != nil && job.Handle.Canceled() && !errors.Is(err, backend.ErrJobCanceled) {
+		err = fmt.Errorf("%w: %w", backend.ErrJobCanceled, err)
+	}
+	if err == nil {
+		return nil
+	}
+
+	return &backend.RunError{
+		Category: categorize(err, job.CheckAcquired),
+		ExitCode: exitCode(err),
+		Stderr:   stderrWriter.Tail(),
+		Err:      fmt.Errorf("buildkite-agent exited: %w", err),
+	}
+}
+
+// FindJob never finds a job. Agents are the controller's own processes, so
+// a restarted controller has no way to wait for them.
+func (b *Backend) FindJob(ctx context.Context, worker string, jobUUID string) (string, error) {
+	return "", nil
+}
+
+func (b *Backend) AttachJob(ctx context.Context, job backend.Job, session string) error {
+	return errors.New("agents started by another controller process can't be attached to")
+}
+
+func (b *Backend) RestoreCheckpoint(ctx context.Context, worker string, name string) error {
+	return errors.New("checkpoints aren't supported by the local backend")
+}
+
+// Destroy deletes the worker's directory
+func (b *Backend) Destroy(ctx context.Context, worker string) error {
+	return os.RemoveAll(b.workerDir(worker))
+}
+
+// process sends signals named as the Sprites API names them to a local process
+type process struct {
+	p *os.Process
+}
+
+var signals = map[string]os.Signal{
+	"TERM": syscall.SIGTERM,
+	"KILL": os.Kill,
+}
+
+func (p process) Signal(sig string) error {
+	s, ok := signals[sig]
+	if !ok {
+		return fmt.Errorf("unknown signal %s", sig)
+	}
+	return p.p.Signal(s)
+}
+
+// categorize says what went wrong for an error returned while running the
+// agent. An agent that exited with an error is assumed to have acquired its
+// job unless acquired says otherwise.
+func categorize(err error, acquired func() bool) backend.Category {
+	var exitErr *exec.ExitError
+
+	switch {
+	case errors.Is(err, backend.ErrJobTimeout), errors.Is(err, backend.ErrAcquireTimeout):
+		return backend.CategoryTimeout
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission):
+		return backend.CategoryAgentMissing
+	case errors.As(err, &exitErr):
+		if acquired != nil && !acquired() {
+			return backend.CategoryAcquireRejected
+		}
+		return backend.CategoryAgentFailed
+	default:
+		return backend.CategoryAgentFailed
+	}
+}
+
+// exitCode returns the agent's exit status, or -1 if it didn't exit
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
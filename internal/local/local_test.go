@@ -0,0 +1,179 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+)
+
+// fakeAgent writes a script standing in for buildkite-agent that records
+// its arguments, token and directory in args.txt and then runs body
+func fakeAgent(t *testing.T, body string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "buildkite-agent")
+	script := "#!/bin/sh\n" +
+		`echo "$@" > "` + filepath.Join(dir, "args.txt") + `"` + "\n" +
+		`echo "$BUILDKITE_AGENT_TOKEN $PWD" >> "` + filepath.Join(dir, "args.txt") + `"` + "\n" +
+		body + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0o755))
+	return path
+}
+
+func TestBackend_RunJob(t *testing.T) {
+	agent := fakeAgent(t, "exit 0")
+	dir := t.TempDir()
+	b := NewBackend(dir, WithAgentPath(agent), WithAgentToken("agent-token"))
+
+	require.NoError(t, b.RunJob(backend.Job{UUID: "job-1", Worker: "local-1", AgentFlags: []string{"--debug"}}, time.Time{}))
+
+	out, err := os.ReadFile(filepath.Join(filepath.Dir(agent), "args.txt"))
+	require.NoError(t, err)
+	workerDir := filepath.Join(dir, "local-1")
+	assert.Equal(t, []string{
+		"start --acquire-job job-1 --name bk-sprites-job-1 --debug --build-path " + filepath.Join(workerDir, "builds"),
+		"agent-token " + workerDir,
+	}, strings.Split(strings.TrimSpace(string(out)), "\n"))
+}
+
+func TestBackend_RunJob_Failed(t *testing.T) {
+	notAcquired := func(context.Context) (bool, error) { return false, nil }
+
+	tests := []struct {
+		name         string
+		agent        string // script body, "" for an agent that isn't there
+		job          backend.Job
+		deadline     time.Time
+		wantErr      error
+		wantCategory backend.Category
+		wantExitCode int
+		wantStderr   []string
+		wantStarted  bool // whether the Started hook was called
+	}{
+		{
+			name:         "agent missing",
+			wantCategory: backend.CategoryAgentMissing,
+			wantExitCode: -1,
+		},
+		{
+			name:         "agent failed",
+			agent:        "echo 'job exploded' >&2; exit 3",
+			wantCategory: backend.CategoryAgentFailed,
+			wantExitCode: 3,
+			wantStderr:   []string{"job exploded"},
+			wantStarted:  true,
+		},
+		{
+			name:         "acquire rejected",
+			agent:        "exit 1",
+			job:          backend.Job{Acquired: notAcquired},
+			wantCategory: backend.CategoryAcquireRejected,
+			wantExitCode: 1,
+			wantStarted:  true,
+		},
+		{
+			name:         "job timeout",
+			agent:        "exec sleep 10",
+			job:          backend.Job{JobTimeout: 50 * time.Millisecond},
+			wantErr:      backend.ErrJobTimeout,
+			wantCategory: backend.CategoryTimeout,
+			wantExitCode: -1,
+			wantStarted:  true,
+		},
+		{
+			name:     "deadline passed",
+			agent:    "exit 0",
+			deadline: time.Now().Add(-time.Second),
+			wantErr:  backend.ErrDispatchDeadline,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := filepath.Join(t.TempDir(), "buildkite-agent")
+			if tt.agent != "" {
+				agent = fakeAgent(t, tt.agent)
+			}
+			b := NewBackend(t.TempDir(), WithAgentPath(agent))
+
+			job := tt.job
+			job.UUID, job.Worker = "job-1", "local-1"
+			started := false
+			job.Started = func() { started = true }
+			err := b.RunJob(job, tt.deadline)
+			require.Error(t, err)
+			assert.Equal(t, tt.wantStarted, started)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+			if tt.wantCategory == "" {
+				return
+			}
+
+			var runErr *backend.RunError
+			require.True(t, errors.As(err, &runErr))
+			assert.Equal(t, tt.wantCategory, runErr.Category)
+			assert.Equal(t, tt.wantExitCode, runErr.ExitCode)
+			assert.Equal(t, tt.wantStderr, runErr.Stderr)
+		})
+	}
+}
+
+func TestBackend_RunJob_Cancelled(t *testing.T) {
+	agent := fakeAgent(t, "trap 'exit 143' TERM; while true; do sleep 0.01; done")
+	b := NewBackend(t.TempDir(), WithAgentPath(agent))
+
+	h := &backend.Handle{}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		h.Cancel(time.Second)
+	}()
+
+	err := b.RunJob(backend.Job{UUID: "job-1", Worker: "local-1", Handle: h}, time.Time{})
+	assert.ErrorIs(t, err, backend.ErrJobCanceled)
+
+	var runErr *backend.RunError
+	require.True(t, errors.As(err, &runErr))
+	assert.Equal(t, 143, runErr.ExitCode)
+}
+
+func TestBackend_ProvisionAndDestroy(t *testing.T) {
+	dir := t.TempDir()
+	b := NewBackend(dir)
+
+	script := []byte(`echo "$BUILDKITE_AGENT_VERSION" > version.txt; cp "$BKSPRITES_INSTALL_AGENT" install.txt`)
+	require.NoError(t, b.Provision(context.Background(), "bk-job-1", script, []string{"BUILDKITE_AGENT_VERSION=3.112.0"}))
+
+	out, err := os.ReadFile(filepath.Join(dir, "bk-job-1", "version.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "3.112.0\n", string(out))
+
+	// The script can install the pinned agent the way the controller does
+	out, err = os.ReadFile(filepath.Join(dir, "bk-job-1", "install.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, backend.InstallAgentScript, string(out))
+
+	require.NoError(t, b.Destroy(context.Background(), "bk-job-1"))
+	assert.NoDirExists(t, filepath.Join(dir, "bk-job-1"))
+
+	// A worker that's already gone isn't an error
+	require.NoError(t, b.Destroy(context.Background(), "bk-job-1"))
+}
+
+func TestBackend_CheckHealth(t *testing.T) {
+	healthy := NewBackend(t.TempDir(), WithAgentPath(fakeAgent(t, "echo 'buildkite-agent version 3.112.0'")))
+	assert.NoError(t, healthy.CheckHealth(context.Background(), "local-1"))
+
+	missing := NewBackend(t.TempDir(), WithAgentPath(filepath.Join(t.TempDir(), "buildkite-agent")))
+	assert.Error(t, missing.CheckHealth(context.Background(), "local-1"))
+}
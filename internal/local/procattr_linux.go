@@ -0,0 +1,11 @@
+package local
+
+import "syscall"
+
+// agentProcAttr starts the agent in its own process group, so a Ctrl-C
+// meant for the controller doesn't reach it, and kills it if the
+// controller dies. A restarted controller can't find agents it didn't
+// start, so they must not outlive it.
+func agentProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+}
@@ -0,0 +1,29 @@
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+)
+
+func TestBackend_RunJob_OwnProcessGroup(t *testing.T) {
+	// The 5th field of /proc/<pid>/stat is the process group
+	out := filepath.Join(t.TempDir(), "pgid.txt")
+	agent := fakeAgent(t, `echo "$$ $(cut -d' ' -f5 /proc/$$/stat)" > "`+out+`"`)
+	b := NewBackend(t.TempDir(), WithAgentPath(agent))
+
+	require.NoError(t, b.RunJob(backend.Job{UUID: "job-1", Worker: "local-1"}, time.Time{}))
+
+	ids, err := os.ReadFile(out)
+	require.NoError(t, err)
+	fields := strings.Fields(string(ids))
+	require.Len(t, fields, 2)
+	assert.Equal(t, fields[0], fields[1], "the agent leads its own process group")
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package local
+
+import "syscall"
+
+// agentProcAttr leaves the agent in the controller's process group. Only
+// Linux can kill it when the controller dies, so elsewhere an agent may
+// outlive a controller that crashes.
+func agentProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -2,6 +2,7 @@ package log
 
 import (
 	"bytes"
+	"slices"
 	"sync"
 
 	"github.com/charmbracelet/log"
@@ -10,19 +11,43 @@ import (
 // LogWriter implements io.Writer that sends output to charmbracelet/log.
 // It buffers writes until a newline is encountered, then logs the complete line.
 type LogWriter struct {
-	logger *log.Logger
-	level  log.Level
-	mu     sync.Mutex
-	buf    []byte
+	logger   *log.Logger
+	level    log.Level
+	mu       sync.Mutex
+	buf      []byte
+	tail     []string // the last tailSize lines logged
+	tailSize int
+}
+
+// Option configures optional LogWriter behaviour
+type Option func(*LogWriter)
+
+// WithTail keeps the last n lines logged, so they can be read back with Tail
+func WithTail(n int) Option {
+	return func(w *LogWriter) {
+		w.tailSize = n
+	}
 }
 
 // NewLogWriter creates a new LogWriter that logs to the given logger at the specified level.
-func NewLogWriter(logger *log.Logger, level log.Level) *LogWriter {
-	return &LogWriter{
+func NewLogWriter(logger *log.Logger, level log.Level, opts ...Option) *LogWriter {
+	w := &LogWriter{
 		logger: logger,
 		level:  level,
 		buf:    make([]byte, 0, 256),
 	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Tail returns the last lines logged, oldest first, if the writer was
+// created WithTail
+func (w *LogWriter) Tail() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.tail)
 }
 
 // Write implements io.Writer. It buffers input until complete lines are received,
@@ -51,6 +76,13 @@ func (w *LogWriter) Write(p []byte) (n int, err error) {
 
 // logLine logs a single line at the configured level.
 func (w *LogWriter) logLine(line string) {
+	if w.tailSize > 0 {
+		if len(w.tail) == w.tailSize {
+			w.tail = slices.Delete(w.tail, 0, 1)
+		}
+		w.tail = append(w.tail, line)
+	}
+
 	switch w.level {
 	case log.DebugLevel:
 		w.logger.Debug(line)
@@ -454,3 +454,30 @@ func TestLogWriter_ConsecutiveFlushes(t *testing.T) {
 	assert.Equal(t, 1, infoCount, "should only log once")
 	assert.Contains(t, output, "data")
 }
+
+// TestLogWriter_Tail tests that only the last lines are kept when asked for
+func TestLogWriter_Tail(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf)
+	logger.SetReportTimestamp(false)
+
+	writer := NewLogWriter(logger, log.WarnLevel, WithTail(2))
+	assert.Empty(t, writer.Tail())
+
+	_, err := writer.Write([]byte("line1\nline2\nline3\npartial"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"line2", "line3"}, writer.Tail())
+
+	// A partial line is kept once it's flushed
+	writer.Flush()
+	assert.Equal(t, []string{"line3", "partial"}, writer.Tail())
+
+	// Every line is still logged
+	assert.Equal(t, 4, strings.Count(buf.String(), "WARN"))
+
+	// Writers created without a tail don't keep lines
+	writer = NewLogWriter(logger, log.WarnLevel)
+	_, err = writer.Write([]byte("line1\n"))
+	assert.NoError(t, err)
+	assert.Empty(t, writer.Tail())
+}
@@ -0,0 +1,484 @@
+// Package manager keeps the warm pools of sprites at the size their
+// configuration and the queue backlog call for
+package manager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/sprites"
+)
+
+const (
+	defaultInterval = 10 * time.Second
+
+	// destroyTimeout bounds deleting a sprite
+	destroyTimeout = time.Minute
+)
+
+// Pool is a pool the manager creates sprites for
+type Pool struct {
+	Name            string
+	MinAgents       int               // idle sprites to keep ready
+	MaxAgents       int               // most sprites the pool may have, 0 keeps only MinAgents idle
+	Tags            map[string]string // tags of the sprites created for the pool
+	AgentVersion    string            // buildkite-agent version to install, the latest if empty
+	ProvisionScript []byte
+	Checkpoint      string        // checkpoint recorded once a sprite is provisioned, if any
+	IdleTimeout     time.Duration // idle sprites beyond MinAgents are destroyed after this long, 0 keeps them
+	MaxJobs         int           // sprites are retired after running this many jobs, 0 for no limit
+	MaxAge          time.Duration // sprites are retired once this old, 0 for no limit
+}
+
+// backlog is the jobs a queue has waiting for a sprite
+type backlog struct {
+	pools   []string // pools the queue's jobs can run in, empty for any
+	waiting []pool.QueryRules
+}
+
+// Manager creates sprites for its pools so each has at least MinAgents
+// idle, and more while jobs are waiting, up to MaxAgents. It destroys the
+// sprites it created once they've been idle too long or are due for
+// retirement. It's safe for concurrent use, and its methods do nothing on
+// a nil Manager.
+type Manager struct {
+	registry      *pool.Registry
+	spriteHandler *sprites.SpriteHandler
+	agentToken    string
+	pools         []Pool
+	interval      time.Duration
+
+	// create provisions a new sprite for the pool and destroy deletes one,
+	// both replaced in tests
+	create  func(ctx context.Context, p Pool, name string) error
+	destroy func(ctx context.Context, name string) error
+	now     func() time.Time
+
+	mu           sync.Mutex
+	backlogs     map[string]backlog // by queue
+	provisioning map[string]int     // sprites being created, by pool
+	decisions    map[string]string  // last decision logged, by pool
+	running      sync.WaitGroup
+}
+
+// Option configures optional Manager behaviour
+type Option func(*Manager)
+
+// WithInterval sets how often the pools are checked
+func WithInterval(d time.Duration) Option {
+	return func(m *Manager) {
+		m.interval = d
+	}
+}
+
+func NewManager(registry *pool.Registry, spriteToken string, agentToken string, pools []Pool, opts ...Option) *Manager {
+	m := &Manager{
+		registry:      registry,
+		spriteHandler: sprites.NewSpriteHandlerWithToken(spriteToken),
+		agentToken:    agentToken,
+		pools:         pools,
+		interval:      defaultInterval,
+		backlogs:      make(map[string]backlog),
+		provisioning:  make(map[string]int),
+		decisions:     make(map[string]string),
+	}
+	m.create = m.createSprite
+	m.destroy = m.destroySprite
+	m.now = time.Now
+
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Replaces reports whether the manager destroys and replaces the sprite
+// when it's unhealthy, rather than it being checked again
+func (m *Manager) Replaces(s pool.Sprite) bool {
+	if m == nil {
+		return false
+	}
+	for _, p := range m.pools {
+		if s.Pool == p.Name && createdFor(p.Name, s.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetBacklog records the agent query rules of the jobs the queue has
+// waiting for a sprite, replacing what it reported before
+func (m *Manager) SetBacklog(queue string, pools []string, waiting []pool.QueryRules) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.backlogs[queue] = backlog{pools: pools, waiting: waiting}
+}
+
+// Adopt registers the sprites a previous controller process created for
+// the pools, so they're used rather than left running after a restart
+func (m *Manager) Adopt(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+
+	for _, p := range m.pools {
+		found, err := m.spriteHandler.Client.ListAllSprites(ctx, spritePrefix(p.Name))
+		if err != nil {
+			return fmt.Errorf("listing sprites in pool %s: %w", p.Name, err)
+		}
+		for _, s := range found {
+			if !createdFor(p.Name, s.Name()) {
+				continue
+			}
+			if err := m.registry.AddToPool(p.Name, s.Name(), p.Tags); err != nil {
+				if !errors.Is(err, pool.ErrSpriteExists) {
+					return fmt.Errorf("registering sprite %s: %w", s.Name(), err)
+				}
+				continue
+			}
+			if !s.CreatedAt.IsZero() {
+				if err := m.registry.SetCreatedAt(s.Name(), s.CreatedAt); err != nil {
+					return fmt.Errorf("registering sprite %s: %w", s.Name(), err)
+				}
+			}
+			log.Info("Adopted sprite created by a previous run", "pool", p.Name, "sprite", s.Name())
+		}
+	}
+	return nil
+}
+
+// Start checks the pools every interval until ctx is cancelled, then waits
+// for the sprites being created or destroyed. Those run under drain, so
+// cancelling it abandons them and creations are cleaned up.
+func (m *Manager) Start(ctx context.Context, drain context.Context) error {
+	if m == nil {
+		return nil
+	}
+	defer m.running.Wait()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.retire(drain)
+		m.scale(drain)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// scale starts creating the sprites each pool is short of
+func (m *Manager) scale(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	registered := m.registry.List()
+	claimed := make(map[string][]bool, len(m.backlogs)) // waiting jobs already counted against a pool
+	for queue, b := range m.backlogs {
+		claimed[queue] = make([]bool, len(b.waiting))
+	}
+
+	for _, p := range m.pools {
+		total, idle := m.provisioning[p.Name], m.provisioning[p.Name]
+		for _, s := range registered {
+			// Unhealthy sprites are replaced, see retire
+			if s.Pool != p.Name || s.Ephemeral || (s.State == pool.StateUnhealthy && createdFor(p.Name, s.Name)) {
+				continue
+			}
+			total++
+			if s.State == pool.StateIdle {
+				idle++
+			}
+		}
+
+		// A waiting job is claimed by the first pool with a spare idle sprite
+		// or room to grow for it, so pools don't scale out for the same job
+		room := max(idle-p.MinAgents, 0)
+		if p.MaxAgents > 0 {
+			room += max(p.MaxAgents-total-max(p.MinAgents-idle, 0), 0)
+		}
+		waiting, claims := 0, 0
+		for queue, b := range m.backlogs {
+			if len(b.pools) > 0 && !slices.Contains(b.pools, p.Name) {
+				continue
+			}
+			for i, rules := range b.waiting {
+				if claimed[queue][i] || !rules.Match(p.Tags) {
+					continue
+				}
+				waiting++
+				if claims < room {
+					claimed[queue][i] = true
+					claims++
+				}
+			}
+		}
+
+		d := decide(p, total, idle, waiting)
+		m.logDecision(p.Name, d, total, idle, waiting)
+		for range d.create {
+			m.startCreate(ctx, p)
+		}
+	}
+}
+
+// retire destroys the sprites the manager created that are unhealthy, due
+// for retirement, or idle beyond MinAgents for longer than IdleTimeout. Busy
+// sprites are drained first so they take no more jobs, and destroyed once
+// their job is done. scale replaces them.
+func (m *Manager) retire(ctx context.Context) {
+	now := m.now()
+	registered := m.registry.List()
+
+	for _, p := range m.pools {
+		idle := 0
+		var idleTooLong []pool.Sprite
+		for _, s := range registered {
+			if s.Pool != p.Name || s.Ephemeral {
+				continue
+			}
+			if s.State == pool.StateIdle {
+				idle++
+			}
+			if !createdFor(p.Name, s.Name) {
+				continue
+			}
+
+			reason := p.retireReason(s, now)
+			switch {
+			case s.State == pool.StateDraining && s.JobUUID == "":
+				m.remove(ctx, p.Name, s.Name, "drained")
+			case s.State == pool.StateUnhealthy:
+				m.remove(ctx, p.Name, s.Name, "unhealthy")
+			case reason != "" && s.JobUUID != "":
+				if s.State == pool.StateDraining {
+					continue
+				}
+				if err := m.registry.SetState(s.Name, pool.StateDraining); err != nil {
+					log.Error("failed to drain sprite", "sprite", s.Name, "error", err)
+					continue
+				}
+				log.Info("Draining sprite for retirement once its job is done", "pool", p.Name, "sprite", s.Name, "jobUUID", s.JobUUID, "reason", reason)
+			case reason != "":
+				if m.remove(ctx, p.Name, s.Name, reason) && s.State == pool.StateIdle {
+					idle--
+				}
+			case s.State == pool.StateIdle && p.IdleTimeout > 0 && now.Sub(s.UpdatedAt) > p.IdleTimeout:
+				idleTooLong = append(idleTooLong, s)
+			}
+		}
+
+		// Longest idle first, never going below MinAgents idle
+		slices.SortStableFunc(idleTooLong, func(a, b pool.Sprite) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+		for _, s := range idleTooLong {
+			if idle <= p.MinAgents {
+				break
+			}
+			if m.remove(ctx, p.Name, s.Name, fmt.Sprintf("idle for longer than idle_timeout (%s)", p.IdleTimeout)) {
+				idle--
+			}
+		}
+	}
+}
+
+// retireReason returns why the sprite is due for retirement, or "" if it isn't
+func (p Pool) retireReason(s pool.Sprite, now time.Time) string {
+	switch {
+	case p.MaxJobs > 0 && s.Jobs >= p.MaxJobs:
+		return fmt.Sprintf("reached max_jobs (%d)", p.MaxJobs)
+	case p.MaxAge > 0 && now.Sub(s.CreatedAt) >= p.MaxAge:
+		return fmt.Sprintf("older than max_age (%s)", p.MaxAge)
+	default:
+		return ""
+	}
+}
+
+// remove unregisters an idle sprite and destroys it in the background. It
+// reports false if the sprite was handed a job in the meantime.
+func (m *Manager) remove(ctx context.Context, poolName string, name string, reason string) bool {
+	if err := m.registry.Remove(name); err != nil {
+		if !errors.Is(err, pool.ErrSpriteBusy) {
+			log.Error("failed to remove sprite from the pool", "sprite", name, "error", err)
+		}
+		return false
+	}
+	log.Info("Destroying sprite", "pool", poolName, "sprite", name, "reason", reason)
+
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+
+		if err := m.destroy(ctx, name); err != nil {
+			log.Error("failed to destroy sprite, it may have leaked", "sprite", name, "error", err)
+		}
+	}()
+	return true
+}
+
+// destroySprite deletes a sprite. It's given the drain's context rather
+// than the manager's, so sprites removed from the pool while shutting down
+// are still cleaned up until the drain ends.
+func (m *Manager) destroySprite(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, destroyTimeout)
+	defer cancel()
+
+	return m.spriteHandler.NewAgentSprite(name).Destroy(ctx)
+}
+
+// decision is how many sprites to create for a pool, and why
+type decision struct {
+	create int
+	reason string
+}
+
+// decide works out how many sprites a pool with total sprites, idle of
+// them idle, needs to create to keep MinAgents idle after running the
+// waiting jobs, without going over MaxAgents. Sprites being created count
+// as idle.
+func decide(p Pool, total int, idle int, waiting int) decision {
+	short := max(p.MinAgents-idle, 0)
+	limit := p.MaxAgents
+	if limit == 0 {
+		// Without a maximum the pool only grows to keep MinAgents idle
+		limit = total + short
+		waiting = 0
+	}
+
+	want := max(p.MinAgents+waiting-idle, 0)
+	if want == 0 {
+		return decision{reason: "enough idle sprites"}
+	}
+	create := min(want, max(limit-total, 0))
+
+	switch {
+	case create == 0:
+		return decision{reason: "at max_agents"}
+	case create < want:
+		return decision{create: create, reason: fmt.Sprintf("%d sprites wanted but capped at max_agents", want)}
+	case short > 0 && want > short:
+		return decision{create: create, reason: "idle sprites below min_agents and jobs waiting"}
+	case short > 0:
+		return decision{create: create, reason: "idle sprites below min_agents"}
+	default:
+		return decision{create: create, reason: "jobs waiting for a sprite"}
+	}
+}
+
+// logDecision logs a pool's scaling decision when it creates sprites or
+// differs from the last one, so a steady state doesn't flood the log
+func (m *Manager) logDecision(poolName string, d decision, total int, idle int, waiting int) {
+	if d.create == 0 && m.decisions[poolName] == d.reason {
+		return
+	}
+	m.decisions[poolName] = d.reason
+
+	log.Info("Pool scaling decision",
+		"pool", poolName,
+		"create", d.create,
+		"reason", d.reason,
+		"sprites", total,
+		"idle", idle,
+		"waiting", waiting,
+	)
+}
+
+// startCreate creates a sprite for the pool in the background. The caller holds m.mu.
+func (m *Manager) startCreate(ctx context.Context, p Pool) {
+	name := spriteName(p.Name)
+	m.provisioning[p.Name]++
+
+	m.running.Add(1)
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			m.provisioning[p.Name]--
+			m.mu.Unlock()
+			m.running.Done()
+		}()
+
+		start := time.Now()
+		if err := m.create(ctx, p, name); err != nil {
+			log.Error("failed to create sprite for pool", "pool", p.Name, "sprite", name, "error", err)
+			return
+		}
+		if err := m.registry.AddToPool(p.Name, name, p.Tags); err != nil {
+			log.Error("failed to register created sprite", "pool", p.Name, "sprite", name, "error", err)
+			return
+		}
+		log.Info("Added sprite to pool", "pool", p.Name, "sprite", name, "duration", time.Since(start))
+	}()
+}
+
+// createSprite creates and provisions a sprite, destroying it again if
+// anything fails so it doesn't leak
+func (m *Manager) createSprite(ctx context.Context, p Pool, name string) (err error) {
+	log.Info("Creating sprite", "pool", p.Name, "sprite", name)
+	spr, err := m.spriteHandler.CreateAgentSprite(ctx, name)
+	if err != nil {
+		return fmt.Errorf("creating sprite %s: %w", name, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		destroyCtx, cancel := context.WithTimeout(context.Background(), destroyTimeout)
+		defer cancel()
+		if destroyErr := spr.Destroy(destroyCtx); destroyErr != nil {
+			log.Error("failed to destroy sprite, it may have leaked", "sprite", name, "error", destroyErr)
+		}
+	}()
+
+	if err := spr.Provision(ctx, p.ProvisionScript, backend.ProvisionEnv(m.agentToken, p.AgentVersion)); err != nil {
+		return fmt.Errorf("provisioning sprite %s: %w", name, err)
+	}
+	if p.Checkpoint != "" {
+		if err := spr.CreateCheckpoint(ctx, p.Checkpoint); err != nil {
+			return fmt.Errorf("checkpointing sprite %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// spriteSuffixLen is the number of random bytes in a created sprite's name
+const spriteSuffixLen = 4
+
+// spriteName returns a unique name for a sprite created for the pool
+func spriteName(poolName string) string {
+	suffix := make([]byte, spriteSuffixLen)
+	_, _ = rand.Read(suffix)
+	return spritePrefix(poolName) + hex.EncodeToString(suffix)
+}
+
+func spritePrefix(poolName string) string {
+	return "bk-" + poolName + "-"
+}
+
+// createdFor reports whether name was made by spriteName for the pool, and
+// not for another pool whose name starts the same way
+func createdFor(poolName string, name string) bool {
+	suffix, ok := strings.CutPrefix(name, spritePrefix(poolName))
+	if !ok || len(suffix) != hex.EncodedLen(spriteSuffixLen) {
+		return false
+	}
+	_, err := hex.DecodeString(suffix)
+	return err == nil
+}
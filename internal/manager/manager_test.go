@@ -0,0 +1,406 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	spritesapi "github.com/superfly/sprites-go"
+
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/sprites"
+)
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    Pool
+		total   int
+		idle    int
+		waiting int
+		want    decision
+	}{
+		{
+			name:  "enough idle sprites",
+			pool:  Pool{MinAgents: 1, MaxAgents: 4},
+			total: 2, idle: 1,
+			want: decision{reason: "enough idle sprites"},
+		},
+		{
+			name:  "below min agents",
+			pool:  Pool{MinAgents: 2, MaxAgents: 4},
+			total: 1, idle: 0,
+			want: decision{create: 2, reason: "idle sprites below min_agents"},
+		},
+		{
+			name:  "jobs waiting",
+			pool:  Pool{MaxAgents: 4},
+			total: 1, idle: 0, waiting: 2,
+			want: decision{create: 2, reason: "jobs waiting for a sprite"},
+		},
+		{
+			name:  "below min agents and jobs waiting",
+			pool:  Pool{MinAgents: 1, MaxAgents: 4},
+			total: 1, idle: 0, waiting: 1,
+			want: decision{create: 2, reason: "idle sprites below min_agents and jobs waiting"},
+		},
+		{
+			name:  "capped at max agents",
+			pool:  Pool{MaxAgents: 3},
+			total: 2, idle: 0, waiting: 5,
+			want: decision{create: 1, reason: "5 sprites wanted but capped at max_agents"},
+		},
+		{
+			name:  "idle sprites cover waiting jobs",
+			pool:  Pool{MinAgents: 1, MaxAgents: 4},
+			total: 3, idle: 3, waiting: 2,
+			want: decision{reason: "enough idle sprites"},
+		},
+		{
+			name:  "at max agents",
+			pool:  Pool{MinAgents: 1, MaxAgents: 2},
+			total: 2, idle: 0, waiting: 1,
+			want: decision{reason: "at max_agents"},
+		},
+		{
+			name:  "no maximum only keeps min agents idle",
+			pool:  Pool{MinAgents: 1},
+			total: 3, idle: 0, waiting: 4,
+			want: decision{create: 1, reason: "idle sprites below min_agents"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, decide(tt.pool, tt.total, tt.idle, tt.waiting))
+		})
+	}
+}
+
+func TestCreatedFor(t *testing.T) {
+	name := spriteName("linux")
+	assert.Regexp(t, `^bk-linux-[0-9a-f]{8}$`, name)
+	assert.True(t, createdFor("linux", name))
+
+	assert.False(t, createdFor("linux", "bk-linux-arm-0011aabb"), "another pool's sprite")
+	assert.False(t, createdFor("linux", "bk-linux-1"), "a configured sprite")
+	assert.False(t, createdFor("linux", "bk-linux-zzzzzzzz"))
+}
+
+// fakeCreate stands in for creating and destroying sprites, blocking
+// creation until release is closed
+type fakeCreate struct {
+	mu        sync.Mutex
+	created   map[string]int // by pool
+	destroyed []string
+	fail      bool
+	release   chan struct{}
+}
+
+func (f *fakeCreate) create(ctx context.Context, p Pool, name string) error {
+	f.mu.Lock()
+	f.created[p.Name]++
+	f.mu.Unlock()
+
+	<-f.release
+	if f.fail {
+		return errors.New("provisioning failed")
+	}
+	return nil
+}
+
+func (f *fakeCreate) destroy(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.destroyed = append(f.destroyed, name)
+	return nil
+}
+
+func newTestManager(t *testing.T, registry *pool.Registry, pools ...Pool) (*Manager, *fakeCreate) {
+	t.Helper()
+
+	f := &fakeCreate{created: make(map[string]int), release: make(chan struct{})}
+	m := NewManager(registry, "test-token", "agent-token", pools)
+	m.create = f.create
+	m.destroy = f.destroy
+	return m, f
+}
+
+func TestManager_Scale(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "bk-linux-1", nil))
+	require.NoError(t, registry.Claim("bk-linux-1", "job-0"))
+
+	m, f := newTestManager(t, registry,
+		Pool{Name: "linux", MinAgents: 1, MaxAgents: 3, Tags: map[string]string{"os": "linux"}},
+		Pool{Name: "overflow", MaxAgents: 5, Tags: map[string]string{"os": "linux"}},
+		Pool{Name: "mac", MaxAgents: 2, Tags: map[string]string{"os": "macos"}},
+	)
+
+	linux, err := pool.ParseQueryRules([]string{"os=linux"})
+	require.NoError(t, err)
+	m.SetBacklog("builds", nil, []pool.QueryRules{linux, linux, linux})
+
+	m.scale(context.Background())
+
+	// linux keeps one idle and takes one job before hitting max_agents, the
+	// rest of the jobs go to overflow, and nothing matches mac
+	m.mu.Lock()
+	assert.Equal(t, map[string]int{"linux": 2, "overflow": 2}, m.provisioning)
+	m.mu.Unlock()
+
+	// Sprites still being created count towards the pool, so scaling again
+	// doesn't create more for the same jobs
+	m.scale(context.Background())
+	close(f.release)
+	m.running.Wait()
+
+	f.mu.Lock()
+	assert.Equal(t, map[string]int{"linux": 2, "overflow": 2}, f.created)
+	f.mu.Unlock()
+
+	assert.Equal(t, 2, registry.CountIn([]string{"linux"}, pool.StateIdle))
+	assert.Equal(t, 2, registry.CountIn([]string{"overflow"}, pool.StateIdle))
+	for _, s := range registry.List() {
+		if s.Pool == "overflow" {
+			assert.Equal(t, "linux", s.Tags["os"])
+		}
+	}
+}
+
+func TestManager_ScaleQueuePools(t *testing.T) {
+	m, f := newTestManager(t, pool.NewRegistry(),
+		Pool{Name: "linux", MaxAgents: 3},
+		Pool{Name: "deploy", MaxAgents: 3},
+	)
+	m.SetBacklog("deploys", []string{"deploy"}, []pool.QueryRules{nil})
+
+	m.scale(context.Background())
+	close(f.release)
+	m.running.Wait()
+
+	assert.Equal(t, map[string]int{"deploy": 1}, f.created)
+}
+
+func TestManager_CreateFailed(t *testing.T) {
+	registry := pool.NewRegistry()
+	m, f := newTestManager(t, registry, Pool{Name: "linux", MinAgents: 1, MaxAgents: 1})
+	f.fail = true
+
+	m.scale(context.Background())
+	close(f.release)
+	m.running.Wait()
+
+	// The failed sprite isn't registered and the pool tries again next time
+	assert.Zero(t, registry.Len())
+	assert.Zero(t, m.provisioning["linux"])
+	m.scale(context.Background())
+	m.running.Wait()
+	assert.Equal(t, 2, f.created["linux"])
+}
+
+func TestManager_Start_DrainEnds(t *testing.T) {
+	registry := pool.NewRegistry()
+	m, _ := newTestManager(t, registry, Pool{Name: "linux", MinAgents: 1, MaxAgents: 1})
+
+	ctx, stop := context.WithCancel(context.Background())
+	drain, endDrain := context.WithCancel(context.Background())
+	m.create = func(ctx context.Context, p Pool, name string) error {
+		// Stopping the manager leaves the creation running until the drain ends
+		stop()
+		assert.NoError(t, ctx.Err())
+		time.AfterFunc(10*time.Millisecond, endDrain)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	assert.ErrorIs(t, m.Start(ctx, drain), context.Canceled)
+	assert.Zero(t, registry.Len())
+	assert.Zero(t, m.provisioning["linux"])
+}
+
+func TestManager_Nil(t *testing.T) {
+	var m *Manager
+	m.SetBacklog("builds", nil, nil)
+	assert.False(t, m.Replaces(pool.Sprite{}))
+	assert.NoError(t, m.Adopt(context.Background()))
+	assert.NoError(t, m.Start(context.Background(), context.Background()))
+}
+
+func TestManager_Adopt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "bk-linux-", r.URL.Query().Get("prefix"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"sprites": [
+			{"name": "bk-linux-0011aabb"},
+			{"name": "bk-linux-arm-0011aabb"},
+			{"name": "bk-linux-1"}
+		]}`))
+	}))
+	defer server.Close()
+
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "bk-linux-1", nil))
+
+	m := NewManager(registry, "test-token", "agent-token", []Pool{{Name: "linux", Tags: map[string]string{"os": "linux"}}})
+	m.spriteHandler = &sprites.SpriteHandler{
+		Client: spritesapi.New("test-token", spritesapi.WithBaseURL(server.URL), spritesapi.WithDisableControl()),
+	}
+
+	require.NoError(t, m.Adopt(context.Background()))
+
+	s, ok := registry.Get("bk-linux-0011aabb")
+	require.True(t, ok)
+	assert.Equal(t, "linux", s.Pool)
+	assert.Equal(t, "linux", s.Tags["os"])
+	assert.Equal(t, 2, registry.Len())
+}
+
+func TestManager_Retire(t *testing.T) {
+	tests := []struct {
+		name string
+		pool Pool
+		busy int // how many of the sprites, in order, are running a job
+		jobs int // jobs each sprite has been handed before the test
+		age  time.Duration
+		want []int // sprites destroyed, by index
+	}{
+		{
+			name: "idle sprites beyond min agents",
+			pool: Pool{MinAgents: 1, IdleTimeout: 10 * time.Minute},
+			age:  time.Hour,
+			want: []int{0, 1},
+		},
+		{
+			name: "busy sprites don't count towards min agents",
+			pool: Pool{MinAgents: 1, IdleTimeout: 10 * time.Minute},
+			busy: 1,
+			age:  time.Hour,
+			want: []int{1},
+		},
+		{
+			name: "not idle long enough",
+			pool: Pool{IdleTimeout: 10 * time.Minute},
+			age:  time.Minute,
+		},
+		{
+			name: "max jobs retires idle sprites below min agents",
+			pool: Pool{MinAgents: 3, MaxJobs: 2},
+			jobs: 2,
+			want: []int{0, 1, 2},
+		},
+		{
+			name: "max age",
+			pool: Pool{MinAgents: 3, MaxAge: time.Hour},
+			age:  2 * time.Hour,
+			want: []int{0, 1, 2},
+		},
+		{
+			name: "busy sprites finish their job first",
+			pool: Pool{MaxJobs: 1},
+			busy: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := pool.NewRegistry()
+			require.NoError(t, registry.AddToPool("linux", "bk-linux-1", nil))
+
+			var names []string
+			for i := range 3 {
+				name := spriteName("linux")
+				names = append(names, name)
+				require.NoError(t, registry.AddToPool("linux", name, nil))
+				for j := range tt.jobs {
+					require.NoError(t, registry.Claim(name, fmt.Sprintf("job-%d-%d", i, j)))
+					require.NoError(t, registry.Return(name))
+				}
+				if i < tt.busy {
+					require.NoError(t, registry.Claim(name, fmt.Sprintf("job-%d", i)))
+				}
+			}
+			// The configured sprite is always busy so it doesn't count as idle
+			require.NoError(t, registry.Claim("bk-linux-1", "job-configured"))
+
+			tt.pool.Name = "linux"
+			m, f := newTestManager(t, registry, tt.pool)
+			m.now = func() time.Time { return time.Now().Add(tt.age) }
+
+			m.retire(context.Background())
+			m.running.Wait()
+
+			var want []string
+			for _, i := range tt.want {
+				want = append(want, names[i])
+			}
+			assert.ElementsMatch(t, want, f.destroyed)
+			for _, name := range want {
+				_, ok := registry.Get(name)
+				assert.False(t, ok, "%s is still registered", name)
+			}
+			_, ok := registry.Get("bk-linux-1")
+			assert.True(t, ok, "configured sprites are never destroyed")
+		})
+	}
+}
+
+func TestManager_ReplacesUnhealthy(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "bk-linux-1", nil))
+	require.NoError(t, registry.SetState("bk-linux-1", pool.StateUnhealthy))
+	name := spriteName("linux")
+	require.NoError(t, registry.AddToPool("linux", name, nil))
+	require.NoError(t, registry.SetState(name, pool.StateUnhealthy))
+
+	m, f := newTestManager(t, registry, Pool{Name: "linux", MinAgents: 1, MaxAgents: 2})
+	assert.True(t, m.Replaces(pool.Sprite{Name: name, Pool: "linux"}))
+	assert.False(t, m.Replaces(pool.Sprite{Name: "bk-linux-1", Pool: "linux"}))
+
+	// The unhealthy sprite it created doesn't take up room under max_agents
+	m.scale(context.Background())
+	close(f.release)
+	m.running.Wait()
+	assert.Equal(t, map[string]int{"linux": 1}, f.created)
+
+	m.retire(context.Background())
+	m.running.Wait()
+	assert.Equal(t, []string{name}, f.destroyed)
+	_, ok := registry.Get(name)
+	assert.False(t, ok)
+	_, ok = registry.Get("bk-linux-1")
+	assert.True(t, ok, "configured sprites are checked again rather than destroyed")
+}
+
+func TestManager_RetireAfterJob(t *testing.T) {
+	registry := pool.NewRegistry()
+	name := spriteName("linux")
+	require.NoError(t, registry.AddToPool("linux", name, nil))
+	require.NoError(t, registry.Claim(name, "job-1"))
+
+	m, f := newTestManager(t, registry, Pool{Name: "linux", MinAgents: 1, MaxJobs: 1})
+
+	// The sprite is drained so it takes no more jobs, but keeps running this one
+	m.retire(context.Background())
+	s, ok := registry.Get(name)
+	require.True(t, ok)
+	assert.Equal(t, pool.StateDraining, s.State)
+	assert.Equal(t, "job-1", s.JobUUID)
+	assert.Empty(t, f.destroyed)
+
+	require.NoError(t, registry.Return(name))
+	_, err := registry.CheckoutFrom([]string{"linux"}, "job-2", nil)
+	assert.ErrorIs(t, err, pool.ErrNoIdleSprites)
+
+	m.retire(context.Background())
+	m.running.Wait()
+	assert.Equal(t, []string{name}, f.destroyed)
+	assert.Zero(t, registry.Len())
+}
@@ -0,0 +1,178 @@
+// Package metrics provides the Prometheus metrics exported by the controller
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/jeremybumsted/bksprites/internal/pool"
+)
+
+const namespace = "bksprites"
+
+var (
+	JobsPolled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_polled_total",
+		Help:      "Scheduled jobs returned when polling the queue.",
+	})
+	JobsReserved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_reserved_total",
+		Help:      "Jobs successfully reserved for the stack.",
+	})
+	JobsNotReserved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_not_reserved_total",
+		Help:      "Jobs that Buildkite refused to reserve for the stack.",
+	})
+	JobsDispatched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_dispatched_total",
+		Help:      "Jobs whose agent was started on a sprite.",
+	})
+	JobsDispatchFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_dispatch_failed_total",
+		Help:      "Jobs whose agent failed to run on a sprite.",
+	})
+	JobsDispatchDeadlineMissed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_dispatch_deadline_missed_total",
+		Help:      "Reserved jobs given up on because their agent couldn't be started before the reservation expired.",
+	})
+	JobsCancelled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_cancelled_total",
+		Help:      "Running jobs whose agent was stopped because the job was cancelled on Buildkite.",
+	})
+
+	PollDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "poll_duration_seconds",
+		Help:      "Time taken to list the scheduled jobs on the queue.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	ReserveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reserve_duration_seconds",
+		Help:      "Time taken by BatchReserveJobs calls.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	DispatchWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dispatch_wait_seconds",
+		Help:      "Time from a job being scheduled to it being dispatched to a sprite.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12), // 0.5s to ~17m
+	})
+
+	CheckpointRestoreDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "checkpoint_restore_duration_seconds",
+		Help:      "Time taken to restore a sprite to its pool's checkpoint after a job.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10), // 1s to ~8.5m
+	})
+	CheckpointRestoresFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checkpoint_restores_failed_total",
+		Help:      "Checkpoint restores that failed, leaving the sprite unhealthy.",
+	})
+
+	SpriteRunAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sprite_run_attempts_total",
+		Help:      "Attempts at running the agent on a sprite, by whether they succeeded, were retried or failed for good.",
+	}, []string{"outcome"})
+
+	JobsPlacedWarm = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_placed_warm_total",
+		Help:      "Jobs placed on a sprite that recently ran their pipeline.",
+	})
+
+	SpriteHealthChecksFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sprite_health_checks_failed_total",
+		Help:      "Health checks before dispatch that failed, quarantining the sprite.",
+	})
+
+	JobsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "jobs_in_flight",
+		Help:      "Jobs placed on a sprite that haven't finished yet.",
+	})
+)
+
+// Registry holds every metric exported by the controller
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		JobsPolled,
+		JobsReserved,
+		JobsNotReserved,
+		JobsDispatched,
+		JobsDispatchFailed,
+		JobsDispatchDeadlineMissed,
+		JobsCancelled,
+		PollDuration,
+		ReserveDuration,
+		DispatchWait,
+		CheckpointRestoreDuration,
+		CheckpointRestoresFailed,
+		SpriteHealthChecksFailed,
+		JobsPlacedWarm,
+		SpriteRunAttempts,
+		JobsInFlight,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// RegisterPool exports the number of sprites in each state, read from the
+// registry whenever the metrics are scraped
+func RegisterPool(registry *pool.Registry) error {
+	return Registry.Register(&poolCollector{registry: registry})
+}
+
+var spritesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "sprites"),
+	"Sprites in the pool by state.",
+	[]string{"state"},
+	nil,
+)
+
+var agentVersionDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "sprite_agent_version"),
+	"buildkite-agent version installed on each sprite, once it has been read.",
+	[]string{"sprite", "pool", "version"},
+	nil,
+)
+
+type poolCollector struct {
+	registry *pool.Registry
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- spritesDesc
+	ch <- agentVersionDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, state := range []pool.State{pool.StateIdle, pool.StateBusy, pool.StateDraining, pool.StateUnhealthy, pool.StateUpgrading, pool.StateChecking} {
+		ch <- prometheus.MustNewConstMetric(spritesDesc, prometheus.GaugeValue, float64(c.registry.Count(state)), string(state))
+	}
+	for _, s := range c.registry.List() {
+		if s.AgentVersion != "" {
+			ch <- prometheus.MustNewConstMetric(agentVersionDesc, prometheus.GaugeValue, 1, s.Name, s.Pool, s.AgentVersion)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/pool"
+)
+
+func TestHandler(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.Add("sprite-1", nil))
+	require.NoError(t, registry.Add("sprite-2", nil))
+	require.NoError(t, registry.SetState("sprite-2", pool.StateUnhealthy))
+	require.NoError(t, registry.SetAgentVersion("sprite-1", "3.112.0"))
+	require.NoError(t, RegisterPool(registry))
+
+	JobsPolled.Add(3)
+	PollDuration.Observe(0.1)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+
+	for _, want := range []string{
+		"bksprites_jobs_polled_total 3",
+		"bksprites_jobs_reserved_total",
+		"bksprites_jobs_dispatch_failed_total",
+		"bksprites_poll_duration_seconds_count 1",
+		"bksprites_reserve_duration_seconds_bucket",
+		"bksprites_dispatch_wait_seconds_bucket",
+		"bksprites_jobs_in_flight",
+		"bksprites_sprite_health_checks_failed_total",
+		`bksprites_sprites{state="idle"} 1`,
+		`bksprites_sprites{state="unhealthy"} 1`,
+		`bksprites_sprites{state="busy"} 0`,
+		`bksprites_sprites{state="upgrading"} 0`,
+		`bksprites_sprite_agent_version{pool="",sprite="sprite-1",version="3.112.0"} 1`,
+	} {
+		assert.Contains(t, string(body), want)
+	}
+}
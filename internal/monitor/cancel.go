@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	"github.com/jeremybumsted/bksprites/internal/metrics"
+)
+
+const (
+	// defaultCancelGrace gives the agent time to stop the job and upload
+	// its log after being sent TERM
+	defaultCancelGrace = 30 * time.Second
+
+	// cancelCheckInterval is how often Buildkite is asked whether running
+	// jobs have been cancelled
+	cancelCheckInterval = 10 * time.Second
+)
+
+// cancelledJobStates are the Buildkite job states of a job that was
+// cancelled while its agent may still be running
+var cancelledJobStates = map[string]bool{
+	"canceling": true,
+	"canceled":  true,
+}
+
+// watchCancellations stops the agents of jobs cancelled on Buildkite. It
+// keeps watching after ctx is cancelled until the running jobs are done, so
+// a job cancelled while the controller drains is still stopped.
+func (m *Monitor) watchCancellations(ctx context.Context) {
+	ticker := time.NewTicker(cancelCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if ctx.Err() != nil && m.InFlight() == 0 {
+			return
+		}
+		m.checkCancellations(context.WithoutCancel(ctx))
+	}
+}
+
+// checkCancellations looks up the state of every job with a running agent
+// and cancels those that Buildkite has cancelled
+func (m *Monitor) checkCancellations(ctx context.Context) {
+	m.mu.Lock()
+	jobUUIDs := make([]string, 0, len(m.handles))
+	for jobUUID, h := range m.handles {
+		if !h.Canceled() {
+			jobUUIDs = append(jobUUIDs, jobUUID)
+		}
+	}
+	m.mu.Unlock()
+	if len(jobUUIDs) == 0 {
+		return
+	}
+	slices.Sort(jobUUIDs)
+
+	for jobUUID, state := range m.jobStates(ctx, jobUUIDs) {
+		if !cancelledJobStates[state] {
+			continue
+		}
+		m.mu.Lock()
+		h, ok := m.handles[jobUUID]
+		spriteName := m.inFlight[jobUUID]
+		m.mu.Unlock()
+		if !ok || h.Canceled() {
+			continue
+		}
+
+		log.Info("Job was cancelled on Buildkite, stopping its agent", "jobUUID", jobUUID, "sprite", spriteName, "state", state)
+		metrics.JobsCancelled.Inc()
+		go h.Cancel(m.cancelGrace)
+	}
+}
+
+// track returns the handle used to cancel the job's agent, creating it if
+// the job doesn't have one yet
+func (m *Monitor) track(jobUUID string) *backend.Handle {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.handles[jobUUID]
+	if !ok {
+		h = &backend.Handle{}
+		m.handles[jobUUID] = h
+	}
+	return h
+}
+
+// untrack forgets the job's handle once the job is done
+func (m *Monitor) untrack(jobUUID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.handles, jobUUID)
+}
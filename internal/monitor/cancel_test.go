@@ -0,0 +1,56 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/stacksapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCancellations(t *testing.T) {
+	var asked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req stacksapi.GetJobStatesRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		asked = req.JobUUIDs
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"states": {"running-job": "running", "canceling-job": "canceling", "canceled-job": "canceled"}}`))
+	}))
+	defer server.Close()
+
+	monitor := NewMonitor(newTestClient(t, server), "test-stack", "default", 30*time.Second, nil, newTestRegistry(t),
+		WithCancelGrace(time.Second),
+	)
+	running := monitor.track("running-job")
+	canceling := monitor.track("canceling-job")
+	canceled := monitor.track("canceled-job")
+
+	monitor.checkCancellations(context.Background())
+
+	assert.Equal(t, []string{"canceled-job", "canceling-job", "running-job"}, asked)
+	assert.Eventually(t, func() bool { return canceling.Canceled() && canceled.Canceled() }, time.Second, 10*time.Millisecond)
+	assert.False(t, running.Canceled())
+
+	// Jobs already being cancelled aren't asked about again
+	monitor.checkCancellations(context.Background())
+	assert.Equal(t, []string{"running-job"}, asked)
+}
+
+func TestTrack(t *testing.T) {
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t))
+
+	// A job moved to another sprite keeps its handle, so a cancellation isn't lost
+	h := monitor.track("job-1")
+	h.Cancel(time.Second)
+	assert.Same(t, h, monitor.track("job-1"))
+
+	monitor.untrack("job-1")
+	assert.NotSame(t, h, monitor.track("job-1"))
+}
@@ -3,38 +3,286 @@ package monitor
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/stacksapi"
 	"github.com/charmbracelet/log"
 
-	"github.com/jeremybumsted/bksprites/internal/sprites"
-	"github.com/jeremybumsted/bksprites/internal/types"
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	"github.com/jeremybumsted/bksprites/internal/health"
+	"github.com/jeremybumsted/bksprites/internal/manager"
+	"github.com/jeremybumsted/bksprites/internal/metrics"
+	"github.com/jeremybumsted/bksprites/internal/pool"
 	"github.com/jeremybumsted/bksprites/internal/store"
+	"github.com/jeremybumsted/bksprites/internal/types"
+)
+
+const (
+	// defaultReservationExpiry is long enough to start an agent on a sprite
+	defaultReservationExpiry = 30 * time.Second
+
+	// maxDispatchMargin is the most time left on a reservation that we
+	// stop trying to start its job, so the agent has time to acquire it
+	maxDispatchMargin = 5 * time.Second
+
+	// spriteDestroyTimeout bounds deleting a sprite created for a job
+	spriteDestroyTimeout = time.Minute
 )
 
 type Monitor struct {
-	client        *stacksapi.Client
-	spriteHandler *sprites.SpriteHandler
-	stackKey      string
-	queue         string
-	interval      time.Duration
-	jobStore      *store.JobStore
+	client   *stacksapi.Client
+	backend  backend.Backend // runs jobs' agents on the registry's sprites
+	stackKey string
+	queue    string
+	interval time.Duration
+	jobStore *store.JobStore
+	registry *pool.Registry
+	health   *health.Loop
+
+	maxConcurrency    int // 0 means the sprite pool is the only limit
+	reservationExpiry time.Duration
+	poolExpiries      map[string]time.Duration     // reservation expiry overrides by pool name
+	priorityAging     time.Duration                // waiting time that raises a job's priority by one, 0 disables aging
+	affinityWait      time.Duration                // how long a job waits for a busy sprite that recently ran its pipeline
+	acquireTimeout    time.Duration                // 0 uses the backend package default
+	jobTimeout        time.Duration                // 0 for no limit
+	poolJobTimeouts   map[string]time.Duration     // job timeout overrides by pool name
+	pipelineTimeouts  map[string]time.Duration     // job timeout overrides by pipeline slug, ahead of the pool's
+	cancelGrace       time.Duration                // how long a cancelled job's agent has to stop before it's killed
+	templates         map[string]types.AgentSprite // agent settings by pool name
+	queuePools        []string                     // pools the queue's jobs can run in, empty for any
+	shares            *pool.Shares                 // capacity shared with other queues, if any
+	manager           *manager.Manager             // told about jobs waiting for a sprite, if any
+	agentToken        string                       // installed on sprites created for ephemeral pools
+	provisionScripts  map[string][]byte            // provision script by pool name, for ephemeral pools
+
+	// setBacklog reports the jobs waiting for a sprite to the manager,
+	// replaced in tests
+	setBacklog func(queue string, pools []string, waiting []pool.QueryRules)
+
+	mu       sync.Mutex
+	inFlight map[string]string          // job uuid -> sprite name
+	handles  map[string]*backend.Handle // job uuid -> agent running it, for cancelling it
+	running  sync.WaitGroup             // agent goroutines, waited on when draining
+}
+
+// Option configures optional Monitor behaviour
+type Option func(*Monitor)
+
+// WithMaxConcurrency caps the number of jobs the monitor will run at once
+func WithMaxConcurrency(n int) Option {
+	return func(m *Monitor) {
+		m.maxConcurrency = n
+	}
+}
+
+// WithJobStore replaces the default in-memory job store, e.g. with one
+// backed by a file store so reservations survive a restart
+func WithJobStore(js *store.JobStore) Option {
+	return func(m *Monitor) {
+		m.jobStore = js
+	}
+}
+
+// WithReservationExpiry sets how long Buildkite holds a reservation for
+// the stack before offering the job to others
+func WithReservationExpiry(d time.Duration) Option {
+	return func(m *Monitor) {
+		m.reservationExpiry = d
+	}
+}
+
+// WithPoolReservationExpiry overrides the reservation expiry for jobs
+// placed on sprites in the given pools
+func WithPoolReservationExpiry(expiries map[string]time.Duration) Option {
+	return func(m *Monitor) {
+		m.poolExpiries = expiries
+	}
+}
+
+// WithPriorityAging sets how long a job waits before it is dispatched as
+// if it had one priority level higher, 0 disables aging
+func WithPriorityAging(d time.Duration) Option {
+	return func(m *Monitor) {
+		m.priorityAging = d
+	}
+}
+
+// WithAffinityWait sets how long a job waits for a busy sprite that
+// recently ran its pipeline before it takes any free sprite. Free sprites
+// that ran the pipeline are preferred however long the job has waited.
+func WithAffinityWait(d time.Duration) Option {
+	return func(m *Monitor) {
+		m.affinityWait = d
+	}
+}
+
+// WithAcquireTimeout bounds how long a job's agent may take to acquire
+// the job. An agent that hasn't is stopped, and the job is left for
+// Buildkite to offer again.
+func WithAcquireTimeout(d time.Duration) Option {
+	return func(m *Monitor) {
+		m.acquireTimeout = d
+	}
+}
+
+// WithJobTimeout bounds how long a job's agent may run on a sprite, 0 for no limit
+func WithJobTimeout(d time.Duration) Option {
+	return func(m *Monitor) {
+		m.jobTimeout = d
+	}
+}
+
+// WithPoolJobTimeout overrides the job timeout for jobs placed on sprites
+// in the given pools, 0 for no limit
+func WithPoolJobTimeout(timeouts map[string]time.Duration) Option {
+	return func(m *Monitor) {
+		m.poolJobTimeouts = timeouts
+	}
+}
+
+// WithPipelineJobTimeout overrides the job timeout for jobs of the given
+// pipelines, keyed by slug, wherever they're placed. 0 is no limit.
+func WithPipelineJobTimeout(timeouts map[string]time.Duration) Option {
+	return func(m *Monitor) {
+		m.pipelineTimeouts = timeouts
+	}
+}
+
+// WithCancelGrace sets how long the agent of a job cancelled on Buildkite
+// has to stop after being sent TERM, before it's killed
+func WithCancelGrace(d time.Duration) Option {
+	return func(m *Monitor) {
+		m.cancelGrace = d
+	}
+}
+
+// WithPools sets the agent settings used for sprites in each pool, keyed by pool name
+func WithPools(pools map[string]types.AgentSprite) Option {
+	return func(m *Monitor) {
+		m.templates = pools
+	}
+}
+
+// WithQueuePools limits the queue's jobs to sprites in the named pools
+func WithQueuePools(pools []string) Option {
+	return func(m *Monitor) {
+		m.queuePools = pools
+	}
+}
+
+// WithShares limits the monitor to its share of capacity shared with
+// monitors for other queues
+func WithShares(shares *pool.Shares) Option {
+	return func(m *Monitor) {
+		m.shares = shares
+	}
+}
+
+// WithManager reports jobs waiting for a sprite to the pool manager, so it
+// can create sprites for them
+func WithManager(pm *manager.Manager) Option {
+	return func(m *Monitor) {
+		m.manager = pm
+	}
+}
+
+// WithProvisioning sets the scripts used to install the agent on sprites
+// created for ephemeral pools, keyed by pool name, and the agent token they install
+func WithProvisioning(agentToken string, scripts map[string][]byte) Option {
+	return func(m *Monitor) {
+		m.agentToken = agentToken
+		m.provisionScripts = scripts
+	}
+}
+
+// WithHealth reports the progress of the poll loop to a health checker
+func WithHealth(l *health.Loop) Option {
+	return func(m *Monitor) {
+		m.health = l
+	}
 }
 
-func NewMonitor(client *stacksapi.Client, stackKey string, queue string, interval time.Duration, spriteToken string) *Monitor {
+func NewMonitor(client *stacksapi.Client, stackKey string, queue string, interval time.Duration, b backend.Backend, registry *pool.Registry, opts ...Option) *Monitor {
 	s := store.NewStore()
 	js := store.NewJobStore(s)
 
-	return &Monitor{
-		client:        client,
-		spriteHandler: sprites.NewSpriteHandlerWithToken(spriteToken),
-		stackKey:      stackKey,
-		queue:         queue,
-		interval:      interval,
-		jobStore:      js,
+	m := &Monitor{
+		client:   client,
+		stackKey: stackKey,
+		queue:    queue,
+		interval: interval,
+		jobStore: js,
+		registry: registry,
+		backend:  b,
+		inFlight: make(map[string]string),
+		handles:  make(map[string]*backend.Handle),
+
+		reservationExpiry: defaultReservationExpiry,
+		priorityAging:     defaultPriorityAging,
+		cancelGrace:       defaultCancelGrace,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.setBacklog = m.manager.SetBacklog
+	return m
+}
+
+// InFlight returns the number of jobs currently running on sprites
+func (m *Monitor) InFlight() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.inFlight)
+}
+
+// Drain waits for every running job to finish, or for ctx to be done. It
+// should be called once Start has returned so no new jobs are started, and
+// returns the jobs that were still running, keyed by uuid, with their sprite.
+func (m *Monitor) Drain(ctx context.Context) map[string]string {
+	done := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := make(map[string]string, len(m.inFlight))
+	for jobUUID, spriteName := range m.inFlight {
+		remaining[jobUUID] = spriteName
 	}
+	return remaining
+}
+
+// capacity returns how many more jobs can be started right now
+func (m *Monitor) capacity() int {
+	return min(m.registry.Available(m.queuePools), m.room())
+}
+
+// room returns how many more jobs max_concurrency and the queue's share of
+// shared capacity let the monitor start, however many sprites are idle
+func (m *Monitor) room() int {
+	room := math.MaxInt
+	if m.maxConcurrency > 0 {
+		room = m.maxConcurrency - m.InFlight()
+	}
+	if m.shares != nil {
+		room = min(room, m.shares.Limit(m.queue)-m.InFlight())
+	}
+	return max(room, 0)
 }
 
 func (m *Monitor) Start(ctx context.Context) error {
@@ -42,6 +290,11 @@ func (m *Monitor) Start(ctx context.Context) error {
 	defer ticker.Stop()
 
 	log.Info(fmt.Sprintf("Starting monitor for queue: %s", m.queue))
+	m.health.Started()
+	defer m.health.Stopped()
+
+	go m.watchCancellations(ctx)
+	go m.watchUnhealthy(ctx)
 
 	for {
 		select {
@@ -49,9 +302,13 @@ func (m *Monitor) Start(ctx context.Context) error {
 			log.Info("Monitor shutting down")
 			return ctx.Err()
 		case <-ticker.C:
+			m.health.Tick()
 			jobList, err := m.pollQueue(ctx, m.queue)
 			if err != nil {
 				log.Error("Error polling queue", "error", err)
+				m.health.PollFailed(err)
+			} else {
+				m.health.PollSucceeded()
 			}
 			if err = m.reserveJobs(ctx, jobList); err != nil {
 				log.Error("Error reserving jobs", "error", err)
@@ -66,6 +323,11 @@ func (m *Monitor) pollQueue(ctx context.Context, queueKey string) ([]stacksapi.S
 	var jobList []stacksapi.ScheduledJob
 	jobsProcessed := 0
 
+	start := time.Now()
+	defer func() {
+		metrics.PollDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	for {
 		resp, _, err := m.client.ListScheduledJobs(ctx, stacksapi.ListScheduledJobsRequest{
 			StackKey:        m.stackKey,
@@ -92,6 +354,7 @@ func (m *Monitor) pollQueue(ctx context.Context, queueKey string) ([]stacksapi.S
 		}
 		cursor = resp.PageInfo.EndCursor
 	}
+	metrics.JobsPolled.Add(float64(jobsProcessed))
 	if jobsProcessed > 0 {
 		log.Info(fmt.Sprintf("Processed %v jobs on queue %v", jobsProcessed, queueKey))
 	}
@@ -99,15 +362,63 @@ func (m *Monitor) pollQueue(ctx context.Context, queueKey string) ([]stacksapi.S
 }
 
 func (m *Monitor) reserveJobs(ctx context.Context, jobs []stacksapi.ScheduledJob) error {
+	if m.shares != nil {
+		m.shares.SetDemand(m.queue, m.InFlight()+len(jobs))
+	}
+
+	// Jobs that no idle sprite matched, reported to the pool manager so it
+	// can create sprites for them
+	var waiting []pool.QueryRules
+	defer func() { m.setBacklog(m.queue, m.queuePools, waiting) }()
+
 	if len(jobs) == 0 {
 		return nil
 	}
 
+	// Jobs beyond max_concurrency or the queue's share wait for a running
+	// job to finish rather than for a sprite, so they aren't reported
+	room := m.room()
+	if room == 0 {
+		log.Debug("No capacity to run jobs, skipping reservation", "scheduled", len(jobs), "inFlight", m.InFlight())
+		return nil
+	}
+	capacity := m.capacity()
+
 	log.Info("we're in reserveJobs now", "job slice length", len(jobs))
 
-	jobUUIDs := make([]string, len(jobs))
-	for i, job := range jobs {
+	ordered := orderJobs(jobs, time.Now(), m.priorityAging)
+	logOrder(m.queue, ordered)
+
+	// Place each job on a sprite before reserving it, so we never hold
+	// a reservation for a job we have nowhere to run. Jobs are still tried
+	// once the idle sprites run out, to find those waiting for a sprite.
+	placements := make(map[string]string)
+	jobUUIDs := make([]string, 0, capacity)
+	for _, sj := range ordered {
+		job := sj.ScheduledJob
+		if len(jobUUIDs)+len(waiting) == room {
+			log.Debug("Trimming reservation to available capacity", "scheduled", len(jobs), "room", room)
+			break
+		}
+
+		spriteName, err := m.placeJob(job)
+		if err != nil {
+			log.Debug("Job can't be placed on a sprite", "uuid", job.ID, "agentQueryRules", job.AgentQueryRules, "error", err)
+			// Jobs waiting for a busy sprite that ran their pipeline, or
+			// with rules that don't parse, don't need a new sprite
+			if errors.Is(err, pool.ErrNoIdleSprites) {
+				rules, _ := pool.ParseQueryRules(job.AgentQueryRules)
+				waiting = append(waiting, rules)
+			}
+			continue
+		}
+
+		entry, _ := m.registry.Get(spriteName)
 		bkJob := types.Job{
+			Queue:           m.queue,
+			Sprite:          spriteName,
+			Pool:            entry.Pool,
+			Ephemeral:       entry.Ephemeral,
 			Priority:        job.Priority,
 			AgentQueryRules: job.AgentQueryRules,
 			ScheduledAt:     job.ScheduledAt,
@@ -125,67 +436,535 @@ func (m *Monitor) reserveJobs(ctx context.Context, jobs []stacksapi.ScheduledJob
 			},
 		}
 		if err := m.jobStore.Set(job.ID, bkJob); err != nil {
+			// Nothing has been reserved yet, so give back every sprite placed so far
+			m.releaseJob(job.ID, spriteName)
+			for _, jobUUID := range jobUUIDs {
+				m.releaseJob(jobUUID, placements[jobUUID])
+				if err := m.jobStore.Delete(jobUUID); err != nil {
+					log.Error("failed to delete job from the job store", "error", err)
+				}
+				delete(placements, jobUUID)
+			}
 			return err
 		}
-		jobUUIDs[i] = job.ID
+		placements[job.ID] = spriteName
+		jobUUIDs = append(jobUUIDs, job.ID)
+	}
+
+	if len(jobUUIDs) == 0 {
+		return nil
+	}
+
+	// Jobs placed in pools with their own reservation expiry are reserved in separate batches
+	batches := make(map[time.Duration][]string)
+	var expiries []time.Duration
+	for _, jobUUID := range jobUUIDs {
+		expiry := m.expiryFor(placements[jobUUID])
+		if _, ok := batches[expiry]; !ok {
+			expiries = append(expiries, expiry)
+		}
+		batches[expiry] = append(batches[expiry], jobUUID)
+	}
+
+	var errs []error
+	for _, expiry := range expiries {
+		if err := m.reserveBatch(ctx, batches[expiry], placements, expiry); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
+}
 
+// reserveBatch reserves placed jobs for expiry and starts the ones Buildkite
+// hands to us. Jobs that aren't reserved are released from their sprites.
+func (m *Monitor) reserveBatch(ctx context.Context, jobUUIDs []string, placements map[string]string, expiry time.Duration) error {
 	reserveRequest := stacksapi.BatchReserveJobsRequest{
 		StackKey:                 m.stackKey,
 		JobUUIDs:                 jobUUIDs,
-		ReservationExpirySeconds: 30, // Let's default to 30, but this can be a config value later, realistically it shouldn't take more than 30 seconds to start a job.
+		ReservationExpirySeconds: int(expiry.Seconds()),
 	}
 
+	reserveStart := time.Now()
 	resp, _, err := m.client.BatchReserveJobs(ctx, reserveRequest)
+	metrics.ReserveDuration.Observe(time.Since(reserveStart).Seconds())
 	if err != nil {
-		log.Error("failed to reserve jobs", "error", err)
+		for _, jobUUID := range jobUUIDs {
+			m.releaseJob(jobUUID, placements[jobUUID])
+			if err := m.jobStore.Delete(jobUUID); err != nil {
+				log.Error("failed to delete job from the job store", "error", err)
+			}
+		}
+		return fmt.Errorf("reserving jobs: %w", err)
 	}
+	metrics.JobsReserved.Add(float64(len(resp.Reserved)))
+	metrics.JobsNotReserved.Add(float64(len(resp.NotReserved)))
+
 	if len(resp.NotReserved) > 0 {
 		for i := 0; i < len(resp.NotReserved); i++ {
 			job := resp.NotReserved[i]
+			m.releaseJob(job, placements[job])
 			if err = m.jobStore.Delete(job); err != nil {
 				log.Error("failed to delete job from the job store, but the job is not reserved on Buildkite", "error", err)
 			}
 		}
 		log.Warn("Some jobs were not reserved", "Not Reserved", resp.NotReserved)
 	}
+
+	// Measured from before the request, so we never think we have longer than we do
+	deadline := dispatchDeadline(reserveStart, expiry)
 	if len(resp.Reserved) > 0 {
 		for i := 0; i < len(resp.Reserved); i++ {
 			job := resp.Reserved[i]
-			log.Info("Running this job: ", "uuid", job)
-			err = m.runJob(ctx, job)
+			log.Info("Running this job: ", "uuid", job, "sprite", placements[job], "deadline", deadline.Format(time.RFC3339))
+			err = m.runJob(ctx, job, placements[job], deadline)
 			if err != nil {
 				log.Error("error running jobs", "error", err)
 			}
-			if err = m.jobStore.Delete(job); err != nil {
-				log.Error("failed to delete job from the job store, but the job finished running", "error", err)
-			}
 		}
 	}
 	return nil
 }
 
-func (m *Monitor) runJob(ctx context.Context, jobUUID string) error {
-	// This will eventually get farmed out to a sprite registry
-	spr := m.spriteHandler.NewAgentSprite("bk-test-1")
+// expiryFor returns the reservation expiry for a job placed on the sprite
+func (m *Monitor) expiryFor(spriteName string) time.Duration {
+	if entry, ok := m.registry.Get(spriteName); ok {
+		if expiry, ok := m.poolExpiries[entry.Pool]; ok && expiry > 0 {
+			return expiry
+		}
+	}
+	return m.reservationExpiry
+}
+
+// dispatchDeadline is the latest time the agent can be started for a job
+// reserved at reservedAt. It leaves the agent a margin to acquire the job
+// before the reservation runs out.
+func dispatchDeadline(reservedAt time.Time, expiry time.Duration) time.Time {
+	return reservedAt.Add(expiry - min(expiry/5, maxDispatchMargin))
+}
+
+// placeJob checks out an idle sprite whose tags satisfy the agent query
+// rules of the job and counts the job as in flight. Sprites that recently
+// ran the job's pipeline still have its checkout and caches, so they're
+// preferred, and the job waits up to affinityWait for one that's busy.
+func (m *Monitor) placeJob(job stacksapi.ScheduledJob) (string, error) {
+	rules, err := pool.ParseQueryRules(job.AgentQueryRules)
+	if err != nil {
+		return "", err
+	}
+
+	entry, err := m.registry.CheckoutWarm(m.queuePools, job.ID, job.Pipeline.UUID, rules)
+	switch {
+	case err == nil:
+		metrics.JobsPlacedWarm.Inc()
+	case errors.Is(err, pool.ErrWarmSpriteBusy) && time.Since(job.ScheduledAt) < m.affinityWait:
+		return "", fmt.Errorf("job %s is waiting for a sprite that ran its pipeline: %w", job.ID, err)
+	default:
+		entry, err = m.registry.CheckoutFrom(m.queuePools, job.ID, rules)
+		if err != nil {
+			return "", fmt.Errorf("checking out a sprite for job %s: %w", job.ID, err)
+		}
+	}
+	log.Debug("Checked out sprite", "sprite", entry.Name, "jobUUID", job.ID, "pipeline", job.Pipeline.Slug)
+
+	// Restoring a checkpoint after the job throws away what it left behind
+	if !entry.Ephemeral && m.templates[entry.Pool].Checkpoint == "" && job.Pipeline.UUID != "" {
+		if err := m.registry.RecordPipeline(entry.Name, job.Pipeline.UUID); err != nil {
+			log.Error("failed to record the sprite's pipeline", "sprite", entry.Name, "error", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.inFlight[job.ID] = entry.Name
+	m.mu.Unlock()
+	metrics.JobsInFlight.Inc()
+
+	return entry.Name, nil
+}
+
+// releaseJob stops counting the job as in flight and returns its sprite to the registry
+func (m *Monitor) releaseJob(jobUUID string, spriteName string) {
+	m.mu.Lock()
+	if _, ok := m.inFlight[jobUUID]; ok {
+		delete(m.inFlight, jobUUID)
+		metrics.JobsInFlight.Dec()
+	}
+	m.mu.Unlock()
+
+	if err := m.registry.Return(spriteName); err != nil && !errors.Is(err, pool.ErrSpriteNotFound) {
+		log.Error("failed to return sprite to the registry", "sprite", spriteName, "error", err)
+	}
+}
 
+// newJob returns the job to run on the sprite, configured with the
+// settings of the sprite's pool and tracked so it can be cancelled
+func (m *Monitor) newJob(jobUUID string, spriteName string) backend.Job {
+	job := backend.Job{
+		UUID:           jobUUID,
+		Worker:         spriteName,
+		AcquireTimeout: m.acquireTimeout,
+		JobTimeout:     m.jobTimeout,
+		Handle:         m.track(jobUUID),
+	}
+
+	if entry, ok := m.registry.Get(spriteName); ok {
+		if template, ok := m.templates[entry.Pool]; ok {
+			job.AgentFlags = template.Agent.Flags
+			job.ConfigFile = template.ConfigFile
+		}
+	}
+	return job
+}
+
+func (m *Monitor) runJob(ctx context.Context, jobUUID string, spriteName string, deadline time.Time) error {
+	// Don't race another stack for a job whose reservation is about to run out
+	if time.Now().After(deadline) {
+		m.missedDeadline(jobUUID, spriteName, deadline, nil)
+		m.dropJob(jobUUID)
+		m.releaseJob(jobUUID, spriteName)
+		return nil
+	}
+
+	// Jobs outlive the poll loop when the controller is draining, so don't
+	// let its cancellation stop us from reporting failures
+	ctx = context.WithoutCancel(ctx)
+
+	m.running.Add(1)
 	go func() {
-		if err := spr.RunJob(jobUUID); err != nil {
-			log.Error("failed to run job on sprite", "jobUUID", jobUUID, "error", err)
-			if err = m.finishJob(ctx, jobUUID, fmt.Sprintf("failed to run job %s: %v", jobUUID, err)); err != nil {
-				log.Error("failed to finish job after run error", "error", err)
-			}
+		defer m.running.Done()
+
+		for spriteName != "" {
+			spriteName = m.dispatch(ctx, jobUUID, spriteName, deadline)
 		}
 	}()
 	return nil
 }
 
+// dispatch runs the job's agent on the sprite. A sprite that fails its
+// health check is quarantined, or skipped if it couldn't be reached, and the
+// job moved to another one, which is returned so the job can be dispatched there. Otherwise it returns "" once
+// the job is done.
+func (m *Monitor) dispatch(ctx context.Context, jobUUID string, spriteName string, deadline time.Time) (next string) {
+	entry, _ := m.registry.Get(spriteName)
+	job := m.newJob(jobUUID, spriteName)
+	job.JobTimeout = m.jobTimeoutFor(jobUUID, entry.Pool)
+	job.Acquired = func(ctx context.Context) (bool, error) {
+		return m.jobAcquired(ctx, jobUUID)
+	}
+	job.Started = func() {
+		if err := m.markStarted(jobUUID); err != nil {
+			log.Error("failed to record the job as started", "jobUUID", jobUUID, "error", err)
+		}
+	}
+
+	ran := false
+	defer func() {
+		if next != "" {
+			return
+		}
+		m.untrack(jobUUID)
+		// The record is kept until the job is done, so a restarted controller knows what was running
+		m.dropJob(jobUUID)
+		if ran {
+			m.resetSprite(spriteName, jobUUID)
+		}
+		m.releaseJob(jobUUID, spriteName)
+	}()
+
+	// Sprites created for the job were just provisioned, so only existing ones are checked
+	if entry.Ephemeral {
+		defer m.destroySprite(spriteName, jobUUID)
+		if err := m.createSprite(ctx, spriteName, entry.Pool, deadline); err != nil {
+			m.dispatchFailed(ctx, jobUUID, spriteName, deadline, err)
+			return ""
+		}
+	} else if err := m.checkSprite(ctx, spriteName, deadline); err != nil {
+		if errors.Is(err, backend.ErrDispatchDeadline) {
+			m.missedDeadline(jobUUID, spriteName, deadline, err)
+			return ""
+		}
+		if backend.Unreachable(err) {
+			// Likely the API rather than the sprite, so it's only skipped this time
+			log.Warn("Couldn't reach sprite to check its health, moving the job", "sprite", spriteName, "jobUUID", jobUUID, "error", err)
+		} else {
+			m.quarantine(spriteName, jobUUID, err)
+		}
+
+		next, err := m.reroute(jobUUID, spriteName)
+		if err != nil {
+			// Finishing the job would fail it, so it's left for Buildkite
+			// to offer again once the reservation expires
+			log.Warn("No other sprite for job whose sprite failed its health check, leaving it to be offered again",
+				"jobUUID", jobUUID,
+				"sprite", spriteName,
+				"error", err,
+			)
+			return ""
+		}
+		log.Info("Moved job to another sprite", "jobUUID", jobUUID, "from", spriteName, "to", next)
+		return next
+	}
+
+	ran = true
+	if err := m.backend.RunJob(job, deadline); err != nil {
+		m.dispatchFailed(ctx, jobUUID, spriteName, deadline, err)
+	}
+	return ""
+}
+
+// checkSprite runs the sprite's health check, giving up with
+// ErrDispatchDeadline if the job's reservation runs out first
+func (m *Monitor) checkSprite(ctx context.Context, spriteName string, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	if err := m.backend.CheckHealth(ctx, spriteName); err != nil {
+		return deadlineErr(ctx, fmt.Errorf("health check of sprite %s: %w", spriteName, err))
+	}
+	return nil
+}
+
+// jobTimeoutFor returns how long the job may run on a sprite in the pool.
+// The job's pipeline overrides the pool, which overrides the default.
+func (m *Monitor) jobTimeoutFor(jobUUID string, poolName string) time.Duration {
+	if job, ok, err := m.jobStore.Get(jobUUID); err == nil && ok {
+		if timeout, ok := m.pipelineTimeouts[job.Pipeline.Slug]; ok {
+			return timeout
+		}
+	}
+	if timeout, ok := m.poolJobTimeouts[poolName]; ok {
+		return timeout
+	}
+	return m.jobTimeout
+}
+
+// unacquiredJobStates are the Buildkite job states of a job that no agent
+// has acquired yet
+var unacquiredJobStates = map[string]bool{
+	"scheduled": true,
+	"reserved":  true,
+}
+
+// jobAcquired asks Buildkite whether an agent has acquired the job
+func (m *Monitor) jobAcquired(ctx context.Context, jobUUID string) (bool, error) {
+	resp, _, err := m.client.GetJobStates(ctx, stacksapi.GetJobStatesRequest{
+		StackKey: m.stackKey,
+		JobUUIDs: []string{jobUUID},
+	})
+	if err != nil {
+		return false, err
+	}
+	state, ok := resp.States[jobUUID]
+	if !ok {
+		return false, fmt.Errorf("no state returned for job %s", jobUUID)
+	}
+	return !unacquiredJobStates[state], nil
+}
+
+// quarantine marks a sprite that failed its health check unhealthy, so it
+// gets no more jobs until it passes a recheck or is replaced
+func (m *Monitor) quarantine(spriteName string, jobUUID string, err error) {
+	metrics.SpriteHealthChecksFailed.Inc()
+	log.Error("Sprite failed its health check, quarantining it", "sprite", spriteName, "jobUUID", jobUUID, "error", err)
+	if err := m.registry.SetState(spriteName, pool.StateUnhealthy); err != nil {
+		log.Error("failed to mark sprite unhealthy", "sprite", spriteName, "error", err)
+	}
+}
+
+// reroute moves the job from its sprite to another that matches its agent
+// query rules, and returns the new sprite's name
+func (m *Monitor) reroute(jobUUID string, from string) (string, error) {
+	job, ok, err := m.jobStore.Get(jobUUID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("job %s is not in the job store", jobUUID)
+	}
+	rules, err := pool.ParseQueryRules(job.AgentQueryRules)
+	if err != nil {
+		return "", err
+	}
+
+	entry, err := m.registry.CheckoutFrom(m.queuePools, jobUUID, rules)
+	if err != nil {
+		return "", fmt.Errorf("checking out a sprite for job %s: %w", jobUUID, err)
+	}
+	if err := m.registry.Return(from); err != nil && !errors.Is(err, pool.ErrSpriteNotFound) {
+		log.Error("failed to return sprite to the registry", "sprite", from, "error", err)
+	}
+
+	m.mu.Lock()
+	m.inFlight[jobUUID] = entry.Name
+	m.mu.Unlock()
+
+	job.Sprite = entry.Name
+	job.Pool = entry.Pool
+	job.Ephemeral = entry.Ephemeral
+	if err := m.jobStore.Set(jobUUID, job); err != nil {
+		log.Error("failed to record the job's new sprite", "jobUUID", jobUUID, "sprite", entry.Name, "error", err)
+	}
+	return entry.Name, nil
+}
+
+// dispatchFailed handles a job whose agent couldn't be run. Jobs that ran
+// out of time to start, or that the agent never acquired, are left for
+// Buildkite to offer again. Anything else is finished so the failure shows
+// up in the build.
+func (m *Monitor) dispatchFailed(ctx context.Context, jobUUID string, spriteName string, deadline time.Time, err error) {
+	if errors.Is(err, backend.ErrDispatchDeadline) {
+		m.missedDeadline(jobUUID, spriteName, deadline, err)
+		return
+	}
+	if errors.Is(err, backend.ErrJobCanceled) {
+		log.Info("Stopped the agent of cancelled job", "jobUUID", jobUUID, "sprite", spriteName)
+		return
+	}
+	if errors.Is(err, backend.ErrAcquireTimeout) {
+		log.Warn("Agent didn't acquire job in time, leaving it to be offered again", "jobUUID", jobUUID, "sprite", spriteName, "error", err)
+		return
+	}
+	exitStatus, detail := failureDetail(spriteName, err)
+	log.Error("failed to run job on sprite", "jobUUID", jobUUID, "sprite", spriteName, "exitStatus", exitStatus, "error", err)
+	if err = m.finishJob(ctx, jobUUID, exitStatus, detail); err != nil {
+		log.Error("failed to finish job after run error", "error", err)
+	}
+}
+
+// categoryAdvice tells whoever is looking at a failed job what to do about
+// each category of failure
+var categoryAdvice = map[backend.Category]string{
+	backend.CategorySpriteUnreachable: "Check the sprite exists and is running, and that the controller's Sprites API token can reach it.",
+	backend.CategoryAgentMissing:      "buildkite-agent isn't installed on the sprite. Give its pool a provision_script, or install the agent on the sprite.",
+	backend.CategoryAcquireRejected:   "Buildkite didn't give the job to the agent. Check the agent token on the sprite belongs to the job's cluster.",
+	backend.CategoryTimeout:           "The job ran past its timeout. Raise job_timeout for its pool or pipeline if it needs longer.",
+	backend.CategoryAgentFailed:       "See the controller logs for the agent's output.",
+}
+
+// failureDetail returns the exit status and message a failed job is
+// finished with, saying what went wrong, how many attempts were made, and
+// including the end of the agent's stderr when there is any
+func failureDetail(spriteName string, err error) (int, string) {
+	var runErr *backend.RunError
+	if !errors.As(err, &runErr) {
+		runErr = &backend.RunError{Category: backend.CategoryAgentFailed, ExitCode: -1, Err: err}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "bksprites couldn't run this job on sprite %s (%s): %v\n%s", spriteName, runErr.Category, err, categoryAdvice[runErr.Category])
+	if n := len(runErr.Attempts); n > 0 {
+		fmt.Fprintf(&b, "\n\nGave up after %d attempt(s), the last wasn't tried again because: %s", n, runErr.Attempts[n-1].Reason)
+	}
+	if len(runErr.Stderr) > 0 {
+		b.WriteString("\n\nLast lines of buildkite-agent stderr:\n")
+		b.WriteString(strings.Join(runErr.Stderr, "\n"))
+	}
+	return runErr.ExitCode, b.String()
+}
+
+// resetSprite restores a sprite to its pool's checkpoint once its job is
+// done, so nothing the job left behind reaches the next one. A sprite that
+// can't be restored is marked unhealthy so it isn't given another job until
+// a recheck restores it.
+func (m *Monitor) resetSprite(spriteName string, jobUUID string) {
+	entry, ok := m.registry.Get(spriteName)
+	if !ok || entry.Ephemeral {
+		return
+	}
+	checkpoint := m.templates[entry.Pool].Checkpoint
+	if checkpoint == "" {
+		return
+	}
+
+	start := time.Now()
+	err := m.backend.RestoreCheckpoint(context.Background(), spriteName, checkpoint)
+	metrics.CheckpointRestoreDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.CheckpointRestoresFailed.Inc()
+		log.Error("failed to restore sprite to its checkpoint, marking it unhealthy",
+			"sprite", spriteName,
+			"checkpoint", checkpoint,
+			"jobUUID", jobUUID,
+			"error", err,
+		)
+		if err := m.registry.SetState(spriteName, pool.StateUnhealthy); err != nil {
+			log.Error("failed to mark sprite unhealthy", "sprite", spriteName, "error", err)
+		}
+		return
+	}
+	log.Info("Restored sprite to checkpoint", "sprite", spriteName, "checkpoint", checkpoint, "duration", time.Since(start))
+}
+
+// createSprite creates and provisions the sprite for a job in an ephemeral
+// pool. Sprites can't be created from another sprite's checkpoint, so every
+// sprite is provisioned from scratch, and that has to finish before the
+// reservation runs out.
+func (m *Monitor) createSprite(ctx context.Context, spriteName string, poolName string, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	log.Info("Creating sprite for job", "sprite", spriteName, "pool", poolName)
+	env := backend.ProvisionEnv(m.agentToken, m.templates[poolName].Agent.Version)
+	if err := m.backend.Provision(ctx, spriteName, m.provisionScripts[poolName], env); err != nil {
+		return deadlineErr(ctx, fmt.Errorf("provisioning sprite %s: %w", spriteName, err))
+	}
+	return nil
+}
+
+// deadlineErr marks err as a missed dispatch deadline if ctx ran out
+func deadlineErr(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", backend.ErrDispatchDeadline, err)
+	}
+	return err
+}
+
+// destroySprite deletes a sprite created for a single job. It runs however
+// the job ended. A sprite that can't be deleted is logged with the job it
+// was created for, its name is derived from the job UUID so it can be found.
+func (m *Monitor) destroySprite(spriteName string, jobUUID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), spriteDestroyTimeout)
+	defer cancel()
+
+	if err := m.backend.Destroy(ctx, spriteName); err != nil {
+		log.Error("failed to destroy sprite, it may have leaked", "sprite", spriteName, "jobUUID", jobUUID, "error", err)
+		return
+	}
+	log.Info("Destroyed sprite", "sprite", spriteName, "jobUUID", jobUUID)
+}
+
+// missedDeadline records giving up on a job that couldn't be started before
+// its reservation ran out. Buildkite will offer it again once the
+// reservation expires, so it's left unfinished.
+func (m *Monitor) missedDeadline(jobUUID string, spriteName string, deadline time.Time, err error) {
+	metrics.JobsDispatchDeadlineMissed.Inc()
+	log.Warn("Giving up on job that couldn't be started before its reservation expired",
+		"jobUUID", jobUUID,
+		"sprite", spriteName,
+		"deadline", deadline.Format(time.RFC3339),
+		"error", err,
+	)
+}
+
+// markStarted records that the agent for the job has been started, so a
+// restarted controller knows to look for it on the sprite
+func (m *Monitor) markStarted(jobUUID string) error {
+	job, ok, err := m.jobStore.Get(jobUUID)
+	if err != nil || !ok {
+		return err
+	}
+	job.StartedAt = time.Now()
+	if !job.ScheduledAt.IsZero() {
+		metrics.DispatchWait.Observe(job.StartedAt.Sub(job.ScheduledAt).Seconds())
+	}
+	return m.jobStore.Set(jobUUID, job)
+}
+
 // finishJob returns a status back to Buildkite to surface failures starting an agent
-func (m *Monitor) finishJob(ctx context.Context, job string, msg string) error {
+func (m *Monitor) finishJob(ctx context.Context, job string, exitStatus int, msg string) error {
 	req := stacksapi.FinishJobRequest{
 		StackKey:   m.stackKey,
 		JobUUID:    job,
-		ExitStatus: -1,
+		ExitStatus: exitStatus,
 		Detail:     msg,
 	}
 	_, err := m.client.FinishJob(ctx, req)
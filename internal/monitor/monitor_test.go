@@ -2,14 +2,62 @@ package monitor
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/buildkite/stacksapi"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	spritesapi "github.com/superfly/sprites-go"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	"github.com/jeremybumsted/bksprites/internal/local"
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/sprites"
+	"github.com/jeremybumsted/bksprites/internal/store"
+	"github.com/jeremybumsted/bksprites/internal/types"
 )
 
+func newTestRegistry(t *testing.T, names ...string) *pool.Registry {
+	t.Helper()
+
+	registry := pool.NewRegistry()
+	for _, name := range names {
+		require.NoError(t, registry.Add(name, nil))
+	}
+	return registry
+}
+
+// newTestClient returns a Stacks API client that talks to server
+func newTestClient(t *testing.T, server *httptest.Server) *stacksapi.Client {
+	t.Helper()
+
+	baseURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	client, err := stacksapi.NewClient("test-token", stacksapi.WithBaseURL(baseURL))
+	require.NoError(t, err)
+	return client
+}
+
+// newTestBackend returns a Sprites backend that talks to server
+func newTestBackend(server *httptest.Server) *sprites.Backend {
+	return &sprites.Backend{
+		Handler: &sprites.SpriteHandler{
+			Client: spritesapi.New("test-token", spritesapi.WithBaseURL(server.URL), spritesapi.WithDisableControl()),
+		},
+	}
+}
+
 func TestNewMonitor(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -40,7 +88,7 @@ func TestNewMonitor(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			client := &stacksapi.Client{}
-			monitor := NewMonitor(client, tt.stackKey, tt.queue, tt.interval, "test-token")
+			monitor := NewMonitor(client, tt.stackKey, tt.queue, tt.interval, nil, newTestRegistry(t, "bk-test-1"))
 
 			assert.NotNil(t, monitor)
 			assert.Equal(t, client, monitor.client)
@@ -53,7 +101,7 @@ func TestNewMonitor(t *testing.T) {
 
 func TestNewMonitor_NilClient(t *testing.T) {
 	// Verify that NewMonitor accepts a nil client (it's up to the caller to provide a valid one)
-	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, "test-token")
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
 
 	assert.NotNil(t, monitor)
 	assert.Nil(t, monitor.client)
@@ -61,7 +109,7 @@ func TestNewMonitor_NilClient(t *testing.T) {
 
 func TestReserveJobs_EmptyJobs(t *testing.T) {
 	client := &stacksapi.Client{}
-	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, "test-token")
+	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
 
 	ctx := context.Background()
 	err := monitor.reserveJobs(ctx, []stacksapi.ScheduledJob{})
@@ -72,7 +120,7 @@ func TestReserveJobs_EmptyJobs(t *testing.T) {
 
 func TestReserveJobs_NilJobs(t *testing.T) {
 	client := &stacksapi.Client{}
-	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, "test-token")
+	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
 
 	ctx := context.Background()
 	err := monitor.reserveJobs(ctx, nil)
@@ -83,21 +131,21 @@ func TestReserveJobs_NilJobs(t *testing.T) {
 
 func TestRunJob_ExecutesWithoutPanic(t *testing.T) {
 	client := &stacksapi.Client{}
-	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, "test-token")
+	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, sprites.NewBackend("test-token"), newTestRegistry(t, "bk-test-1"))
 
 	ctx := context.Background()
 
 	// This test ensures runJob can be called without panicking
 	// It catches syntax errors like missing () on goroutine invocation
 	assert.NotPanics(t, func() {
-		err := monitor.runJob(ctx, "test-job-uuid")
+		err := monitor.runJob(ctx, "test-job-uuid", "bk-test-1", time.Now().Add(time.Minute))
 		assert.NoError(t, err)
 	})
 }
 
 func TestRunJob_GoroutineExecutes(t *testing.T) {
 	client := &stacksapi.Client{}
-	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, "test-token")
+	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, sprites.NewBackend("test-token"), newTestRegistry(t, "bk-test-1"))
 
 	ctx := context.Background()
 
@@ -109,7 +157,7 @@ func TestRunJob_GoroutineExecutes(t *testing.T) {
 	wg.Add(1)
 
 	start := time.Now()
-	err := monitor.runJob(ctx, "test-job-uuid")
+	err := monitor.runJob(ctx, "test-job-uuid", "bk-test-1", time.Now().Add(time.Minute))
 	elapsed := time.Since(start)
 
 	wg.Done()
@@ -121,7 +169,872 @@ func TestRunJob_GoroutineExecutes(t *testing.T) {
 	assert.Less(t, elapsed, 1*time.Second, "runJob should return without blocking indefinitely")
 }
 
+func TestRunJob_PastDeadline(t *testing.T) {
+	registry := newTestRegistry(t, "bk-test-1")
+	monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil, registry)
+
+	_, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+
+	// The job is given up on without starting an agent, and its sprite is freed
+	require.NoError(t, monitor.runJob(context.Background(), "job-1", "bk-test-1", time.Now().Add(-time.Second)))
+
+	assert.Equal(t, 0, monitor.InFlight())
+	assert.Equal(t, 1, registry.Count(pool.StateIdle))
+	assert.Empty(t, monitor.Drain(context.Background()))
+}
+
+func TestDispatchDeadline(t *testing.T) {
+	reservedAt := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		expiry   time.Duration
+		expected time.Duration
+	}{
+		{name: "short expiry keeps a fifth", expiry: 10 * time.Second, expected: 8 * time.Second},
+		{name: "margin is capped", expiry: 5 * time.Minute, expected: 5*time.Minute - maxDispatchMargin},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, reservedAt.Add(tt.expected), dispatchDeadline(reservedAt, tt.expiry))
+		})
+	}
+}
+
+func TestExpiryFor(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("slow", "slow-1", nil))
+	require.NoError(t, registry.AddToPool("fast", "fast-1", nil))
+
+	monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil, registry,
+		WithReservationExpiry(time.Minute),
+		WithPoolReservationExpiry(map[string]time.Duration{"slow": 5 * time.Minute}),
+	)
+
+	assert.Equal(t, 5*time.Minute, monitor.expiryFor("slow-1"))
+	assert.Equal(t, time.Minute, monitor.expiryFor("fast-1"))
+	assert.Equal(t, time.Minute, monitor.expiryFor("unknown"))
+}
+
+func TestJobTimeoutFor(t *testing.T) {
+	monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil, pool.NewRegistry(),
+		WithJobTimeout(time.Hour),
+		WithPoolJobTimeout(map[string]time.Duration{"deploy": 10 * time.Minute, "batch": 0}),
+		WithPipelineJobTimeout(map[string]time.Duration{"nightly": 6 * time.Hour}),
+	)
+	require.NoError(t, monitor.jobStore.Set("nightly-job", types.Job{Pipeline: types.Pipeline{Slug: "nightly"}}))
+	require.NoError(t, monitor.jobStore.Set("app-job", types.Job{Pipeline: types.Pipeline{Slug: "app"}}))
+
+	assert.Equal(t, 6*time.Hour, monitor.jobTimeoutFor("nightly-job", "deploy"), "pipeline overrides the pool")
+	assert.Equal(t, 10*time.Minute, monitor.jobTimeoutFor("app-job", "deploy"))
+	assert.Equal(t, time.Duration(0), monitor.jobTimeoutFor("app-job", "batch"), "no limit")
+	assert.Equal(t, time.Hour, monitor.jobTimeoutFor("app-job", "linux"))
+	assert.Equal(t, time.Hour, monitor.jobTimeoutFor("unknown-job", "linux"))
+}
+
+func TestJobAcquired(t *testing.T) {
+	tests := []struct {
+		state   string
+		want    bool
+		wantErr bool
+	}{
+		{state: "reserved", want: false},
+		{state: "scheduled", want: false},
+		{state: "accepted", want: true},
+		{state: "running", want: true},
+		{state: "canceled", want: true},
+		{state: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/stacks/test-stack/jobs/get-states", r.URL.Path)
+				states := "{}"
+				if tt.state != "" {
+					states = fmt.Sprintf(`{"job-1": %q}`, tt.state)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"states": %s}`, states)
+			}))
+			defer server.Close()
+
+			monitor := NewMonitor(newTestClient(t, server), "test-stack", "default", 30*time.Second, nil, pool.NewRegistry())
+
+			acquired, err := monitor.jobAcquired(context.Background(), "job-1")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, acquired)
+		})
+	}
+}
+
+func TestFailureDetail(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantExitStatus int
+		wantDetail     []string
+	}{
+		{
+			name: "agent missing",
+			err: &backend.RunError{
+				Category: backend.CategoryAgentMissing,
+				ExitCode: 127,
+				Stderr:   []string{"bash: .buildkite-agent/bin/buildkite-agent: No such file or directory"},
+				Attempts: []backend.Attempt{{Number: 1, Err: errors.New("exit status 127"), Reason: "command exited with status 127"}},
+				Err:      errors.New("failed to start sprite command after 1 attempt(s): exit status 127"),
+			},
+			wantExitStatus: 127,
+			wantDetail: []string{
+				"bksprites couldn't run this job on sprite bk-test-1 (agent missing): failed to start sprite command after 1 attempt(s): exit status 127\n",
+				"buildkite-agent isn't installed on the sprite",
+				"\n\nGave up after 1 attempt(s), the last wasn't tried again because: command exited with status 127",
+				"\n\nLast lines of buildkite-agent stderr:\nbash: .buildkite-agent/bin/buildkite-agent: No such file or directory",
+			},
+		},
+		{
+			name: "sprite unreachable",
+			err: fmt.Errorf("provisioning sprite: %w", &backend.RunError{
+				Category: backend.CategorySpriteUnreachable,
+				ExitCode: -1,
+				Err:      errors.New("failed to connect"),
+			}),
+			wantExitStatus: -1,
+			wantDetail:     []string{"(sprite unreachable): provisioning sprite: failed to connect\nCheck the sprite exists and is running"},
+		},
+		{
+			name:           "not from the backend",
+			err:            errors.New("something else went wrong"),
+			wantExitStatus: -1,
+			wantDetail:     []string{"(agent failed): something else went wrong\nSee the controller logs"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exitStatus, detail := failureDetail("bk-test-1", tt.err)
+			assert.Equal(t, tt.wantExitStatus, exitStatus)
+			for _, want := range tt.wantDetail {
+				assert.Contains(t, detail, want)
+			}
+		})
+	}
+}
+
+func TestDispatchFailed_FinishesJob(t *testing.T) {
+	var finished map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/stacks/test-stack/jobs/job-1/finish", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&finished))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	monitor := NewMonitor(newTestClient(t, server), "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
+	err := &backend.RunError{
+		Category: backend.CategoryAcquireRejected,
+		ExitCode: 1,
+		Stderr:   []string{"fatal: Failed to acquire job: job already assigned"},
+		Err:      errors.New("failed to start sprite command after 1 attempt(s): exit status 1"),
+	}
+	monitor.dispatchFailed(context.Background(), "job-1", "bk-test-1", time.Now().Add(time.Minute), err)
+
+	require.NotNil(t, finished)
+	assert.EqualValues(t, 1, finished["exit_status"])
+	assert.Contains(t, finished["detail"], "(acquire rejected)")
+	assert.Contains(t, finished["detail"], "fatal: Failed to acquire job: job already assigned")
+}
+
+func TestDispatchFailed_NotFinished(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		// The agent never acquired the job, so it's left for Buildkite to offer again
+		{name: "acquire timeout", err: backend.ErrAcquireTimeout},
+		// Buildkite already knows the job is over
+		{name: "cancelled", err: backend.ErrJobCanceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Finishing the job would panic on the zero client
+			monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
+			err := fmt.Errorf("failed to start sprite command after 1 attempt(s): %w", tt.err)
+
+			assert.NotPanics(t, func() {
+				monitor.dispatchFailed(context.Background(), "job-1", "bk-test-1", time.Now().Add(time.Minute), err)
+			})
+		})
+	}
+}
+
+func TestPlaceJob_ChecksOutSprite(t *testing.T) {
+	client := &stacksapi.Client{}
+	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1", "bk-test-2"))
+
+	spriteName, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "bk-test-1", spriteName)
+
+	spriteName, err = monitor.placeJob(stacksapi.ScheduledJob{ID: "job-2"})
+	require.NoError(t, err)
+	assert.Equal(t, "bk-test-2", spriteName)
+
+	assert.Equal(t, 2, monitor.InFlight())
+
+	// Both sprites are busy until their jobs finish, so a third job has nowhere to go
+	_, err = monitor.placeJob(stacksapi.ScheduledJob{ID: "job-3"})
+	assert.ErrorIs(t, err, pool.ErrNoIdleSprites)
+
+	// Releasing a job frees its sprite
+	monitor.releaseJob("job-1", "bk-test-1")
+	assert.Equal(t, 1, monitor.InFlight())
+
+	spriteName, err = monitor.placeJob(stacksapi.ScheduledJob{ID: "job-3"})
+	require.NoError(t, err)
+	assert.Equal(t, "bk-test-1", spriteName)
+}
+
+func TestPlaceJob_EmptyRegistry(t *testing.T) {
+	client := &stacksapi.Client{}
+	monitor := NewMonitor(client, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t))
+
+	_, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "test-job-uuid"})
+	assert.ErrorIs(t, err, pool.ErrNoIdleSprites)
+	assert.Equal(t, 0, monitor.InFlight())
+}
+
+func TestPlaceJob_AgentQueryRules(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.Add("linux-small", map[string]string{"os": "linux", "size": "small"}))
+	require.NoError(t, registry.Add("linux-large", map[string]string{"os": "linux", "size": "large", "docker": "true"}))
+	require.NoError(t, registry.Add("darwin", map[string]string{"os": "darwin", "size": "large"}))
+
+	tests := []struct {
+		name     string
+		rules    []string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "queue rule is ignored",
+			rules:    []string{"queue=default"},
+			expected: "linux-small",
+		},
+		{
+			name:     "exact match",
+			rules:    []string{"queue=default", "os=darwin"},
+			expected: "darwin",
+		},
+		{
+			name:     "multiple rules",
+			rules:    []string{"os=linux", "docker=true"},
+			expected: "linux-large",
+		},
+		{
+			name:     "negated rule",
+			rules:    []string{"size!=small", "os=lin*"},
+			expected: "linux-large",
+		},
+		{
+			name:    "no sprite matches",
+			rules:   []string{"os=windows"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid rule",
+			rules:   []string{"os"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil, registry)
+
+			spriteName, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1", AgentQueryRules: tt.rules})
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, 0, monitor.InFlight())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, spriteName)
+
+			monitor.releaseJob("job-1", spriteName)
+		})
+	}
+}
+
+func TestPlaceJob_PipelineAffinity(t *testing.T) {
+	tests := []struct {
+		name       string
+		warmBusy   bool // the sprite that ran the pipeline is running another job
+		waited     time.Duration
+		checkpoint string
+		expected   string
+		wantErr    error
+	}{
+		{
+			name:     "sprite that ran the pipeline is preferred",
+			expected: "bk-test-2",
+		},
+		{
+			name:     "waits for a busy sprite that ran the pipeline",
+			warmBusy: true,
+			waited:   time.Second,
+			wantErr:  pool.ErrWarmSpriteBusy,
+		},
+		{
+			name:     "takes any sprite once it has waited long enough",
+			warmBusy: true,
+			waited:   time.Minute,
+			expected: "bk-test-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestRegistry(t, "bk-test-1", "bk-test-2", "bk-test-3")
+			monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil, registry, WithAffinityWait(30*time.Second))
+
+			warm := stacksapi.ScheduledJob{ID: "job-0", Pipeline: stacksapi.Pipeline{UUID: "pipeline-1"}}
+			require.NoError(t, registry.Claim("bk-test-1", "other"))
+			spriteName, err := monitor.placeJob(warm)
+			require.NoError(t, err)
+			require.Equal(t, "bk-test-2", spriteName)
+			monitor.releaseJob("job-0", spriteName)
+			require.NoError(t, registry.Return("bk-test-1"))
+			if tt.warmBusy {
+				require.NoError(t, registry.Claim("bk-test-2", "other"))
+			}
+
+			job := stacksapi.ScheduledJob{
+				ID:          "job-1",
+				ScheduledAt: time.Now().Add(-tt.waited),
+				Pipeline:    stacksapi.Pipeline{UUID: "pipeline-1"},
+			}
+			spriteName, err = monitor.placeJob(job)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Equal(t, 0, monitor.InFlight())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, spriteName)
+
+			s, _ := registry.Get(spriteName)
+			assert.Equal(t, []string{"pipeline-1"}, s.Pipelines)
+		})
+	}
+}
+
+func TestPlaceJob_CheckpointPoolNotWarm(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "bk-test-1", nil))
+	monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil, registry,
+		WithPools(map[string]types.AgentSprite{"linux": {Checkpoint: "golden"}}))
+
+	spriteName, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1", Pipeline: stacksapi.Pipeline{UUID: "pipeline-1"}})
+	require.NoError(t, err)
+
+	// The sprite is restored after the job, so nothing of the pipeline is left on it
+	s, _ := registry.Get(spriteName)
+	assert.Empty(t, s.Pipelines)
+}
+
+func TestCapacity(t *testing.T) {
+	tests := []struct {
+		name           string
+		sprites        []string
+		maxConcurrency int
+		running        int
+		expected       int
+	}{
+		{
+			name:     "limited by idle sprites",
+			sprites:  []string{"a", "b", "c"},
+			expected: 3,
+		},
+		{
+			name:           "limited by max concurrency",
+			sprites:        []string{"a", "b", "c"},
+			maxConcurrency: 2,
+			expected:       2,
+		},
+		{
+			name:           "running jobs count against max concurrency",
+			sprites:        []string{"a", "b", "c", "d"},
+			maxConcurrency: 3,
+			running:        2,
+			expected:       1,
+		},
+		{
+			name:           "at max concurrency",
+			sprites:        []string{"a", "b", "c"},
+			maxConcurrency: 1,
+			running:        1,
+			expected:       0,
+		},
+		{
+			name:     "every sprite busy",
+			sprites:  []string{"a", "b"},
+			running:  2,
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil,
+				newTestRegistry(t, tt.sprites...),
+				WithMaxConcurrency(tt.maxConcurrency),
+			)
+
+			for i := 0; i < tt.running; i++ {
+				_, err := monitor.placeJob(stacksapi.ScheduledJob{ID: fmt.Sprintf("job-%d", i)})
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, tt.running, monitor.InFlight())
+			assert.Equal(t, tt.expected, monitor.capacity())
+		})
+	}
+}
+
+func TestCapacity_QueuePools(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddToPool("builds", "build-1", nil))
+	require.NoError(t, registry.AddToPool("builds", "build-2", nil))
+	require.NoError(t, registry.AddToPool("deploys", "deploy-1", nil))
+
+	builds := NewMonitor(&stacksapi.Client{}, "stack-builds", "builds", 30*time.Second, nil, registry,
+		WithQueuePools([]string{"builds"}),
+	)
+	deploys := NewMonitor(&stacksapi.Client{}, "stack-deploys", "deploys", 30*time.Second, nil, registry,
+		WithQueuePools([]string{"deploys"}),
+	)
+
+	assert.Equal(t, 2, builds.capacity())
+	assert.Equal(t, 1, deploys.capacity())
+
+	// Jobs only land on sprites from the queue's pools
+	spriteName, err := deploys.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "deploy-1", spriteName)
+
+	_, err = deploys.placeJob(stacksapi.ScheduledJob{ID: "job-2"})
+	assert.ErrorIs(t, err, pool.ErrNoIdleSprites)
+	assert.Equal(t, 2, builds.capacity())
+}
+
+func TestCapacity_Shares(t *testing.T) {
+	registry := newTestRegistry(t, "a", "b", "c", "d")
+	shares := pool.NewShares(registry, 0)
+	shares.SetWeight("builds", 3)
+	shares.SetWeight("nightly", 1)
+
+	builds := NewMonitor(&stacksapi.Client{}, "stack-builds", "builds", 30*time.Second, nil, registry, WithShares(shares))
+	nightly := NewMonitor(&stacksapi.Client{}, "stack-nightly", "nightly", 30*time.Second, nil, registry, WithShares(shares))
+
+	// Only builds has work, so it can use every sprite
+	shares.SetDemand("builds", 10)
+	assert.Equal(t, 4, builds.capacity())
+	assert.Equal(t, 0, nightly.capacity())
+
+	// Once nightly has work too they split the sprites by weight
+	shares.SetDemand("nightly", 10)
+	assert.Equal(t, 3, builds.capacity())
+	assert.Equal(t, 1, nightly.capacity())
+
+	// Running jobs count against the share
+	_, err := builds.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, builds.capacity())
+}
+
+func TestReserveJobs_NoCapacity(t *testing.T) {
+	// A nil client would panic if reserveJobs tried to call the API
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t))
+
+	jobs := []stacksapi.ScheduledJob{{ID: "job-1"}, {ID: "job-2"}}
+
+	assert.NotPanics(t, func() {
+		err := monitor.reserveJobs(context.Background(), jobs)
+		assert.NoError(t, err)
+	})
+
+	// Nothing should have been recorded for jobs we didn't try to reserve
+	_, ok, err := monitor.jobStore.Get("job-1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestReserveJobs_NoMatchingSprite(t *testing.T) {
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.Add("linux", map[string]string{"os": "linux"}))
+
+	// A nil client would panic if reserveJobs tried to call the API
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, registry)
+
+	jobs := []stacksapi.ScheduledJob{
+		{ID: "job-1", AgentQueryRules: []string{"os=darwin"}},
+		{ID: "job-2", AgentQueryRules: []string{"queue=default", "docker=true"}},
+	}
+
+	assert.NotPanics(t, func() {
+		err := monitor.reserveJobs(context.Background(), jobs)
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, 0, monitor.InFlight())
+	assert.Equal(t, 1, registry.Count(pool.StateIdle))
+}
+
+func TestReserveJobs_Backlog(t *testing.T) {
+	linux := map[string]string{"os": "linux"}
+	tests := []struct {
+		name           string
+		maxConcurrency int
+		jobs           []stacksapi.ScheduledJob
+		want           int // jobs reported as waiting for a sprite
+	}{
+		{
+			name: "no matching idle sprite",
+			jobs: []stacksapi.ScheduledJob{
+				{ID: "job-1", AgentQueryRules: []string{"os=darwin"}},
+				{ID: "job-2", AgentQueryRules: []string{"os=darwin"}},
+			},
+			want: 2,
+		},
+		{
+			name:           "deferred by max concurrency",
+			maxConcurrency: 2, // one is taken by the busy sprite's job
+			jobs: []stacksapi.ScheduledJob{
+				{ID: "job-1", AgentQueryRules: []string{"os=darwin"}},
+				{ID: "job-2", AgentQueryRules: []string{"os=darwin"}},
+			},
+			want: 1,
+		},
+		{
+			name:           "at max concurrency",
+			maxConcurrency: 1,
+			jobs:           []stacksapi.ScheduledJob{{ID: "job-1", AgentQueryRules: []string{"os=darwin"}}},
+		},
+		{
+			name: "waiting for the sprite that ran its pipeline",
+			jobs: []stacksapi.ScheduledJob{{ID: "job-1", Pipeline: stacksapi.Pipeline{UUID: "pipeline-1"}, ScheduledAt: time.Now()}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := pool.NewRegistry()
+			require.NoError(t, registry.Add("warm", linux))
+			require.NoError(t, registry.RecordPipeline("warm", "pipeline-1"))
+
+			// A nil client would panic if reserveJobs tried to call the API
+			monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, registry,
+				WithMaxConcurrency(tt.maxConcurrency),
+				WithAffinityWait(time.Minute),
+			)
+			_, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "running", AgentQueryRules: []string{"os=linux"}})
+			require.NoError(t, err)
+
+			waiting := -1
+			monitor.setBacklog = func(queue string, pools []string, rules []pool.QueryRules) { waiting = len(rules) }
+
+			require.NoError(t, monitor.reserveJobs(context.Background(), tt.jobs))
+			assert.Equal(t, tt.want, waiting)
+		})
+	}
+}
+
+func TestReserveJobs_StoreFailure(t *testing.T) {
+	registry := newTestRegistry(t, "bk-test-1", "bk-test-2")
+
+	// Fill the store so the first job fits and the second doesn't
+	s := store.NewStore()
+	for i := range 999 {
+		require.NoError(t, s.Set(fmt.Sprintf("filler:%d", i), "", 0))
+	}
+
+	// A nil client would panic if reserveJobs tried to call the API
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, registry,
+		WithJobStore(store.NewJobStore(s)),
+	)
+
+	jobs := []stacksapi.ScheduledJob{{ID: "job-1"}, {ID: "job-2"}}
+
+	assert.NotPanics(t, func() {
+		err := monitor.reserveJobs(context.Background(), jobs)
+		assert.ErrorIs(t, err, store.ErrStoreFull)
+	})
+
+	assert.Equal(t, 0, monitor.InFlight())
+	assert.Equal(t, 2, registry.Count(pool.StateIdle))
+	for _, job := range jobs {
+		_, ok, err := monitor.jobStore.Get(job.ID)
+		require.NoError(t, err)
+		assert.False(t, ok, job.ID)
+	}
+}
+
+func TestDrain_NoJobs(t *testing.T) {
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
+
+	remaining := monitor.Drain(context.Background())
+	assert.Empty(t, remaining)
+}
+
+func TestDrain_WaitsForJobs(t *testing.T) {
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
+
+	_, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+
+	// Stand in for the agent goroutine started by runJob
+	monitor.running.Add(1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		monitor.releaseJob("job-1", "bk-test-1")
+		monitor.running.Done()
+	}()
+
+	remaining := monitor.Drain(context.Background())
+	assert.Empty(t, remaining)
+	assert.Equal(t, 0, monitor.InFlight())
+}
+
+func TestDrain_Timeout(t *testing.T) {
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
+
+	_, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+	monitor.running.Add(1)
+	defer monitor.running.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	remaining := monitor.Drain(ctx)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, map[string]string{"job-1": "bk-test-1"}, remaining)
+}
+
 // Note: Testing pollQueue, reserveJobs with actual jobs, and detailed runJob behavior
 // would require mocking the stacksapi.Client and sprites, which would be more appropriate
 // as integration tests or would require refactoring to inject dependencies via interfaces.
 // For unit tests, we've covered the structural, lifecycle, and goroutine syntax aspects.
+
+func TestCapacity_EphemeralPool(t *testing.T) {
+	registry := newTestRegistry(t, "bk-test-1")
+	require.NoError(t, registry.AddEphemeralPool("clean", nil, 2))
+	monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, nil, registry, WithQueuePools([]string{"clean"}))
+
+	assert.Equal(t, 2, monitor.capacity())
+
+	spriteName, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+	assert.Equal(t, pool.EphemeralSpriteName("job-1"), spriteName)
+	assert.Equal(t, 1, monitor.capacity())
+
+	monitor.releaseJob("job-1", spriteName)
+	assert.Equal(t, 2, monitor.capacity())
+}
+
+func TestRunJob_LocalBackend(t *testing.T) {
+	agent := filepath.Join(t.TempDir(), "buildkite-agent")
+	require.NoError(t, os.WriteFile(agent, []byte("#!/bin/sh\nexit 0\n"), 0o755))
+	dir := t.TempDir()
+
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddEphemeralPool("clean", nil, 1))
+	monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, local.NewBackend(dir, local.WithAgentPath(agent)), registry,
+		WithProvisioning("agent-token", map[string][]byte{"clean": []byte("touch provisioned")}),
+	)
+
+	spriteName, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+
+	// The job succeeds, so it isn't finished, the test client would panic if it were
+	require.NoError(t, monitor.runJob(context.Background(), "job-1", spriteName, time.Now().Add(time.Minute)))
+	assert.Empty(t, monitor.Drain(context.Background()))
+
+	// The directory made for the job is gone once it's done, and its slot is freed
+	assert.NoDirExists(t, filepath.Join(dir, spriteName))
+	assert.Equal(t, 0, monitor.InFlight())
+	assert.Equal(t, 1, registry.Available(nil))
+}
+
+func TestRunJob_EphemeralDestroyedOnFailure(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		// Creating the sprite takes longer than the reservation allows
+		if r.Method == http.MethodPost {
+			// The connection is only watched for the client going away once the body is read
+			_, _ = io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	registry := pool.NewRegistry()
+	require.NoError(t, registry.AddEphemeralPool("clean", nil, 1))
+	monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, newTestBackend(server), registry)
+
+	spriteName, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+	require.NoError(t, err)
+
+	require.NoError(t, monitor.runJob(context.Background(), "job-1", spriteName, time.Now().Add(100*time.Millisecond)))
+	assert.Empty(t, monitor.Drain(context.Background()))
+
+	// The sprite is destroyed even though it was never provisioned, and its slot is freed
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, requests, "DELETE /v1/sprites/bk-job-job-1")
+	assert.Equal(t, 0, monitor.InFlight())
+	assert.Equal(t, 1, registry.Available(nil))
+}
+
+func TestRunJob_QuarantinesUnhealthySprite(t *testing.T) {
+	tests := []struct {
+		name        string
+		ephemeral   bool // whether there's another sprite the job can move to
+		unreachable bool // whether the Sprites API fails rather than the sprite
+		want        pool.State
+	}{
+		{name: "job moves to another sprite", ephemeral: true, want: pool.StateUnhealthy},
+		{name: "no other sprite", want: pool.StateUnhealthy},
+		{name: "unreachable sprites are only skipped", ephemeral: true, unreachable: true, want: pool.StateIdle},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests []string
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				mu.Unlock()
+
+				switch r.Method {
+				case http.MethodGet:
+					w.Header().Set("Content-Type", "application/json")
+					if tt.unreachable {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						_, _ = w.Write([]byte(`{"error": "unavailable"}`))
+						return
+					}
+					_, _ = w.Write([]byte(`{"name": "bk-test-1", "status": "failed"}`))
+				case http.MethodPost:
+					// Creating the new sprite runs past the reservation
+					_, _ = io.Copy(io.Discard, r.Body)
+					<-r.Context().Done()
+				default:
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+			defer server.Close()
+
+			registry := newTestRegistry(t, "bk-test-1")
+			if tt.ephemeral {
+				require.NoError(t, registry.AddEphemeralPool("clean", nil, 1))
+			}
+			monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, newTestBackend(server), registry)
+
+			spriteName, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+			require.NoError(t, err)
+			require.Equal(t, "bk-test-1", spriteName)
+			require.NoError(t, monitor.jobStore.Set("job-1", types.Job{Sprite: spriteName}))
+
+			// The job isn't finished, the test client would panic if it were
+			require.NoError(t, monitor.runJob(context.Background(), "job-1", spriteName, time.Now().Add(500*time.Millisecond)))
+			assert.Empty(t, monitor.Drain(context.Background()))
+
+			s, ok := registry.Get("bk-test-1")
+			require.True(t, ok)
+			assert.Equal(t, tt.want, s.State)
+			assert.Empty(t, s.JobUUID)
+			assert.Equal(t, 0, monitor.InFlight())
+
+			_, ok, err = monitor.jobStore.Get("job-1")
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, "GET /v1/sprites/bk-test-1", requests[0])
+			if tt.ephemeral {
+				assert.Contains(t, requests, "POST /v1/sprites")
+				assert.Contains(t, requests, "DELETE /v1/sprites/bk-job-job-1")
+			} else {
+				assert.Len(t, requests, 1)
+			}
+		})
+	}
+}
+
+func TestResetSprite(t *testing.T) {
+	tests := []struct {
+		name       string
+		checkpoint string
+		status     int
+		wantState  pool.State
+		wantCalls  int
+	}{
+		{name: "no checkpoint configured", wantState: pool.StateBusy},
+		{name: "restored", checkpoint: "golden", status: http.StatusOK, wantState: pool.StateBusy, wantCalls: 2},
+		{name: "restore failed", checkpoint: "golden", status: http.StatusInternalServerError, wantState: pool.StateUnhealthy, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				if r.Method == http.MethodGet && tt.status == http.StatusOK {
+					_, _ = w.Write([]byte(`[{"id": "v1", "comment": "golden"}]`))
+				}
+			}))
+			defer server.Close()
+
+			registry := pool.NewRegistry()
+			require.NoError(t, registry.AddToPool("linux", "bk-1", nil))
+			monitor := NewMonitor(&stacksapi.Client{}, "test-stack", "default", 30*time.Second, newTestBackend(server), registry,
+				WithPools(map[string]types.AgentSprite{"linux": {Checkpoint: tt.checkpoint}}),
+			)
+
+			spriteName, err := monitor.placeJob(stacksapi.ScheduledJob{ID: "job-1"})
+			require.NoError(t, err)
+
+			monitor.resetSprite(spriteName, "job-1")
+
+			entry, _ := registry.Get(spriteName)
+			assert.Equal(t, tt.wantState, entry.State)
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package monitor
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/jeremybumsted/bksprites/internal/pool"
+)
+
+const (
+	// recheckInterval is how often unhealthy sprites are checked again
+	recheckInterval = time.Minute
+
+	// recheckTimeout bounds restoring and checking one unhealthy sprite
+	recheckTimeout = 5 * time.Minute
+)
+
+// watchUnhealthy checks the unhealthy sprites in the queue's pools every
+// recheckInterval until ctx is cancelled, returning those that pass to idle
+func (m *Monitor) watchUnhealthy(ctx context.Context) {
+	ticker := time.NewTicker(recheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.recheckUnhealthy(ctx)
+		}
+	}
+}
+
+// recheckUnhealthy restores each unhealthy sprite to its pool's checkpoint,
+// if it has one, and runs its health check. Sprites the pool manager
+// created are left for it to replace.
+func (m *Monitor) recheckUnhealthy(ctx context.Context) {
+	for _, s := range m.registry.List() {
+		if s.State != pool.StateUnhealthy || s.Ephemeral || m.manager.Replaces(s) {
+			continue
+		}
+		if len(m.queuePools) > 0 && !slices.Contains(m.queuePools, s.Pool) {
+			continue
+		}
+		// Another queue's monitor may be checking it already
+		if err := m.registry.Recheck(s.Name); err != nil {
+			continue
+		}
+
+		state := pool.StateIdle
+		if err := m.recheck(ctx, s); err != nil {
+			state = pool.StateUnhealthy
+			log.Debug("Unhealthy sprite failed its recheck", "sprite", s.Name, "error", err)
+		} else {
+			log.Info("Unhealthy sprite passed its recheck, returning it to the pool", "sprite", s.Name)
+		}
+		if err := m.registry.SetState(s.Name, state); err != nil {
+			log.Error("failed to set the state of rechecked sprite", "sprite", s.Name, "state", state, "error", err)
+		}
+	}
+}
+
+// recheck restores the sprite to its pool's checkpoint, if any, so nothing
+// left by the job before it was marked unhealthy reaches the next one, then
+// runs its health check
+func (m *Monitor) recheck(ctx context.Context, s pool.Sprite) error {
+	ctx, cancel := context.WithTimeout(ctx, recheckTimeout)
+	defer cancel()
+
+	if checkpoint := m.templates[s.Pool].Checkpoint; checkpoint != "" {
+		if err := m.backend.RestoreCheckpoint(ctx, s.Name, checkpoint); err != nil {
+			return err
+		}
+	}
+	return m.backend.CheckHealth(ctx, s.Name)
+}
@@ -0,0 +1,61 @@
+package monitor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/local"
+	"github.com/jeremybumsted/bksprites/internal/manager"
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/types"
+)
+
+func TestRecheckUnhealthy(t *testing.T) {
+	tests := []struct {
+		name       string
+		agent      string // the buildkite-agent script run by the health check
+		checkpoint string // local sprites can't be restored, so any checkpoint fails
+		want       pool.State
+	}{
+		{name: "passes", agent: "#!/bin/sh\nexit 0\n", want: pool.StateIdle},
+		{name: "agent fails", agent: "#!/bin/sh\nexit 1\n", want: pool.StateUnhealthy},
+		{name: "restore fails", agent: "#!/bin/sh\nexit 0\n", checkpoint: "golden", want: pool.StateUnhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := filepath.Join(t.TempDir(), "buildkite-agent")
+			require.NoError(t, os.WriteFile(agent, []byte(tt.agent), 0o755))
+
+			registry := pool.NewRegistry()
+			for _, s := range []struct{ pool, name string }{
+				{"linux", "bk-1"},
+				{"linux", "bk-linux-0a1b2c3d"}, // created by the manager
+				{"mac", "bk-2"},                // in another queue's pool
+			} {
+				require.NoError(t, registry.AddToPool(s.pool, s.name, nil))
+				require.NoError(t, registry.SetState(s.name, pool.StateUnhealthy))
+			}
+			pm := manager.NewManager(registry, "test-token", "agent-token", []manager.Pool{{Name: "linux"}})
+
+			monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, local.NewBackend(t.TempDir(), local.WithAgentPath(agent)), registry,
+				WithQueuePools([]string{"linux"}),
+				WithPools(map[string]types.AgentSprite{"linux": {Checkpoint: tt.checkpoint}}),
+				WithManager(pm),
+			)
+			monitor.recheckUnhealthy(context.Background())
+
+			for name, want := range map[string]pool.State{"bk-1": tt.want, "bk-linux-0a1b2c3d": pool.StateUnhealthy, "bk-2": pool.StateUnhealthy} {
+				s, ok := registry.Get(name)
+				require.True(t, ok)
+				assert.Equal(t, want, s.State, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/stacksapi"
+	"github.com/charmbracelet/log"
+
+	"github.com/jeremybumsted/bksprites/internal/metrics"
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/types"
+)
+
+// terminalJobStates are the Buildkite job states a job can't leave, so
+// there is nothing left for the controller to do with it
+var terminalJobStates = map[string]bool{
+	"finished":  true,
+	"canceled":  true,
+	"timed_out": true,
+	"skipped":   true,
+	"broken":    true,
+	"expired":   true,
+}
+
+// Reconcile looks at the jobs a previous controller process left in the
+// job store and brings them back in line with reality before the monitor
+// starts. Jobs still running on a sprite are re-adopted, jobs whose agent
+// has gone away are finished unless no agent acquired them, and everything
+// else is dropped. Sprites
+// created for jobs in ephemeral pools are destroyed once their job is done.
+func (m *Monitor) Reconcile(ctx context.Context) error {
+	jobs, err := m.jobStore.List()
+	if err != nil {
+		return fmt.Errorf("listing stored jobs: %w", err)
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	log.Info("Reconciling jobs from a previous run", "queue", m.queue, "jobs", len(jobs))
+
+	var gone []string
+	for jobUUID, job := range jobs {
+		// Another queue's monitor reconciles its own jobs
+		if job.Queue != "" && job.Queue != m.queue {
+			delete(jobs, jobUUID)
+			continue
+		}
+
+		// Reserved but its agent never started, the reservation will expire
+		// and Buildkite will hand the job out again
+		if job.StartedAt.IsZero() || job.Sprite == "" {
+			log.Info("Dropping job that was reserved but never started", "jobUUID", jobUUID)
+			m.dropJob(jobUUID)
+			continue
+		}
+
+		adopted, err := m.adoptJob(ctx, jobUUID, job)
+		if err != nil {
+			log.Error("failed to look for the job on its sprite", "jobUUID", jobUUID, "sprite", job.Sprite, "error", err)
+		}
+		if !adopted {
+			gone = append(gone, jobUUID)
+		}
+	}
+
+	if len(gone) == 0 {
+		return nil
+	}
+
+	states := m.jobStates(ctx, gone)
+	for _, jobUUID := range gone {
+		if jobs[jobUUID].Ephemeral {
+			m.destroySprite(jobs[jobUUID].Sprite, jobUUID)
+		}
+
+		state, known := states[jobUUID]
+		if known && terminalJobStates[state] {
+			log.Info("Dropping job that already finished", "jobUUID", jobUUID, "state", state)
+			m.dropJob(jobUUID)
+			continue
+		}
+		// The agent stopped before acquiring the job, so it's left for
+		// Buildkite to offer again rather than failed
+		if known && unacquiredJobStates[state] {
+			log.Info("Releasing job whose agent is gone without acquiring it", "jobUUID", jobUUID, "state", state)
+			m.dropJob(jobUUID)
+			continue
+		}
+
+		detail := fmt.Sprintf("bksprites controller restarted and the buildkite-agent for job %s is no longer running on sprite %s", jobUUID, jobs[jobUUID].Sprite)
+		log.Warn("Finishing job whose agent is gone", "jobUUID", jobUUID, "sprite", jobs[jobUUID].Sprite, "state", state)
+		if err := m.finishJob(ctx, jobUUID, -1, detail); err != nil {
+			log.Error("failed to finish orphaned job", "jobUUID", jobUUID, "error", err)
+		}
+		m.dropJob(jobUUID)
+	}
+
+	return nil
+}
+
+// adoptJob looks for the agent session running the job on its sprite and,
+// if it is still there, watches it to completion as if this process had started it
+func (m *Monitor) adoptJob(ctx context.Context, jobUUID string, job types.Job) (bool, error) {
+	session, err := m.backend.FindJob(ctx, job.Sprite, jobUUID)
+	if err != nil || session == "" {
+		return false, err
+	}
+
+	if job.Ephemeral {
+		if _, err := m.registry.AdoptEphemeral(job.Pool, jobUUID); err != nil && !errors.Is(err, pool.ErrSpriteNotFound) {
+			return false, fmt.Errorf("claiming sprite %s: %w", job.Sprite, err)
+		}
+	} else if err := m.registry.Claim(job.Sprite, jobUUID); err != nil && !errors.Is(err, pool.ErrSpriteNotFound) {
+		return false, fmt.Errorf("claiming sprite %s: %w", job.Sprite, err)
+	}
+
+	// Records written before queues were tracked are claimed by the first
+	// monitor to adopt them, so other queues' monitors skip them
+	if job.Queue == "" {
+		job.Queue = m.queue
+		if err := m.jobStore.Set(jobUUID, job); err != nil {
+			log.Error("failed to record the queue of a re-adopted job", "jobUUID", jobUUID, "error", err)
+		}
+	}
+
+	agentJob := m.newJob(jobUUID, job.Sprite)
+	agentJob.JobTimeout = m.jobTimeoutFor(jobUUID, job.Pool)
+	agentJob.Acquired = func(ctx context.Context) (bool, error) {
+		return m.jobAcquired(ctx, jobUUID)
+	}
+	m.mu.Lock()
+	m.inFlight[jobUUID] = job.Sprite
+	m.mu.Unlock()
+	metrics.JobsInFlight.Inc()
+
+	log.Info("Re-adopted running job", "jobUUID", jobUUID, "sprite", job.Sprite, "session", session)
+
+	m.running.Add(1)
+	go func() {
+		defer func() {
+			m.untrack(jobUUID)
+			m.dropJob(jobUUID)
+			m.resetSprite(job.Sprite, jobUUID)
+			m.releaseJob(jobUUID, job.Sprite)
+			m.running.Done()
+		}()
+		if job.Ephemeral {
+			defer m.destroySprite(job.Sprite, jobUUID)
+		}
+
+		if err := m.backend.AttachJob(context.Background(), agentJob, session); err != nil {
+			log.Error("re-adopted job exited with an error", "jobUUID", jobUUID, "error", err)
+			m.dispatchFailed(context.Background(), jobUUID, job.Sprite, time.Time{}, err)
+		}
+	}()
+	return true, nil
+}
+
+// jobStates fetches the current Buildkite state of the given jobs. Failures
+// are logged and result in an empty map so the caller treats every job as unknown.
+func (m *Monitor) jobStates(ctx context.Context, jobUUIDs []string) map[string]string {
+	resp, _, err := m.client.GetJobStates(ctx, stacksapi.GetJobStatesRequest{
+		StackKey: m.stackKey,
+		JobUUIDs: jobUUIDs,
+	})
+	if err != nil {
+		log.Error("failed to get job states", "error", err)
+		return map[string]string{}
+	}
+	return resp.States
+}
+
+// dropJob removes a job from the job store
+func (m *Monitor) dropJob(jobUUID string) {
+	if err := m.jobStore.Delete(jobUUID); err != nil {
+		log.Error("failed to delete job from the job store", "jobUUID", jobUUID, "error", err)
+	}
+}
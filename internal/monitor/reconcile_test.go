@@ -0,0 +1,112 @@
+package monitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/local"
+	"github.com/jeremybumsted/bksprites/internal/pool"
+	"github.com/jeremybumsted/bksprites/internal/store"
+	"github.com/jeremybumsted/bksprites/internal/types"
+)
+
+func TestReconcile_NoStoredJobs(t *testing.T) {
+	// A nil client would panic if Reconcile tried to call the API
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"))
+
+	assert.NotPanics(t, func() {
+		assert.NoError(t, monitor.Reconcile(context.Background()))
+	})
+}
+
+func TestReconcile_DropsUnstartedJobs(t *testing.T) {
+	js := store.NewJobStore(store.NewStore())
+	require.NoError(t, js.Set("reserved-1", types.Job{Sprite: "bk-test-1"}))
+	require.NoError(t, js.Set("reserved-2", types.Job{}))
+
+	registry := newTestRegistry(t, "bk-test-1")
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, registry, WithJobStore(js))
+
+	require.NoError(t, monitor.Reconcile(context.Background()))
+
+	jobs, err := js.List()
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	// Nothing was adopted, so the sprite is still free
+	assert.Equal(t, 0, monitor.InFlight())
+	assert.Equal(t, 1, registry.Count(pool.StateIdle))
+}
+
+func TestReconcile_SkipsOtherQueues(t *testing.T) {
+	js := store.NewJobStore(store.NewStore())
+	require.NoError(t, js.Set("builds-job", types.Job{Queue: "builds", Sprite: "bk-test-1"}))
+	require.NoError(t, js.Set("deploys-job", types.Job{Queue: "deploys", Sprite: "bk-test-1"}))
+
+	monitor := NewMonitor(nil, "test-stack", "builds", 30*time.Second, nil, newTestRegistry(t, "bk-test-1"), WithJobStore(js))
+
+	require.NoError(t, monitor.Reconcile(context.Background()))
+
+	// The unstarted builds job is dropped, the deploys job is left for its own monitor
+	jobs, err := js.List()
+	require.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Contains(t, jobs, "deploys-job")
+}
+
+func TestReconcile_AgentGone(t *testing.T) {
+	var finished []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/finish") {
+			finished = append(finished, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"states": {"reserved-job": "reserved", "finished-job": "finished", "running-job": "running"}}`))
+	}))
+	defer server.Close()
+
+	js := store.NewJobStore(store.NewStore())
+	for _, jobUUID := range []string{"reserved-job", "finished-job", "running-job"} {
+		require.NoError(t, js.Set(jobUUID, types.Job{Sprite: "local-1", StartedAt: time.Now()}))
+	}
+
+	// The local backend never finds a job, so every agent is gone
+	monitor := NewMonitor(newTestClient(t, server), "test-stack", "default", 30*time.Second, local.NewBackend(t.TempDir()), newTestRegistry(t, "local-1"),
+		WithJobStore(js),
+	)
+	require.NoError(t, monitor.Reconcile(context.Background()))
+
+	// Only the job an agent acquired is failed, the reserved one is left
+	// for Buildkite to offer again
+	assert.Equal(t, []string{"/stacks/test-stack/jobs/running-job/finish"}, finished)
+	jobs, err := js.List()
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+}
+
+func TestMarkStarted(t *testing.T) {
+	js := store.NewJobStore(store.NewStore())
+	require.NoError(t, js.Set("job-1", types.Job{Sprite: "bk-test-1"}))
+
+	monitor := NewMonitor(nil, "test-stack", "default", 30*time.Second, nil, newTestRegistry(t), WithJobStore(js))
+
+	require.NoError(t, monitor.markStarted("job-1"))
+
+	job, ok, err := js.Get("job-1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, job.StartedAt.IsZero())
+	assert.Equal(t, "bk-test-1", job.Sprite)
+
+	// Unknown jobs are ignored
+	assert.NoError(t, monitor.markStarted("missing"))
+}
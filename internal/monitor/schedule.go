@@ -0,0 +1,66 @@
+package monitor
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buildkite/stacksapi"
+	"github.com/charmbracelet/log"
+)
+
+// defaultPriorityAging is how long a job waits before it is treated as one
+// priority level higher
+const defaultPriorityAging = 5 * time.Minute
+
+// scheduledJob is a scheduled job with the priority it is dispatched at
+type scheduledJob struct {
+	stacksapi.ScheduledJob
+	effectivePriority int
+	waited            time.Duration
+}
+
+// orderJobs sorts jobs into the order they should be dispatched in: highest
+// priority first, then longest waiting. Every aging interval a job spends
+// waiting raises its priority by one, so low priority work isn't starved
+// by a steady stream of higher priority jobs. An aging interval of 0
+// disables aging.
+func orderJobs(jobs []stacksapi.ScheduledJob, now time.Time, aging time.Duration) []scheduledJob {
+	ordered := make([]scheduledJob, 0, len(jobs))
+	for _, job := range jobs {
+		sj := scheduledJob{ScheduledJob: job, effectivePriority: job.Priority}
+		if !job.ScheduledAt.IsZero() {
+			sj.waited = max(now.Sub(job.ScheduledAt), 0)
+		}
+		if aging > 0 {
+			sj.effectivePriority += int(sj.waited / aging)
+		}
+		ordered = append(ordered, sj)
+	}
+
+	slices.SortStableFunc(ordered, func(a, b scheduledJob) int {
+		if a.effectivePriority != b.effectivePriority {
+			return b.effectivePriority - a.effectivePriority
+		}
+		if c := a.ScheduledAt.Compare(b.ScheduledAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return ordered
+}
+
+// logOrder writes the dispatch order to the debug log
+func logOrder(queue string, ordered []scheduledJob) {
+	if len(ordered) == 0 || log.GetLevel() > log.DebugLevel {
+		return
+	}
+
+	entries := make([]string, 0, len(ordered))
+	for _, job := range ordered {
+		entries = append(entries, fmt.Sprintf("%s(priority=%d effective=%d waited=%s)",
+			job.ID, job.Priority, job.effectivePriority, job.waited.Round(time.Second)))
+	}
+	log.Debug("Dispatch order", "queue", queue, "jobs", strings.Join(entries, ", "))
+}
@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/stacksapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderJobs(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	tests := []struct {
+		name     string
+		aging    time.Duration
+		jobs     []stacksapi.ScheduledJob
+		expected []string
+	}{
+		{
+			name:  "highest priority first",
+			aging: 0,
+			jobs: []stacksapi.ScheduledJob{
+				{ID: "low", Priority: 0, ScheduledAt: ago(time.Minute)},
+				{ID: "high", Priority: 10, ScheduledAt: ago(time.Second)},
+				{ID: "mid", Priority: 5, ScheduledAt: ago(time.Second)},
+			},
+			expected: []string{"high", "mid", "low"},
+		},
+		{
+			name:  "oldest first within a priority",
+			aging: 0,
+			jobs: []stacksapi.ScheduledJob{
+				{ID: "newer", ScheduledAt: ago(time.Second)},
+				{ID: "oldest", ScheduledAt: ago(time.Hour)},
+				{ID: "older", ScheduledAt: ago(time.Minute)},
+			},
+			expected: []string{"oldest", "older", "newer"},
+		},
+		{
+			name:  "long waiting jobs age past newer higher priority jobs",
+			aging: 5 * time.Minute,
+			jobs: []stacksapi.ScheduledJob{
+				{ID: "fresh-high", Priority: 2, ScheduledAt: ago(time.Minute)},
+				{ID: "starved-low", Priority: 0, ScheduledAt: ago(16 * time.Minute)},
+			},
+			expected: []string{"starved-low", "fresh-high"},
+		},
+		{
+			name:  "aging disabled",
+			aging: 0,
+			jobs: []stacksapi.ScheduledJob{
+				{ID: "fresh-high", Priority: 2, ScheduledAt: ago(time.Minute)},
+				{ID: "starved-low", Priority: 0, ScheduledAt: ago(16 * time.Minute)},
+			},
+			expected: []string{"fresh-high", "starved-low"},
+		},
+		{
+			name:  "ties broken by id",
+			aging: time.Minute,
+			jobs: []stacksapi.ScheduledJob{
+				{ID: "b", ScheduledAt: ago(time.Second)},
+				{ID: "a", ScheduledAt: ago(time.Second)},
+			},
+			expected: []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ordered := orderJobs(tt.jobs, now, tt.aging)
+
+			ids := make([]string, 0, len(ordered))
+			for _, job := range ordered {
+				ids = append(ids, job.ID)
+			}
+			assert.Equal(t, tt.expected, ids)
+		})
+	}
+}
+
+func TestOrderJobs_EffectivePriority(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	jobs := []stacksapi.ScheduledJob{
+		{ID: "job-1", Priority: 1, ScheduledAt: now.Add(-11 * time.Minute)},
+		{ID: "job-2", Priority: 1}, // no scheduled time, doesn't age
+		{ID: "job-3", Priority: 1, ScheduledAt: now.Add(time.Minute)},
+	}
+
+	ordered := orderJobs(jobs, now, 5*time.Minute)
+
+	assert.Equal(t, 3, ordered[0].effectivePriority)
+	assert.Equal(t, 11*time.Minute, ordered[0].waited)
+	for _, job := range ordered[1:] {
+		assert.Equal(t, 1, job.effectivePriority)
+		assert.Zero(t, job.waited)
+	}
+}
@@ -0,0 +1,512 @@
+// Package pool keeps track of the sprites available to the controller
+// and hands them out to jobs as they are dispatched
+package pool
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoIdleSprites  = errors.New("no idle sprites available")
+	ErrSpriteExists   = errors.New("sprite already registered")
+	ErrSpriteNotFound = errors.New("sprite not registered")
+	ErrSpriteBusy     = errors.New("sprite is busy")
+	ErrPoolExists     = errors.New("pool already registered")
+	ErrWarmSpriteBusy = errors.New("sprites that ran the pipeline are busy")
+)
+
+// maxRecentPipelines is how many pipelines are remembered for each sprite
+const maxRecentPipelines = 5
+
+// State is the lifecycle state of a sprite in the registry
+type State string
+
+const (
+	StateIdle      State = "idle"      // ready to be checked out for a job
+	StateBusy      State = "busy"      // running a job
+	StateDraining  State = "draining"  // finishing its current job, will not be handed out again
+	StateUnhealthy State = "unhealthy" // failed a check and should not be used
+	StateUpgrading State = "upgrading" // its agent is being replaced, idle again once that's done
+	StateChecking  State = "checking"  // was unhealthy and is being checked again
+)
+
+// Sprite is a snapshot of a registered sprite
+type Sprite struct {
+	Name         string
+	Pool         string // the configured pool the sprite belongs to, if any
+	Ephemeral    bool   // created for a single job and destroyed afterwards
+	State        State
+	Tags         map[string]string // matched against the agent query rules of jobs
+	JobUUID      string            // The job currently running on the sprite, if any
+	AgentVersion string            // buildkite-agent version installed on the sprite, if known
+	Pipelines    []string          // UUIDs of the pipelines the sprite ran recently, most recent first
+	Jobs         int               // jobs handed to the sprite since it was registered
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// ephemeralPool is a pool whose sprites are created for each job
+type ephemeralPool struct {
+	name    string
+	tags    map[string]string
+	max     int // most sprites that can exist at once
+	running int
+}
+
+// Registry is the set of sprites known to the controller. It is safe
+// for concurrent use.
+type Registry struct {
+	mu        sync.Mutex
+	sprites   map[string]*Sprite
+	order     []string // registration order, so checkouts are deterministic
+	ephemeral []*ephemeralPool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sprites: make(map[string]*Sprite),
+	}
+}
+
+// EphemeralSpriteName returns the name of the sprite created to run a job
+// in an ephemeral pool, so a leaked sprite can be traced back to its job
+func EphemeralSpriteName(jobUUID string) string {
+	return "bk-job-" + jobUUID
+}
+
+// AddEphemeralPool registers a pool that creates a sprite for every job,
+// up to max at once. Its sprites carry tags for query rule matching.
+func (r *Registry) AddEphemeralPool(poolName string, tags map[string]string, max int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.ephemeral {
+		if p.name == poolName {
+			return ErrPoolExists
+		}
+	}
+	r.ephemeral = append(r.ephemeral, &ephemeralPool{name: poolName, tags: maps.Clone(tags), max: max})
+	return nil
+}
+
+// Add registers a sprite in the idle state
+func (r *Registry) Add(name string, tags map[string]string) error {
+	return r.AddToPool("", name, tags)
+}
+
+// AddToPool registers a sprite belonging to the named pool in the idle state
+func (r *Registry) AddToPool(poolName string, name string, tags map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sprites[name]; ok {
+		return ErrSpriteExists
+	}
+
+	now := time.Now()
+	r.sprites[name] = &Sprite{
+		Name:      name,
+		Pool:      poolName,
+		State:     StateIdle,
+		Tags:      maps.Clone(tags),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	r.order = append(r.order, name)
+	return nil
+}
+
+// Remove unregisters a sprite. Busy sprites can't be removed until they
+// have been returned, nor upgrading or checking ones until they're done.
+func (r *Registry) Remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+	if s.JobUUID != "" || s.State == StateUpgrading || s.State == StateChecking {
+		return ErrSpriteBusy
+	}
+
+	r.removeLocked(name)
+	return nil
+}
+
+func (r *Registry) removeLocked(name string) {
+	delete(r.sprites, name)
+	for i, n := range r.order {
+		if n == name {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Checkout marks the first idle sprite whose tags satisfy rules as busy
+// running jobUUID and returns it
+func (r *Registry) Checkout(jobUUID string, rules QueryRules) (Sprite, error) {
+	return r.CheckoutFrom(nil, jobUUID, rules)
+}
+
+// CheckoutFrom is Checkout limited to sprites in the given pools, or any
+// pool if pools is empty. Idle sprites are preferred, then a new sprite
+// from an ephemeral pool with room for one.
+func (r *Registry) CheckoutFrom(pools []string, jobUUID string, rules QueryRules) (Sprite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range r.order {
+		s := r.sprites[name]
+		if s.Ephemeral || s.State != StateIdle || !inPools(s.Pool, pools) || !rules.Match(s.Tags) {
+			continue
+		}
+		s.State = StateBusy
+		s.JobUUID = jobUUID
+		s.Jobs++
+		s.UpdatedAt = time.Now()
+		return *s, nil
+	}
+
+	for _, p := range r.ephemeral {
+		if p.running >= p.max || !inPools(p.name, pools) || !rules.Match(p.tags) {
+			continue
+		}
+		s := r.addEphemeral(p, jobUUID)
+		return *s, nil
+	}
+
+	return Sprite{}, ErrNoIdleSprites
+}
+
+// CheckoutWarm is CheckoutFrom limited to idle sprites that recently ran
+// the pipeline, preferring the one that ran it last. If the only such
+// sprites are running other jobs it returns ErrWarmSpriteBusy.
+func (r *Registry) CheckoutWarm(pools []string, jobUUID string, pipelineUUID string, rules QueryRules) (Sprite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var warmest *Sprite
+	warmestAt, busy := maxRecentPipelines, false
+	for _, name := range r.order {
+		s := r.sprites[name]
+		if s.Ephemeral || !inPools(s.Pool, pools) || !rules.Match(s.Tags) {
+			continue
+		}
+		i := slices.Index(s.Pipelines, pipelineUUID)
+		if i < 0 {
+			continue
+		}
+		switch {
+		case s.State == StateBusy:
+			busy = true
+		case s.State == StateIdle && i < warmestAt:
+			warmest, warmestAt = s, i
+		}
+	}
+
+	switch {
+	case warmest != nil:
+		warmest.State = StateBusy
+		warmest.JobUUID = jobUUID
+		warmest.Jobs++
+		warmest.UpdatedAt = time.Now()
+		return *warmest, nil
+	case busy:
+		return Sprite{}, ErrWarmSpriteBusy
+	default:
+		return Sprite{}, ErrNoIdleSprites
+	}
+}
+
+// RecordPipeline remembers that the sprite ran a job from the pipeline,
+// forgetting the oldest once it has run more than a few
+func (r *Registry) RecordPipeline(name string, pipelineUUID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+	// Snapshots share the slice, so it's replaced rather than modified
+	pipelines := make([]string, 0, maxRecentPipelines)
+	pipelines = append(pipelines, pipelineUUID)
+	for _, p := range s.Pipelines {
+		if p != pipelineUUID && len(pipelines) < maxRecentPipelines {
+			pipelines = append(pipelines, p)
+		}
+	}
+	s.Pipelines = pipelines
+	return nil
+}
+
+// AdoptEphemeral records a sprite already running a job in an ephemeral
+// pool, e.g. when re-adopting jobs after a restart. It may take the pool
+// over its limit until the job finishes.
+func (r *Registry) AdoptEphemeral(poolName string, jobUUID string) (Sprite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.sprites[EphemeralSpriteName(jobUUID)]; ok {
+		return *s, ErrSpriteExists
+	}
+	for _, p := range r.ephemeral {
+		if p.name == poolName {
+			return *r.addEphemeral(p, jobUUID), nil
+		}
+	}
+	return Sprite{}, ErrSpriteNotFound
+}
+
+func (r *Registry) addEphemeral(p *ephemeralPool, jobUUID string) *Sprite {
+	s := &Sprite{
+		Name:      EphemeralSpriteName(jobUUID),
+		Pool:      p.name,
+		Ephemeral: true,
+		State:     StateBusy,
+		Tags:      maps.Clone(p.tags),
+		JobUUID:   jobUUID,
+		Jobs:      1,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	p.running++
+	r.sprites[s.Name] = s
+	r.order = append(r.order, s.Name)
+	return s
+}
+
+// Claim assigns jobUUID to a specific sprite, e.g. when re-adopting a job
+// that was already running on it. Idle sprites become busy.
+func (r *Registry) Claim(name string, jobUUID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+	if s.JobUUID != "" {
+		return ErrSpriteBusy
+	}
+
+	if s.State == StateIdle {
+		s.State = StateBusy
+	}
+	s.JobUUID = jobUUID
+	s.Jobs++
+	s.UpdatedAt = time.Now()
+	return nil
+}
+
+// Return gives a checked out sprite back to the registry. Busy sprites
+// become idle again, draining and unhealthy sprites keep their state.
+// Ephemeral sprites are forgotten, freeing room in their pool.
+func (r *Registry) Return(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+
+	if s.Ephemeral {
+		r.removeLocked(name)
+		for _, p := range r.ephemeral {
+			if p.name == s.Pool {
+				p.running--
+			}
+		}
+		return nil
+	}
+
+	if s.State == StateBusy {
+		s.State = StateIdle
+	}
+	s.JobUUID = ""
+	s.UpdatedAt = time.Now()
+	return nil
+}
+
+// SetCreatedAt records when a sprite was created, for sprites that existed
+// before they were registered
+func (r *Registry) SetCreatedAt(name string, createdAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+	s.CreatedAt = createdAt
+	return nil
+}
+
+// Upgrade takes an idle sprite out of rotation while its agent is
+// replaced. Set it back to idle once that's done.
+func (r *Registry) Upgrade(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+	if s.State != StateIdle {
+		return ErrSpriteBusy
+	}
+	s.State = StateUpgrading
+	s.UpdatedAt = time.Now()
+	return nil
+}
+
+// Recheck takes an unhealthy sprite aside while it's checked again, so
+// only one check runs at a time. Set it back to idle if it passes, or
+// unhealthy if it doesn't.
+func (r *Registry) Recheck(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+	if s.State != StateUnhealthy {
+		return ErrSpriteBusy
+	}
+	s.State = StateChecking
+	s.UpdatedAt = time.Now()
+	return nil
+}
+
+// SetAgentVersion records the buildkite-agent version installed on a sprite
+func (r *Registry) SetAgentVersion(name string, version string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+	s.AgentVersion = version
+	return nil
+}
+
+// SetState moves a sprite into the given state. A busy sprite keeps its
+// job until it is returned.
+func (r *Registry) SetState(name string, state State) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return ErrSpriteNotFound
+	}
+
+	s.State = state
+	s.UpdatedAt = time.Now()
+	return nil
+}
+
+// Get returns a snapshot of the named sprite
+func (r *Registry) Get(name string) (Sprite, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sprites[name]
+	if !ok {
+		return Sprite{}, false
+	}
+	return *s, true
+}
+
+// List returns a snapshot of every registered sprite in registration order
+func (r *Registry) List() []Sprite {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]Sprite, 0, len(r.order))
+	for _, name := range r.order {
+		list = append(list, *r.sprites[name])
+	}
+	return list
+}
+
+// Count returns the number of sprites in the given state
+func (r *Registry) Count(state State) int {
+	return r.CountIn(nil, state)
+}
+
+// CountIn returns the number of sprites in the given state and pools, or
+// any pool if pools is empty
+func (r *Registry) CountIn(pools []string, state State) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, s := range r.sprites {
+		if s.State == state && inPools(s.Pool, pools) {
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of registered sprites
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.sprites)
+}
+
+// Available returns how many more jobs could be checked out to the given
+// pools, or any pool if pools is empty: the idle sprites plus the room left
+// in ephemeral pools
+func (r *Registry) Available(pools []string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, s := range r.sprites {
+		if !s.Ephemeral && s.State == StateIdle && inPools(s.Pool, pools) {
+			n++
+		}
+	}
+	for _, p := range r.ephemeral {
+		if inPools(p.name, pools) {
+			n += max(p.max-p.running, 0)
+		}
+	}
+	return n
+}
+
+// Capacity returns the most jobs the registry could run at once: every
+// sprite that isn't unhealthy or being checked again, plus the limit of
+// each ephemeral pool
+func (r *Registry) Capacity() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, s := range r.sprites {
+		if !s.Ephemeral && s.State != StateUnhealthy && s.State != StateChecking {
+			n++
+		}
+	}
+	for _, p := range r.ephemeral {
+		n += p.max
+	}
+	return n
+}
+
+func inPools(pool string, pools []string) bool {
+	return len(pools) == 0 || slices.Contains(pools, pool)
+}
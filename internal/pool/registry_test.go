@@ -0,0 +1,451 @@
+package pool
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	assert.NotNil(t, registry)
+	assert.NotNil(t, registry.sprites)
+	assert.Empty(t, registry.List())
+}
+
+func TestRegistry_Add(t *testing.T) {
+	registry := NewRegistry()
+
+	err := registry.Add("sprite-1", nil)
+	require.NoError(t, err)
+
+	s, ok := registry.Get("sprite-1")
+	assert.True(t, ok)
+	assert.Equal(t, "sprite-1", s.Name)
+	assert.Equal(t, StateIdle, s.State)
+	assert.Empty(t, s.JobUUID)
+
+	// Adding the same sprite twice should fail
+	err = registry.Add("sprite-1", nil)
+	assert.ErrorIs(t, err, ErrSpriteExists)
+}
+
+func TestRegistry_CheckoutAndReturn(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("sprite-1", nil))
+	require.NoError(t, registry.Add("sprite-2", nil))
+
+	// Sprites are handed out in registration order
+	s, err := registry.Checkout("job-1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sprite-1", s.Name)
+	assert.Equal(t, StateBusy, s.State)
+	assert.Equal(t, "job-1", s.JobUUID)
+
+	s, err = registry.Checkout("job-2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sprite-2", s.Name)
+
+	// Nothing left
+	_, err = registry.Checkout("job-3", nil)
+	assert.ErrorIs(t, err, ErrNoIdleSprites)
+
+	// Returning a sprite makes it available again
+	require.NoError(t, registry.Return("sprite-1"))
+	s, ok := registry.Get("sprite-1")
+	assert.True(t, ok)
+	assert.Equal(t, StateIdle, s.State)
+	assert.Empty(t, s.JobUUID)
+
+	s, err = registry.Checkout("job-3", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sprite-1", s.Name)
+	assert.Equal(t, "job-3", s.JobUUID)
+}
+
+func TestRegistry_CheckoutSkipsUnavailable(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("draining", nil))
+	require.NoError(t, registry.Add("unhealthy", nil))
+	require.NoError(t, registry.Add("idle", nil))
+
+	require.NoError(t, registry.SetState("draining", StateDraining))
+	require.NoError(t, registry.SetState("unhealthy", StateUnhealthy))
+
+	s, err := registry.Checkout("job-1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "idle", s.Name)
+}
+
+func TestRegistry_ReturnKeepsDrainingAndUnhealthy(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+	}{
+		{name: "draining", state: StateDraining},
+		{name: "unhealthy", state: StateUnhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewRegistry()
+			require.NoError(t, registry.Add("sprite-1", nil))
+
+			_, err := registry.Checkout("job-1", nil)
+			require.NoError(t, err)
+
+			// The state changes while the job is still running
+			require.NoError(t, registry.SetState("sprite-1", tt.state))
+
+			require.NoError(t, registry.Return("sprite-1"))
+
+			s, ok := registry.Get("sprite-1")
+			assert.True(t, ok)
+			assert.Equal(t, tt.state, s.State)
+			assert.Empty(t, s.JobUUID)
+		})
+	}
+}
+
+func TestRegistry_Claim(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("sprite-1", nil))
+	require.NoError(t, registry.Add("sprite-2", nil))
+
+	require.NoError(t, registry.Claim("sprite-2", "job-1"))
+
+	s, ok := registry.Get("sprite-2")
+	assert.True(t, ok)
+	assert.Equal(t, StateBusy, s.State)
+	assert.Equal(t, "job-1", s.JobUUID)
+
+	// Already running a job
+	assert.ErrorIs(t, registry.Claim("sprite-2", "job-2"), ErrSpriteBusy)
+	assert.ErrorIs(t, registry.Claim("missing", "job-2"), ErrSpriteNotFound)
+
+	// Checkout skips the claimed sprite
+	s, err := registry.Checkout("job-2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sprite-1", s.Name)
+}
+
+func TestRegistry_UnknownSprite(t *testing.T) {
+	registry := NewRegistry()
+
+	assert.ErrorIs(t, registry.Return("missing"), ErrSpriteNotFound)
+	assert.ErrorIs(t, registry.SetState("missing", StateIdle), ErrSpriteNotFound)
+	assert.ErrorIs(t, registry.Remove("missing"), ErrSpriteNotFound)
+
+	_, ok := registry.Get("missing")
+	assert.False(t, ok)
+}
+
+func TestRegistry_Remove(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("sprite-1", nil))
+	require.NoError(t, registry.Add("sprite-2", nil))
+
+	_, err := registry.Checkout("job-1", nil)
+	require.NoError(t, err)
+
+	// A busy sprite can't be removed
+	assert.ErrorIs(t, registry.Remove("sprite-1"), ErrSpriteBusy)
+
+	require.NoError(t, registry.Remove("sprite-2"))
+	_, ok := registry.Get("sprite-2")
+	assert.False(t, ok)
+	assert.Len(t, registry.List(), 1)
+}
+
+func TestRegistry_Count(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("sprite-1", nil))
+	require.NoError(t, registry.Add("sprite-2", nil))
+	require.NoError(t, registry.Add("sprite-3", nil))
+
+	_, err := registry.Checkout("job-1", nil)
+	require.NoError(t, err)
+	require.NoError(t, registry.SetState("sprite-3", StateUnhealthy))
+
+	assert.Equal(t, 1, registry.Count(StateIdle))
+	assert.Equal(t, 1, registry.Count(StateBusy))
+	assert.Equal(t, 1, registry.Count(StateUnhealthy))
+	assert.Equal(t, 0, registry.Count(StateDraining))
+}
+
+func TestRegistry_ConcurrentCheckout(t *testing.T) {
+	registry := NewRegistry()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, registry.Add(fmt.Sprintf("sprite-%d", i), nil))
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		assigned = make(map[string]string)
+		failures int
+	)
+
+	// More jobs than sprites, each sprite should be handed out exactly once
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jobUUID := fmt.Sprintf("job-%d", i)
+			s, err := registry.Checkout(jobUUID, nil)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				assert.ErrorIs(t, err, ErrNoIdleSprites)
+				failures++
+				return
+			}
+			_, dup := assigned[s.Name]
+			assert.False(t, dup, "sprite %s checked out twice", s.Name)
+			assigned[s.Name] = jobUUID
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, assigned, 10)
+	assert.Equal(t, 10, failures)
+	assert.Equal(t, 10, registry.Count(StateBusy))
+}
+
+func TestRegistry_AddToPool(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "sprite-1", map[string]string{"os": "linux"}))
+	require.NoError(t, registry.Add("sprite-2", nil))
+
+	// Names are unique across pools
+	assert.ErrorIs(t, registry.AddToPool("other", "sprite-1", nil), ErrSpriteExists)
+
+	s, ok := registry.Get("sprite-1")
+	assert.True(t, ok)
+	assert.Equal(t, "linux", s.Pool)
+
+	s, ok = registry.Get("sprite-2")
+	assert.True(t, ok)
+	assert.Empty(t, s.Pool)
+}
+
+func TestRegistry_CheckoutFrom(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.AddToPool("deploys", "deploy-1", nil))
+	require.NoError(t, registry.AddToPool("builds", "build-1", nil))
+	require.NoError(t, registry.AddToPool("builds", "build-2", nil))
+
+	s, err := registry.CheckoutFrom([]string{"builds"}, "job-1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "build-1", s.Name)
+
+	assert.Equal(t, 1, registry.CountIn([]string{"builds"}, StateIdle))
+	assert.Equal(t, 2, registry.CountIn(nil, StateIdle))
+	assert.Equal(t, 3, registry.Len())
+
+	_, err = registry.CheckoutFrom([]string{"builds"}, "job-2", nil)
+	require.NoError(t, err)
+	_, err = registry.CheckoutFrom([]string{"builds"}, "job-3", nil)
+	assert.ErrorIs(t, err, ErrNoIdleSprites)
+
+	// No pools means any pool
+	s, err = registry.CheckoutFrom(nil, "job-3", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "deploy-1", s.Name)
+}
+
+func TestRegistry_EphemeralPool(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.AddToPool("static", "static-1", map[string]string{"os": "linux"}))
+	require.NoError(t, registry.AddEphemeralPool("clean", map[string]string{"os": "linux", "clean": "true"}, 2))
+	assert.ErrorIs(t, registry.AddEphemeralPool("clean", nil, 1), ErrPoolExists)
+
+	assert.Equal(t, 3, registry.Available(nil))
+	assert.Equal(t, 3, registry.Capacity())
+
+	// Existing idle sprites are used before creating new ones
+	s, err := registry.CheckoutFrom(nil, "job-1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "static-1", s.Name)
+
+	s, err = registry.CheckoutFrom(nil, "job-2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "bk-job-job-2", s.Name)
+	assert.Equal(t, "clean", s.Pool)
+	assert.True(t, s.Ephemeral)
+	assert.Equal(t, StateBusy, s.State)
+	assert.Equal(t, "true", s.Tags["clean"])
+
+	rules, err := ParseQueryRules([]string{"clean=false"})
+	require.NoError(t, err)
+	_, err = registry.CheckoutFrom(nil, "job-3", rules)
+	assert.ErrorIs(t, err, ErrNoIdleSprites)
+
+	_, err = registry.CheckoutFrom([]string{"clean"}, "job-3", nil)
+	require.NoError(t, err)
+	_, err = registry.CheckoutFrom([]string{"clean"}, "job-4", nil)
+	assert.ErrorIs(t, err, ErrNoIdleSprites, "pool is at max_agents")
+	assert.Equal(t, 0, registry.Available(nil))
+
+	// Returning an ephemeral sprite forgets it and frees its slot
+	require.NoError(t, registry.Return("bk-job-job-2"))
+	_, ok := registry.Get("bk-job-job-2")
+	assert.False(t, ok)
+	assert.Equal(t, 1, registry.Available([]string{"clean"}))
+	assert.Equal(t, 1, registry.CountIn([]string{"clean"}, StateBusy))
+}
+
+func TestRegistry_AdoptEphemeral(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.AddEphemeralPool("clean", nil, 1))
+
+	s, err := registry.AdoptEphemeral("clean", "job-1")
+	require.NoError(t, err)
+	assert.Equal(t, "bk-job-job-1", s.Name)
+	assert.Equal(t, "job-1", s.JobUUID)
+
+	_, err = registry.AdoptEphemeral("clean", "job-1")
+	assert.ErrorIs(t, err, ErrSpriteExists)
+
+	// Adopted jobs can take the pool over its limit
+	_, err = registry.AdoptEphemeral("clean", "job-2")
+	require.NoError(t, err)
+	assert.Equal(t, 0, registry.Available(nil))
+
+	_, err = registry.AdoptEphemeral("missing", "job-3")
+	assert.ErrorIs(t, err, ErrSpriteNotFound)
+}
+
+func TestRegistry_JobsAndCreatedAt(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "sprite-1", nil))
+
+	s, _ := registry.Get("sprite-1")
+	assert.False(t, s.CreatedAt.IsZero())
+	assert.Zero(t, s.Jobs)
+
+	_, err := registry.Checkout("job-1", nil)
+	require.NoError(t, err)
+	require.NoError(t, registry.Return("sprite-1"))
+	require.NoError(t, registry.Claim("sprite-1", "job-2"))
+
+	s, _ = registry.Get("sprite-1")
+	assert.Equal(t, 2, s.Jobs)
+
+	createdAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, registry.SetCreatedAt("sprite-1", createdAt))
+	s, _ = registry.Get("sprite-1")
+	assert.Equal(t, createdAt, s.CreatedAt)
+
+	assert.ErrorIs(t, registry.SetCreatedAt("missing", createdAt), ErrSpriteNotFound)
+}
+
+func TestRegistry_Upgrade(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("sprite-1", nil))
+	require.NoError(t, registry.Add("sprite-2", nil))
+	require.NoError(t, registry.Claim("sprite-2", "job-1"))
+
+	require.NoError(t, registry.Upgrade("sprite-1"))
+	assert.ErrorIs(t, registry.Upgrade("sprite-1"), ErrSpriteBusy)
+	assert.ErrorIs(t, registry.Upgrade("sprite-2"), ErrSpriteBusy)
+	assert.ErrorIs(t, registry.Upgrade("missing"), ErrSpriteNotFound)
+
+	// Upgrading sprites aren't handed out or removed
+	_, err := registry.Checkout("job-2", nil)
+	assert.ErrorIs(t, err, ErrNoIdleSprites)
+	assert.ErrorIs(t, registry.Remove("sprite-1"), ErrSpriteBusy)
+
+	require.NoError(t, registry.SetAgentVersion("sprite-1", "3.112.0"))
+	require.NoError(t, registry.SetState("sprite-1", StateIdle))
+	s, err := registry.Checkout("job-2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "3.112.0", s.AgentVersion)
+
+	assert.ErrorIs(t, registry.SetAgentVersion("missing", "3.112.0"), ErrSpriteNotFound)
+}
+
+func TestRegistry_Recheck(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("sprite-1", nil))
+	require.NoError(t, registry.Add("sprite-2", nil))
+	require.NoError(t, registry.SetState("sprite-1", StateUnhealthy))
+	assert.Equal(t, 1, registry.Capacity())
+
+	require.NoError(t, registry.Recheck("sprite-1"))
+	assert.ErrorIs(t, registry.Recheck("sprite-1"), ErrSpriteBusy)
+	assert.ErrorIs(t, registry.Recheck("sprite-2"), ErrSpriteBusy)
+	assert.ErrorIs(t, registry.Recheck("missing"), ErrSpriteNotFound)
+
+	// Sprites being checked aren't handed out, removed or counted as capacity
+	_, err := registry.Checkout("job-1", nil)
+	require.NoError(t, err)
+	_, err = registry.Checkout("job-2", nil)
+	assert.ErrorIs(t, err, ErrNoIdleSprites)
+	assert.ErrorIs(t, registry.Remove("sprite-1"), ErrSpriteBusy)
+	assert.Equal(t, 1, registry.Capacity())
+
+	require.NoError(t, registry.SetState("sprite-1", StateIdle))
+	s, err := registry.Checkout("job-2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sprite-1", s.Name)
+}
+
+func TestRegistry_CheckoutWarm(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.AddToPool("linux", "sprite-1", map[string]string{"os": "linux"}))
+	require.NoError(t, registry.AddToPool("linux", "sprite-2", map[string]string{"os": "linux"}))
+	require.NoError(t, registry.AddToPool("linux", "sprite-3", map[string]string{"os": "linux"}))
+	require.NoError(t, registry.AddEphemeralPool("clean", nil, 1))
+
+	_, err := registry.CheckoutWarm(nil, "job-1", "pipeline-a", nil)
+	assert.ErrorIs(t, err, ErrNoIdleSprites, "no sprite has run the pipeline")
+
+	require.NoError(t, registry.RecordPipeline("sprite-2", "pipeline-a"))
+	require.NoError(t, registry.RecordPipeline("sprite-3", "pipeline-a"))
+	require.NoError(t, registry.RecordPipeline("sprite-2", "pipeline-b"))
+
+	// sprite-3 ran pipeline-a more recently than sprite-2
+	s, err := registry.CheckoutWarm(nil, "job-1", "pipeline-a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sprite-3", s.Name)
+	assert.Equal(t, StateBusy, s.State)
+	assert.Equal(t, 1, s.Jobs)
+
+	rules, err := ParseQueryRules([]string{"os=darwin"})
+	require.NoError(t, err)
+	_, err = registry.CheckoutWarm(nil, "job-2", "pipeline-a", rules)
+	assert.ErrorIs(t, err, ErrNoIdleSprites)
+
+	s, err = registry.CheckoutWarm(nil, "job-2", "pipeline-a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sprite-2", s.Name)
+
+	_, err = registry.CheckoutWarm(nil, "job-3", "pipeline-a", nil)
+	assert.ErrorIs(t, err, ErrWarmSpriteBusy)
+	_, err = registry.CheckoutWarm([]string{"clean"}, "job-3", "pipeline-a", nil)
+	assert.ErrorIs(t, err, ErrNoIdleSprites)
+}
+
+func TestRegistry_RecordPipeline(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("sprite-1", nil))
+
+	for i := range maxRecentPipelines + 2 {
+		require.NoError(t, registry.RecordPipeline("sprite-1", fmt.Sprintf("pipeline-%d", i)))
+	}
+	before, _ := registry.Get("sprite-1")
+	require.NoError(t, registry.RecordPipeline("sprite-1", "pipeline-4"))
+
+	s, _ := registry.Get("sprite-1")
+	assert.Equal(t, []string{"pipeline-4", "pipeline-6", "pipeline-5", "pipeline-3", "pipeline-2"}, s.Pipelines)
+	assert.Equal(t, "pipeline-6", before.Pipelines[0], "snapshots aren't changed by later jobs")
+
+	assert.ErrorIs(t, registry.RecordPipeline("missing", "pipeline-1"), ErrSpriteNotFound)
+}
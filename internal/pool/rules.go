@@ -0,0 +1,139 @@
+package pool
+
+import (
+	"fmt"
+	"strings"
+)
+
+// queueRuleKey is handled by the cluster queue the stack is registered
+// against, so it never needs to match a sprite tag
+const queueRuleKey = "queue"
+
+// QueryRule is a single parsed agent query rule, e.g. `os=linux` or `size!=small`
+type QueryRule struct {
+	Key     string
+	Value   string // may contain * wildcards
+	Negated bool
+}
+
+// QueryRules are the agent query rules of a job, all of which must match
+type QueryRules []QueryRule
+
+// ParseQueryRules parses the agent query rules of a job. Rules are in the
+// form `key=value` or `key!=value`, and the value may contain `*` wildcards.
+func ParseQueryRules(raw []string) (QueryRules, error) {
+	rules := make(QueryRules, 0, len(raw))
+	for _, r := range raw {
+		rule, err := parseQueryRule(r)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Key == queueRuleKey {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseQueryRule(raw string) (QueryRule, error) {
+	if key, value, ok := strings.Cut(raw, "!="); ok {
+		if key == "" {
+			return QueryRule{}, fmt.Errorf("invalid agent query rule %q: missing key", raw)
+		}
+		return QueryRule{Key: key, Value: value, Negated: true}, nil
+	}
+
+	key, value, ok := strings.Cut(raw, "=")
+	if !ok {
+		return QueryRule{}, fmt.Errorf("invalid agent query rule %q: expected key=value or key!=value", raw)
+	}
+	if key == "" {
+		return QueryRule{}, fmt.Errorf("invalid agent query rule %q: missing key", raw)
+	}
+	return QueryRule{Key: key, Value: value}, nil
+}
+
+// Match reports whether a sprite with the given tags satisfies every rule
+func (qr QueryRules) Match(tags map[string]string) bool {
+	for _, rule := range qr {
+		if !rule.Match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether the tags satisfy the rule. A negated rule matches
+// when the tag is missing or its value doesn't match.
+func (r QueryRule) Match(tags map[string]string) bool {
+	value, ok := tags[r.Key]
+	matched := ok && matchWildcard(r.Value, value)
+	if r.Negated {
+		return !matched
+	}
+	return matched
+}
+
+func (r QueryRule) String() string {
+	if r.Negated {
+		return r.Key + "!=" + r.Value
+	}
+	return r.Key + "=" + r.Value
+}
+
+// matchWildcard matches value against a pattern where `*` matches any
+// run of characters
+func matchWildcard(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(value, part)
+		if idx == -1 {
+			return false
+		}
+		value = value[idx+len(part):]
+	}
+
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
+
+// ParseTags parses sprite tags in the form `key=value`
+func ParseTags(raw []string) (map[string]string, error) {
+	tags := make(map[string]string, len(raw))
+	for _, t := range raw {
+		key, value, ok := strings.Cut(t, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid sprite tag %q: expected key=value", t)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// ParseSpriteSpec parses a sprite given on the command line, either a bare
+// name or a name followed by its tags, e.g. `bk-linux-1:os=linux,docker=true`
+func ParseSpriteSpec(spec string) (string, map[string]string, error) {
+	name, rawTags, hasTags := strings.Cut(spec, ":")
+	if name == "" {
+		return "", nil, fmt.Errorf("invalid sprite %q: missing name", spec)
+	}
+	if !hasTags || rawTags == "" {
+		return name, nil, nil
+	}
+
+	tags, err := ParseTags(strings.Split(rawTags, ","))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid sprite %q: %w", spec, err)
+	}
+	return name, tags, nil
+}
@@ -0,0 +1,206 @@
+package pool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueryRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      []string
+		expected QueryRules
+		wantErr  bool
+	}{
+		{
+			name:     "equality rule",
+			raw:      []string{"os=linux"},
+			expected: QueryRules{{Key: "os", Value: "linux"}},
+		},
+		{
+			name:     "negated rule",
+			raw:      []string{"size!=small"},
+			expected: QueryRules{{Key: "size", Value: "small", Negated: true}},
+		},
+		{
+			name:     "queue rule is dropped",
+			raw:      []string{"queue=default", "docker=true"},
+			expected: QueryRules{{Key: "docker", Value: "true"}},
+		},
+		{
+			name:     "value containing equals",
+			raw:      []string{"env=FOO=bar"},
+			expected: QueryRules{{Key: "env", Value: "FOO=bar"}},
+		},
+		{
+			name:     "empty value",
+			raw:      []string{"gpu="},
+			expected: QueryRules{{Key: "gpu", Value: ""}},
+		},
+		{
+			name:     "no rules",
+			raw:      nil,
+			expected: QueryRules{},
+		},
+		{
+			name:    "missing operator",
+			raw:     []string{"linux"},
+			wantErr: true,
+		},
+		{
+			name:    "missing key",
+			raw:     []string{"=linux"},
+			wantErr: true,
+		},
+		{
+			name:    "missing negated key",
+			raw:     []string{"!=linux"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseQueryRules(tt.raw)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, rules)
+		})
+	}
+}
+
+func TestQueryRules_Match(t *testing.T) {
+	tags := map[string]string{
+		"os":     "linux",
+		"size":   "large",
+		"docker": "true",
+		"arch":   "arm64",
+	}
+
+	tests := []struct {
+		name     string
+		rules    []string
+		expected bool
+	}{
+		{name: "no rules", rules: nil, expected: true},
+		{name: "matching rule", rules: []string{"os=linux"}, expected: true},
+		{name: "all rules match", rules: []string{"os=linux", "size=large", "docker=true"}, expected: true},
+		{name: "one rule doesn't match", rules: []string{"os=linux", "size=small"}, expected: false},
+		{name: "missing tag", rules: []string{"gpu=true"}, expected: false},
+		{name: "negated rule with different value", rules: []string{"size!=small"}, expected: true},
+		{name: "negated rule with same value", rules: []string{"size!=large"}, expected: false},
+		{name: "negated rule with missing tag", rules: []string{"gpu!=true"}, expected: true},
+		{name: "wildcard any value", rules: []string{"arch=*"}, expected: true},
+		{name: "wildcard any value on missing tag", rules: []string{"gpu=*"}, expected: false},
+		{name: "wildcard prefix", rules: []string{"arch=arm*"}, expected: true},
+		{name: "wildcard suffix", rules: []string{"arch=*64"}, expected: true},
+		{name: "wildcard middle", rules: []string{"arch=a*4"}, expected: true},
+		{name: "wildcard no match", rules: []string{"arch=amd*"}, expected: false},
+		{name: "negated wildcard", rules: []string{"arch!=amd*"}, expected: true},
+		{name: "queue rule ignored", rules: []string{"queue=deploys"}, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseQueryRules(tt.rules)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, rules.Match(tags))
+		})
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		value    string
+		expected bool
+	}{
+		{pattern: "linux", value: "linux", expected: true},
+		{pattern: "linux", value: "linux2", expected: false},
+		{pattern: "*", value: "", expected: true},
+		{pattern: "*", value: "anything", expected: true},
+		{pattern: "a*a", value: "a", expected: false},
+		{pattern: "a*a", value: "aa", expected: true},
+		{pattern: "a*b*c", value: "axxbyyc", expected: true},
+		{pattern: "a*b*c", value: "axxcyyb", expected: false},
+		{pattern: "**", value: "x", expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.expected, matchWildcard(tt.pattern, tt.value))
+		})
+	}
+}
+
+func TestRegistry_CheckoutMatchesTags(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Add("linux", map[string]string{"os": "linux"}))
+	require.NoError(t, registry.Add("darwin", map[string]string{"os": "darwin"}))
+
+	rules, err := ParseQueryRules([]string{"os=darwin"})
+	require.NoError(t, err)
+
+	s, err := registry.Checkout("job-1", rules)
+	require.NoError(t, err)
+	assert.Equal(t, "darwin", s.Name)
+
+	// The only darwin sprite is busy now
+	_, err = registry.Checkout("job-2", rules)
+	assert.ErrorIs(t, err, ErrNoIdleSprites)
+}
+
+func TestParseSpriteSpec(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         string
+		expectedName string
+		expectedTags map[string]string
+		wantErr      bool
+	}{
+		{
+			name:         "bare name",
+			spec:         "bk-test-1",
+			expectedName: "bk-test-1",
+		},
+		{
+			name:         "name with tags",
+			spec:         "bk-linux-1:os=linux,docker=true",
+			expectedName: "bk-linux-1",
+			expectedTags: map[string]string{"os": "linux", "docker": "true"},
+		},
+		{
+			name:         "trailing colon",
+			spec:         "bk-test-1:",
+			expectedName: "bk-test-1",
+		},
+		{
+			name:    "missing name",
+			spec:    ":os=linux",
+			wantErr: true,
+		},
+		{
+			name:    "invalid tag",
+			spec:    "bk-test-1:linux",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, tags, err := ParseSpriteSpec(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedName, name)
+			assert.Equal(t, tt.expectedTags, tags)
+		})
+	}
+}
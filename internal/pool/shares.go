@@ -0,0 +1,122 @@
+package pool
+
+import (
+	"sort"
+	"sync"
+)
+
+// Shares divides the controller's capacity between the queues it serves.
+// Each queue reports its demand, the jobs it is running plus the jobs it has
+// waiting, and is allowed a share of the capacity in proportion to its
+// weight. Capacity a queue doesn't need is lent to the others, so a busy
+// queue can use every sprite while the rest are quiet. It is safe for
+// concurrent use.
+type Shares struct {
+	mu       sync.Mutex
+	registry *Registry
+	limit    int // 0 means the capacity of the registry
+	weights  map[string]int
+	demand   map[string]int
+}
+
+// NewShares returns Shares dividing up to limit concurrent jobs, or every
+// usable sprite in registry if limit is 0
+func NewShares(registry *Registry, limit int) *Shares {
+	return &Shares{
+		registry: registry,
+		limit:    limit,
+		weights:  make(map[string]int),
+		demand:   make(map[string]int),
+	}
+}
+
+// SetWeight sets the relative share of capacity a queue is entitled to.
+// Weights below 1 are treated as 1.
+func (s *Shares) SetWeight(queue string, weight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.weights[queue] = max(weight, 1)
+}
+
+// SetDemand records how many jobs a queue could be running right now
+func (s *Shares) SetDemand(queue string, demand int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.demand[queue] = max(demand, 0)
+}
+
+// Limit returns how many jobs the queue may be running at once given the
+// current demand of every queue
+func (s *Shares) Limit(queue string) int {
+	total := s.limit
+	if total == 0 {
+		total = s.registry.Capacity()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allocate(total)[queue]
+}
+
+// allocate splits total between the queues by weighted max-min fairness.
+// Queues that need less than their share get what they need and the rest
+// is divided again between the others.
+func (s *Shares) allocate(total int) map[string]int {
+	alloc := make(map[string]int, len(s.weights))
+
+	active := make([]string, 0, len(s.weights))
+	for queue := range s.weights {
+		active = append(active, queue)
+	}
+	// Heaviest first, so rounding leftovers go to the queues with the biggest share
+	sort.Slice(active, func(i, j int) bool {
+		wi, wj := s.weights[active[i]], s.weights[active[j]]
+		if wi != wj {
+			return wi > wj
+		}
+		return active[i] < active[j]
+	})
+
+	remaining := total
+	for remaining > 0 && len(active) > 0 {
+		weightSum := 0
+		for _, queue := range active {
+			weightSum += s.weights[queue]
+		}
+
+		// Satisfy every queue whose outstanding demand fits in its share
+		var unsatisfied []string
+		for _, queue := range active {
+			share := remaining * s.weights[queue] / weightSum
+			if need := s.demand[queue] - alloc[queue]; need <= share {
+				alloc[queue] += need
+				continue
+			}
+			unsatisfied = append(unsatisfied, queue)
+		}
+		used := 0
+		for queue := range alloc {
+			used += alloc[queue]
+		}
+
+		if len(unsatisfied) == len(active) {
+			// Nobody could be satisfied, hand out the shares and give
+			// what's left after rounding to the heaviest queues
+			given := 0
+			for _, queue := range active {
+				share := remaining * s.weights[queue] / weightSum
+				alloc[queue] += share
+				given += share
+			}
+			for i := 0; given < remaining; i = (i + 1) % len(active) {
+				alloc[active[i]]++
+				given++
+			}
+			break
+		}
+
+		remaining = total - used
+		active = unsatisfied
+	}
+	return alloc
+}
@@ -0,0 +1,92 @@
+package pool
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShares_Limit(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int
+		weights map[string]int
+		demand  map[string]int
+		want    map[string]int
+	}{
+		{
+			name:    "split by weight when every queue is busy",
+			total:   10,
+			weights: map[string]int{"builds": 3, "deploys": 1, "nightly": 1},
+			demand:  map[string]int{"builds": 20, "deploys": 20, "nightly": 20},
+			want:    map[string]int{"builds": 6, "deploys": 2, "nightly": 2},
+		},
+		{
+			name:    "idle queues lend their share",
+			total:   10,
+			weights: map[string]int{"builds": 1, "deploys": 1},
+			demand:  map[string]int{"builds": 20, "deploys": 0},
+			want:    map[string]int{"builds": 10, "deploys": 0},
+		},
+		{
+			name:    "unused share is divided between the rest",
+			total:   10,
+			weights: map[string]int{"builds": 1, "deploys": 1, "nightly": 2},
+			demand:  map[string]int{"builds": 1, "deploys": 20, "nightly": 20},
+			want:    map[string]int{"builds": 1, "deploys": 3, "nightly": 6},
+		},
+		{
+			name:    "everyone fits",
+			total:   10,
+			weights: map[string]int{"builds": 1, "deploys": 1},
+			demand:  map[string]int{"builds": 2, "deploys": 3},
+			want:    map[string]int{"builds": 2, "deploys": 3},
+		},
+		{
+			name:    "rounding leftovers go to the heaviest queue",
+			total:   3,
+			weights: map[string]int{"builds": 2, "deploys": 1, "nightly": 1},
+			demand:  map[string]int{"builds": 5, "deploys": 5, "nightly": 5},
+			want:    map[string]int{"builds": 2, "deploys": 1, "nightly": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares := NewShares(NewRegistry(), tt.total)
+			for queue, weight := range tt.weights {
+				shares.SetWeight(queue, weight)
+				shares.SetDemand(queue, tt.demand[queue])
+			}
+
+			got := make(map[string]int)
+			sum := 0
+			for queue := range tt.weights {
+				got[queue] = shares.Limit(queue)
+				sum += got[queue]
+			}
+			assert.Equal(t, tt.want, got)
+			assert.LessOrEqual(t, sum, tt.total)
+		})
+	}
+}
+
+func TestShares_RegistrySize(t *testing.T) {
+	registry := NewRegistry()
+	for i := 0; i < 4; i++ {
+		require.NoError(t, registry.Add(fmt.Sprintf("sprite-%d", i), nil))
+	}
+	require.NoError(t, registry.SetState("sprite-3", StateUnhealthy))
+
+	shares := NewShares(registry, 0)
+	shares.SetWeight("builds", 1)
+	shares.SetDemand("builds", 10)
+
+	// Unhealthy sprites can't run jobs so they don't count
+	assert.Equal(t, 3, shares.Limit("builds"))
+
+	// Unknown queues get nothing
+	assert.Equal(t, 0, shares.Limit("missing"))
+}
@@ -0,0 +1,67 @@
+package sprites
+
+import (
+	"context"
+	"time"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+)
+
+// Backend runs jobs' agents on Fly.io Sprites, the workers are sprites
+type Backend struct {
+	Handler     *SpriteHandler
+	RetryPolicy *RetryPolicy // DefaultRetryPolicy if unset
+}
+
+var _ backend.Backend = (*Backend)(nil)
+
+// NewBackend returns a Backend that authenticates to the Sprites API with token
+func NewBackend(token string) *Backend {
+	return &Backend{Handler: NewSpriteHandlerWithToken(token)}
+}
+
+// agentSprite returns the AgentSprite for the named sprite
+func (b *Backend) agentSprite(name string) *AgentSprite {
+	spr := b.Handler.NewAgentSprite(name)
+	spr.RetryPolicy = b.RetryPolicy
+	return spr
+}
+
+func (b *Backend) Provision(ctx context.Context, worker string, script []byte, env []string) error {
+	spr, err := b.Handler.CreateAgentSprite(ctx, worker)
+	if err == nil {
+		err = spr.Provision(ctx, script, env)
+	}
+	if err != nil {
+		return &backend.RunError{Category: Categorize(err, nil), ExitCode: ExitCode(err), Err: err}
+	}
+	return nil
+}
+
+func (b *Backend) CheckHealth(ctx context.Context, worker string) error {
+	return b.agentSprite(worker).CheckHealth(ctx)
+}
+
+func (b *Backend) RunJob(job backend.Job, deadline time.Time) error {
+	return b.agentSprite(job.Worker).RunJob(job, deadline)
+}
+
+func (b *Backend) FindJob(ctx context.Context, worker string, jobUUID string) (string, error) {
+	session, err := b.agentSprite(worker).FindJobSession(ctx, jobUUID)
+	if err != nil || session == nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+func (b *Backend) AttachJob(ctx context.Context, job backend.Job, session string) error {
+	return b.agentSprite(job.Worker).AttachJob(ctx, job, session)
+}
+
+func (b *Backend) RestoreCheckpoint(ctx context.Context, worker string, name string) error {
+	return b.agentSprite(worker).RestoreCheckpoint(ctx, name)
+}
+
+func (b *Backend) Destroy(ctx context.Context, worker string) error {
+	return b.agentSprite(worker).Destroy(ctx)
+}
@@ -0,0 +1,99 @@
+package sprites
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	sprites "github.com/superfly/sprites-go"
+)
+
+const checkpointTimeout = 10 * time.Minute
+
+// ErrCheckpointNotFound is returned when the sprite has no checkpoint with the requested name
+var ErrCheckpointNotFound = errors.New("checkpoint not found")
+
+// CreateCheckpoint records a checkpoint of the sprite named by its comment,
+// e.g. a golden checkpoint taken right after provisioning
+func (a *AgentSprite) CreateCheckpoint(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, checkpointTimeout)
+	defer cancel()
+
+	stream, err := a.Client.CreateCheckpointWithComment(ctx, a.Name, name)
+	if err != nil {
+		return fmt.Errorf("creating checkpoint %s: %w", name, err)
+	}
+	if err := stream.ProcessAll(a.checkpointMessage("checkpoint")); err != nil {
+		return fmt.Errorf("creating checkpoint %s: %w", name, err)
+	}
+	return nil
+}
+
+// RestoreCheckpoint restores the sprite to the newest checkpoint named name
+func (a *AgentSprite) RestoreCheckpoint(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, checkpointTimeout)
+	defer cancel()
+
+	checkpoint, err := a.findCheckpoint(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	stream, err := a.Client.RestoreCheckpoint(ctx, a.Name, checkpoint.ID)
+	if err != nil {
+		return fmt.Errorf("restoring checkpoint %s (%s): %w", name, checkpoint.ID, err)
+	}
+	if err := stream.ProcessAll(a.checkpointMessage("restore")); err != nil {
+		return fmt.Errorf("restoring checkpoint %s (%s): %w", name, checkpoint.ID, err)
+	}
+	return nil
+}
+
+// CheckCheckpoint returns ErrCheckpointNotFound if the sprite has no
+// checkpoint named name to restore
+func (a *AgentSprite) CheckCheckpoint(ctx context.Context, name string) error {
+	_, err := a.findCheckpoint(ctx, name)
+	return err
+}
+
+// findCheckpoint returns the newest checkpoint named name
+func (a *AgentSprite) findCheckpoint(ctx context.Context, name string) (*sprites.Checkpoint, error) {
+	checkpoints, err := a.Client.ListCheckpoints(ctx, a.Name, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing checkpoints: %w", err)
+	}
+	checkpoint := newestCheckpoint(checkpoints, name)
+	if checkpoint == nil {
+		return nil, fmt.Errorf("%w: %s on sprite %s", ErrCheckpointNotFound, name, a.Name)
+	}
+	return checkpoint, nil
+}
+
+// checkpointMessage logs the progress of a checkpoint or restore and turns
+// error messages in the stream into an error
+func (a *AgentSprite) checkpointMessage(component string) func(*sprites.StreamMessage) error {
+	logger := log.With("component", component, "sprite", a.Name)
+	return func(msg *sprites.StreamMessage) error {
+		if msg.Type == "error" {
+			if msg.Error != "" {
+				return errors.New(msg.Error)
+			}
+			return errors.New(msg.Data)
+		}
+		logger.Debug(msg.Data, "type", msg.Type)
+		return nil
+	}
+}
+
+// newestCheckpoint returns the most recent checkpoint whose comment is name
+func newestCheckpoint(checkpoints []*sprites.Checkpoint, name string) *sprites.Checkpoint {
+	var newest *sprites.Checkpoint
+	for _, c := range checkpoints {
+		if c.Comment == name && (newest == nil || c.CreateTime.After(newest.CreateTime)) {
+			newest = c
+		}
+	}
+	return newest
+}
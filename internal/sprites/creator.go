@@ -2,11 +2,13 @@ package sprites
 
 import (
 	"context"
-)
+	"errors"
+	"net/http"
 
-func (s *SpriteHandler) CreateAgentSprite(name string) (*AgentSprite, error) {
-	ctx := context.Background()
+	sprites "github.com/superfly/sprites-go"
+)
 
+func (s *SpriteHandler) CreateAgentSprite(ctx context.Context, name string) (*AgentSprite, error) {
 	r, err := s.Client.CreateSprite(ctx, name, nil)
 	if err != nil {
 		return nil, err
@@ -15,7 +17,20 @@ func (s *SpriteHandler) CreateAgentSprite(name string) (*AgentSprite, error) {
 	as := AgentSprite{
 		Name:    r.Name(),
 		Address: r.URL,
+		Client:  s.Client,
 	}
 
 	return &as, nil
 }
+
+// Destroy deletes the sprite. A sprite that doesn't exist is already gone,
+// so that isn't an error.
+func (a *AgentSprite) Destroy(ctx context.Context) error {
+	err := a.Client.DeleteSprite(ctx, a.Name)
+
+	var apiErr *sprites.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package sprites
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	sprites "github.com/superfly/sprites-go"
+)
+
+// stderrTailLines is how many of the agent's last stderr lines are kept
+// to explain a failure
+const stderrTailLines = 20
+
+// Categorize says what went wrong for an error returned while running a
+// sprite command. An agent that exited with an error is assumed to have
+// acquired its job unless acquired says otherwise.
+func Categorize(err error, acquired func() bool) backend.Category {
+	var (
+		exitErr  *sprites.ExitError
+		apiErr   *sprites.APIError
+		closeErr *websocket.CloseError
+		netErr   net.Error
+		startErr *StartError
+	)
+
+	switch {
+	case errors.Is(err, backend.ErrJobTimeout), errors.Is(err, backend.ErrAcquireTimeout), errors.Is(err, backend.ErrDispatchDeadline):
+		return backend.CategoryTimeout
+	case errors.As(err, &exitErr):
+		// The shell's statuses for a command that isn't there or can't be run
+		if exitErr.Code == 126 || exitErr.Code == 127 {
+			return backend.CategoryAgentMissing
+		}
+		if acquired != nil && !acquired() {
+			return backend.CategoryAcquireRejected
+		}
+		return backend.CategoryAgentFailed
+	case errors.As(err, &apiErr), errors.As(err, &closeErr), errors.As(err, &netErr), errors.As(err, &startErr),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return backend.CategorySpriteUnreachable
+	default:
+		return backend.CategoryAgentFailed
+	}
+}
+
+// ExitCode returns the exit status of the command that failed with err, or
+// -1 if it didn't exit
+func ExitCode(err error) int {
+	var exitErr *sprites.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return -1
+}
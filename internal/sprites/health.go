@@ -0,0 +1,91 @@
+package sprites
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeremybumsted/bksprites/internal/backend"
+)
+
+const (
+	healthCheckTimeout = 30 * time.Second
+
+	// minFreeDisk is the least free space in the sprite's home directory
+	// a job is started with
+	minFreeDisk = 1 << 30
+)
+
+// unhealthyStatuses are the sprite statuses that can't run a job. Stopped
+// sprites are fine, they start when a command is run on them.
+var unhealthyStatuses = []string{"error", "failed", "destroying", "destroyed"}
+
+// CheckHealth is a quick check that the sprite can run a job: it isn't in
+// an error state, the agent runs, and there's disk space free for the
+// build. The error says which check failed, or is a *backend.RunError if
+// the sprite couldn't be reached to check it.
+func (a *AgentSprite) CheckHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	if err := a.checkHealth(ctx); err != nil {
+		// The API or the sprite not answering isn't the sprite failing a check
+		if Categorize(err, nil) == backend.CategorySpriteUnreachable || errors.Is(err, context.DeadlineExceeded) {
+			return &backend.RunError{Category: backend.CategorySpriteUnreachable, ExitCode: -1, Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *AgentSprite) checkHealth(ctx context.Context) error {
+
+	info, err := a.Client.GetSprite(ctx, a.Name)
+	if err != nil {
+		return fmt.Errorf("getting sprite status: %w", err)
+	}
+	if slices.Contains(unhealthyStatuses, info.Status) {
+		return fmt.Errorf("sprite status is %s", info.Status)
+	}
+
+	if _, err := a.AgentVersion(ctx); err != nil {
+		return err
+	}
+
+	out, err := a.Client.Sprite(a.Name).CommandContext(ctx, "df", "-Pk", ".").Output()
+	if err != nil {
+		return fmt.Errorf("checking free disk: %w", err)
+	}
+	free, err := parseFreeDisk(string(out))
+	if err != nil {
+		return err
+	}
+	if free < minFreeDisk {
+		return fmt.Errorf("only %d MiB of disk free, need %d MiB", free>>20, minFreeDisk>>20)
+	}
+	return nil
+}
+
+// parseFreeDisk returns the bytes available from `df -Pk` output, e.g.
+//
+//	Filesystem     1024-blocks    Used Available Capacity Mounted on
+//	/dev/vdb          98304000 1234567  97069433       2% /home/sprite
+func parseFreeDisk(out string) (int64, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected df output: %q", strings.TrimSpace(out))
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output: %q", strings.TrimSpace(out))
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output: %q", strings.TrimSpace(out))
+	}
+	return kb << 10, nil
+}
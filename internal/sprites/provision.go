@@ -0,0 +1,131 @@
+package sprites
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	logwriter "github.com/jeremybumsted/bksprites/internal/log"
+)
+
+const (
+	agentBinaryPath        = backend.AgentBinaryPath
+	provisionScriptPath    = "/tmp/bksprites-provision.sh"
+	installAgentScriptPath = "/tmp/bksprites-install-agent.sh"
+	provisionTimeout       = 15 * time.Minute
+	agentVersionTimeout    = 30 * time.Second
+	agentInstallTimeout    = 5 * time.Minute
+)
+
+var agentVersionPattern = regexp.MustCompile(`version (\d+\.\d+\.\d+[^\s,]*)`)
+
+// Provision uploads the provision script to the sprite and runs it with
+// the given environment, e.g. BUILDKITE_SPRITE_AGENT_TOKEN=... The agent
+// install script is uploaded alongside it for the script to pin the agent.
+func (a *AgentSprite) Provision(ctx context.Context, script []byte, env []string) error {
+	ctx, cancel := context.WithTimeout(ctx, provisionTimeout)
+	defer cancel()
+
+	sprite := a.Client.Sprite(a.Name)
+
+	if err := sprite.Filesystem().WriteFileContext(ctx, provisionScriptPath, script, 0o755); err != nil {
+		return fmt.Errorf("uploading provision script: %w", err)
+	}
+	if err := sprite.Filesystem().WriteFileContext(ctx, installAgentScriptPath, []byte(backend.InstallAgentScript), 0o755); err != nil {
+		return fmt.Errorf("uploading agent install script: %w", err)
+	}
+
+	provisionLogger := log.With(
+		"component", "provision",
+		"sprite", a.Name,
+	)
+	stdoutWriter := logwriter.NewLogWriter(provisionLogger, log.InfoLevel)
+	stderrWriter := logwriter.NewLogWriter(provisionLogger, log.WarnLevel)
+
+	cmd := sprite.CommandContext(ctx, "bash", provisionScriptPath)
+	cmd.Env = append(slices.Clip(env), backend.InstallAgentEnv+"="+installAgentScriptPath)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	err := cmd.Run()
+
+	stdoutWriter.Flush()
+	stderrWriter.Flush()
+
+	if err != nil {
+		return fmt.Errorf("running provision script: %w", err)
+	}
+	return nil
+}
+
+// AgentVersion returns the version of the buildkite-agent installed on the sprite
+func (a *AgentSprite) AgentVersion(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, agentVersionTimeout)
+	defer cancel()
+
+	sprite := a.Client.Sprite(a.Name)
+
+	if err := sprite.CommandContext(ctx, "test", "-x", agentBinaryPath).Run(); err != nil {
+		return "", fmt.Errorf("buildkite-agent not found at %s: %w", agentBinaryPath, err)
+	}
+
+	out, err := sprite.CommandContext(ctx, agentBinaryPath, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("running buildkite-agent --version: %w", err)
+	}
+
+	return parseAgentVersion(string(out))
+}
+
+// InstallAgent replaces the sprite's buildkite-agent with the given release,
+// upgrading or downgrading it, and checks the new version is the one running
+func (a *AgentSprite) InstallAgent(ctx context.Context, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, agentInstallTimeout)
+	defer cancel()
+
+	installLogger := log.With(
+		"component", "agent-install",
+		"sprite", a.Name,
+	)
+	stderrWriter := logwriter.NewLogWriter(installLogger, log.WarnLevel)
+
+	cmd := a.Client.Sprite(a.Name).CommandContext(ctx, "bash", "-c", backend.InstallAgentScript)
+	cmd.Env = []string{"BUILDKITE_AGENT_VERSION=" + version}
+	cmd.Stderr = stderrWriter
+
+	err := cmd.Run()
+	stderrWriter.Flush()
+	if err != nil {
+		return fmt.Errorf("installing buildkite-agent %s: %w", version, err)
+	}
+
+	installed, err := a.AgentVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if !SameAgentVersion(installed, version) {
+		return fmt.Errorf("installed buildkite-agent %s but %s is running", version, installed)
+	}
+	return nil
+}
+
+// SameAgentVersion reports whether two agent versions are the same,
+// ignoring a leading v
+func SameAgentVersion(a, b string) bool {
+	return strings.TrimPrefix(a, "v") == strings.TrimPrefix(b, "v")
+}
+
+// parseAgentVersion pulls the version number out of `buildkite-agent --version`
+// output, e.g. "buildkite-agent version 3.87.1, build 10003"
+func parseAgentVersion(out string) (string, error) {
+	m := agentVersionPattern.FindStringSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("unexpected buildkite-agent version output: %q", strings.TrimSpace(out))
+	}
+	return m[1], nil
+}
@@ -0,0 +1,129 @@
+package sprites
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	sprites "github.com/superfly/sprites-go"
+)
+
+// RetryPolicy decides whether a failed sprite command is tried again, and
+// how long to wait first. Errors are classified by type, never by message.
+type RetryPolicy struct {
+	MaxAttempts int           // attempts including the first, 1 never retries
+	BaseDelay   time.Duration // wait before the first retry, doubled for each one after
+	MaxDelay    time.Duration // longest wait between attempts, before jitter
+	Jitter      float64       // fraction of the wait randomly added or taken away, e.g. 0.2
+}
+
+// DefaultRetryPolicy is used by sprites that aren't given a policy
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   2 * time.Second,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// StartError is returned when a sprite command couldn't be started, so
+// nothing ran on the sprite
+type StartError struct {
+	Err error
+}
+
+func (e *StartError) Error() string { return fmt.Sprintf("starting command: %v", e.Err) }
+
+func (e *StartError) Unwrap() error { return e.Err }
+
+// retryableCloseCodes are the websocket close codes sent when the sprite or
+// the proxy in front of it went away, rather than the command ending
+var retryableCloseCodes = []int{
+	websocket.CloseGoingAway,
+	websocket.CloseAbnormalClosure,
+	websocket.CloseInternalServerErr,
+	websocket.CloseServiceRestart,
+	websocket.CloseTryAgainLater,
+	1014, // bad gateway
+}
+
+// Classify reports whether err is worth another attempt, and why
+func (p RetryPolicy) Classify(err error) (retry bool, reason string) {
+	var (
+		exitErr  *sprites.ExitError
+		apiErr   *sprites.APIError
+		closeErr *websocket.CloseError
+		netErr   net.Error
+		startErr *StartError
+	)
+
+	switch {
+	case err == nil:
+		return false, "succeeded"
+	case errors.Is(err, backend.ErrJobCanceled):
+		return false, "the job was cancelled"
+	case errors.Is(err, backend.ErrAcquireTimeout):
+		return false, "the agent didn't acquire the job in time"
+	case errors.Is(err, backend.ErrJobTimeout):
+		// Stopped on purpose, trying again would run the job twice
+		return false, "the job ran past its timeout"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false, "cancelled or timed out"
+	case errors.As(err, &exitErr):
+		// The agent ran, trying again would run the job twice
+		return false, fmt.Sprintf("command exited with status %d", exitErr.Code)
+	case errors.As(err, &apiErr):
+		switch code := apiErr.StatusCode; {
+		case code == http.StatusTooManyRequests:
+			return true, "rate limited by the Sprites API"
+		case code >= 500:
+			return true, fmt.Sprintf("Sprites API returned %d", code)
+		default:
+			return false, fmt.Sprintf("Sprites API returned %d", code)
+		}
+	case errors.As(err, &closeErr):
+		if slices.Contains(retryableCloseCodes, closeErr.Code) {
+			return true, fmt.Sprintf("connection closed with code %d", closeErr.Code)
+		}
+		return false, fmt.Sprintf("connection closed with code %d", closeErr.Code)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true, "network timeout"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, io.ErrUnexpectedEOF):
+		return true, "connection lost"
+	case errors.As(err, &startErr):
+		// The Sprites client doesn't keep the type of every connection
+		// error, but nothing ran so it's safe to try again
+		return true, "command didn't start"
+	default:
+		return false, "not a retryable error"
+	}
+}
+
+// Delay returns how long to wait after the given attempt failed with err.
+// It backs off exponentially up to MaxDelay, and waits at least as long as
+// the Sprites API asked when rate limiting.
+func (p RetryPolicy) Delay(attempt int, err error) time.Duration {
+	delay := p.MaxDelay
+	if attempt < 32 {
+		delay = min(p.BaseDelay*time.Duration(1<<(attempt-1)), p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(p.Jitter * float64(delay) * (2*rand.Float64() - 1))
+	}
+
+	var apiErr *sprites.APIError
+	if errors.As(err, &apiErr) {
+		delay = max(delay, time.Duration(apiErr.GetRetryAfterSeconds())*time.Second)
+	}
+	return delay
+}
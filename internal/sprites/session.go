@@ -0,0 +1,86 @@
+package sprites
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/jeremybumsted/bksprites/internal/backend"
+	logwriter "github.com/jeremybumsted/bksprites/internal/log"
+	sprites "github.com/superfly/sprites-go"
+)
+
+// FindJobSession returns the exec session running the agent for jobUUID,
+// or nil if the sprite has no such session
+func (a *AgentSprite) FindJobSession(ctx context.Context, jobUUID string) (*sprites.Session, error) {
+	sessions, err := a.Client.ListSessions(ctx, a.Name)
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions on sprite %s: %w", a.Name, err)
+	}
+
+	for _, session := range sessions {
+		if strings.Contains(session.Command, agentBinaryPath) && strings.Contains(session.Command, jobUUID) {
+			return session, nil
+		}
+	}
+	return nil, nil
+}
+
+// AttachJob attaches to a running agent session, e.g. one started by a
+// previous controller process, and streams its output until it exits. The
+// job's timeouts are watched from when it's attached. Failures are a
+// *backend.RunError, as from RunJob.
+func (a *AgentSprite) AttachJob(ctx context.Context, job backend.Job, sessionID string) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	sprite := a.Client.Sprite(a.Name)
+	cmd := sprite.AttachSessionContext(ctx, sessionID)
+
+	agentLogger := log.With(
+		"component", "buildkite-agent",
+		"jobUUID", job.UUID,
+		"sprite", a.Name,
+		"session", sessionID,
+	)
+
+	stdoutWriter := logwriter.NewLogWriter(agentLogger, log.DebugLevel)
+	stderrWriter := logwriter.NewLogWriter(agentLogger, log.WarnLevel, logwriter.WithTail(stderrTailLines))
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	started := false
+	err := cmd.Start()
+	if err != nil {
+		err = &StartError{Err: err}
+	} else {
+		started = true
+		job.Handle.Attach(cmd, cancel, agentLogger)
+		stop := job.WatchTimeouts(ctx, cancel)
+		err = cmd.Wait()
+		stop()
+		job.Handle.Detach()
+		if cause := context.Cause(ctx); err != nil && cause != nil {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+	}
+
+	stdoutWriter.Flush()
+	stderrWriter.Flush()
+
+	if err != nil && job.Handle.Canceled() && !errors.Is(err, backend.ErrJobCanceled) {
+		err = fmt.Errorf("%w: %w", backend.ErrJobCanceled, err)
+	}
+	if err == nil {
+		return nil
+	}
+	return &backend.RunError{
+		Category: Categorize(err, func() bool { return started && job.CheckAcquired() }),
+		ExitCode: ExitCode(err),
+		Stderr:   stderrWriter.Tail(),
+		Attempts: []backend.Attempt{{Number: 1, Err: err, Reason: "agents that were already running aren't run again"}},
+		Err:      fmt.Errorf("attached agent session %s exited: %w", sessionID, err),
+	}
+}
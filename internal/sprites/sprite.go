@@ -6,22 +6,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/jeremybumsted/bksprites/internal/backend"
 	logwriter "github.com/jeremybumsted/bksprites/internal/log"
+	"github.com/jeremybumsted/bksprites/internal/metrics"
 	sprites "github.com/superfly/sprites-go"
 )
 
-const (
-	spriteCommandTimeout = 5 * time.Minute
-	spriteRunMaxAttempts = 3
-	spriteRetryDelay     = 2 * time.Second
-)
-
 type SpriteHandler struct {
 	Client *sprites.Client
 }
@@ -30,6 +24,8 @@ type AgentSprite struct {
 	Name    string          // This is the name of the sprite the agent will be run on.
 	Address string          // This is the ip address of the sprite
 	Client  *sprites.Client // Sprites client for API calls
+
+	RetryPolicy *RetryPolicy // DefaultRetryPolicy if unset
 	// command sprites.Command  <- Don't know if this is useful yet.
 }
 
@@ -67,68 +63,153 @@ func (s *SpriteHandler) NewAgentSprite(name string) *AgentSprite {
 	}
 }
 
-func (a *AgentSprite) RunJob(jobUUID string) error {
-	log.Info("We'll run this job", "uuid", jobUUID)
+// RunJob runs the job's agent on the sprite, retrying as the RetryPolicy
+// allows. It gives up with ErrDispatchDeadline rather than starting an
+// attempt after deadline, a zero deadline never passes.
+func (a *AgentSprite) RunJob(job backend.Job, deadline time.Time) error {
+	log.Info("We'll run this job", "uuid", job.UUID)
 
 	sprite := a.Client.Sprite(a.Name)
 
 	var err error
-	for attempt := 1; attempt <= spriteRunMaxAttempts; attempt++ {
-		ctx, cancel := context.WithTimeout(context.Background(), spriteCommandTimeout)
-		cmd := sprite.CommandContext(ctx, ".buildkite-agent/bin/buildkite-agent", "start", "--acquire-job", jobUUID, "--name", "bk-sprites-"+jobUUID)
+	dispatched := false
+	defer func() {
+		if err != nil && !errors.Is(err, backend.ErrDispatchDeadline) && !errors.Is(err, backend.ErrJobCanceled) {
+			metrics.JobsDispatchFailed.Inc()
+		}
+	}()
+
+	policy := DefaultRetryPolicy()
+	if a.RetryPolicy != nil {
+		policy = *a.RetryPolicy
+	}
+	var attempts []backend.Attempt
+
+	for attempt := 1; ; attempt++ {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			err = withAttempts(fmt.Errorf("%w before the agent could be started", backend.ErrDispatchDeadline), attempts)
+			return err
+		}
+		if job.Handle.Canceled() {
+			err = withAttempts(fmt.Errorf("%w before the agent could be started", backend.ErrJobCanceled), attempts)
+			return err
+		}
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cmd := sprite.CommandContext(ctx, agentBinaryPath, job.AgentStartArgs()...)
 
 		// Create sub-logger with context
 		agentLogger := log.With(
 			"component", "buildkite-agent",
-			"jobUUID", jobUUID,
+			"jobUUID", job.UUID,
 			"sprite", a.Name,
 		)
 
 		// Redirect output to structured logging
 		stdoutWriter := logwriter.NewLogWriter(agentLogger, log.DebugLevel)
-		stderrWriter := logwriter.NewLogWriter(agentLogger, log.WarnLevel)
+		stderrWriter := logwriter.NewLogWriter(agentLogger, log.WarnLevel, logwriter.WithTail(stderrTailLines))
 		cmd.Stdout = stdoutWriter
 		cmd.Stderr = stderrWriter
 
-		err = cmd.Run()
+		started := false
+		err = cmd.Start()
+		if err != nil {
+			err = &StartError{Err: err}
+		} else {
+			started = true
+			if !dispatched {
+				dispatched = true
+				metrics.JobsDispatched.Inc()
+				job.MarkStarted()
+			}
+			job.Handle.Attach(cmd, cancel, agentLogger)
+			stop := job.WatchTimeouts(ctx, cancel)
+			err = cmd.Wait()
+			stop()
+			job.Handle.Detach()
+			if cause := context.Cause(ctx); err != nil && cause != nil {
+				err = fmt.Errorf("%w: %w", cause, err)
+			}
+			if err != nil && job.Handle.Canceled() && !errors.Is(err, backend.ErrJobCanceled) {
+				err = fmt.Errorf("%w: %w", backend.ErrJobCanceled, err)
+			}
+		}
 
 		// Flush any remaining output
 		stdoutWriter.Flush()
 		stderrWriter.Flush()
 
-		cancel()
+		cancel(nil)
+
+		retry, reason := policy.Classify(err)
+		if retry && started && job.CheckAcquired() {
+			retry, reason = false, "the agent acquired the job, so it isn't run again"
+		}
+		record := backend.Attempt{Number: attempt, Err: err, Retry: retry, Reason: reason}
+		if retry && attempt < policy.MaxAttempts {
+			record.Delay = policy.Delay(attempt, err)
+		}
+		attempts = append(attempts, record)
+		metrics.SpriteRunAttempts.WithLabelValues(attemptOutcome(record, policy)).Inc()
 
 		if err == nil {
 			return nil
 		}
 
-		if !isRetryableRunError(err) || attempt == spriteRunMaxAttempts {
-			return fmt.Errorf("failed to start sprite command after %d attempt(s): %w", attempt, err)
+		if !retry || attempt >= policy.MaxAttempts {
+			log.Warn("Sprite run attempt failed, giving up",
+				"sprite", a.Name,
+				"jobUUID", job.UUID,
+				"attempt", attempt,
+				"maxAttempts", policy.MaxAttempts,
+				"reason", reason,
+				"error", err,
+			)
+			err = &backend.RunError{
+				Category: Categorize(err, func() bool { return started && job.CheckAcquired() }),
+				ExitCode: ExitCode(err),
+				Stderr:   stderrWriter.Tail(),
+				Attempts: attempts,
+				Err:      fmt.Errorf("failed to start sprite command after %d attempt(s): %w", attempt, err),
+			}
+			return err
+		}
+
+		if !deadline.IsZero() && time.Now().Add(record.Delay).After(deadline) {
+			err = withAttempts(fmt.Errorf("%w before attempt %d could be made: %w", backend.ErrDispatchDeadline, attempt+1, err), attempts)
+			return err
 		}
 
-		delay := spriteRetryDelay * time.Duration(1<<(attempt-1))
 		log.Warn("Sprite run attempt failed, retrying",
 			"sprite", a.Name,
-			"jobUUID", jobUUID,
+			"jobUUID", job.UUID,
 			"attempt", attempt,
-			"maxAttempts", spriteRunMaxAttempts,
-			"retryIn", delay,
+			"maxAttempts", policy.MaxAttempts,
+			"reason", reason,
+			"retryIn", record.Delay,
 			"error", err,
 		)
-		time.Sleep(delay)
+		time.Sleep(record.Delay)
 	}
-
-	return fmt.Errorf("failed to start sprite command: %w", err)
 }
 
-func isRetryableRunError(err error) bool {
-	var netErr net.Error
-	if errors.As(err, &netErr) && netErr.Timeout() {
-		return true
+// withAttempts wraps err, the reason no more attempts at running a job were
+// made, in a *backend.RunError with the attempts that were, if there were any
+func withAttempts(err error, attempts []backend.Attempt) error {
+	if len(attempts) == 0 {
+		return err
 	}
+	return &backend.RunError{Category: Categorize(err, nil), ExitCode: ExitCode(err), Attempts: attempts, Err: err}
+}
 
-	msg := strings.ToLower(err.Error())
-	return strings.Contains(msg, "i/o timeout") ||
-		strings.Contains(msg, "failed to connect") ||
-		strings.Contains(msg, "connection reset by peer")
+// attemptOutcome labels an attempt for the attempts metric
+func attemptOutcome(a backend.Attempt, policy RetryPolicy) string {
+	switch {
+	case a.Err == nil:
+		return "succeeded"
+	case a.Retry && a.Number < policy.MaxAttempts:
+		return "retried"
+	default:
+		return "failed"
+	}
 }
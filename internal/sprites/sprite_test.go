@@ -1,12 +1,22 @@
 package sprites
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/jeremybumsted/bksprites/internal/backend"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sprites "github.com/superfly/sprites-go"
 )
 
 func TestNewSpriteHandler(t *testing.T) {
@@ -50,7 +60,7 @@ func TestSpriteHandler_CreateAgentSprite(t *testing.T) {
 	t.Setenv("SPRITE_API_TOKEN", "your-token-here")
 
 	handler := NewSpriteHandler()
-	sprite, err := handler.CreateAgentSprite("test-sprite")
+	sprite, err := handler.CreateAgentSprite(context.Background(), "test-sprite")
 
 	if err != nil {
 		t.Logf("Expected error without valid token/connectivity: %v", err)
@@ -62,96 +72,285 @@ func TestSpriteHandler_CreateAgentSprite(t *testing.T) {
 	assert.NotEmpty(t, sprite.Address)
 }
 
-func TestIsRetryableRunError(t *testing.T) {
+func TestParseAgentVersion(t *testing.T) {
 	tests := []struct {
 		name     string
-		err      error
-		expected bool
+		output   string
+		expected string
+		wantErr  bool
 	}{
 		{
-			name:     "timeout error",
-			err:      &testTimeoutError{timeout: true},
-			expected: true,
-		},
-		{
-			name:     "i/o timeout string",
-			err:      errors.New("i/o timeout"),
-			expected: true,
-		},
-		{
-			name:     "I/O TIMEOUT uppercase",
-			err:      errors.New("I/O TIMEOUT occurred"),
-			expected: true,
-		},
-		{
-			name:     "failed to connect",
-			err:      errors.New("failed to connect to server"),
-			expected: true,
-		},
-		{
-			name:     "FAILED TO CONNECT uppercase",
-			err:      errors.New("FAILED TO CONNECT"),
-			expected: true,
+			name:     "release build",
+			output:   "buildkite-agent version 3.87.1, build 10003\n",
+			expected: "3.87.1",
 		},
 		{
-			name:     "connection reset by peer",
-			err:      errors.New("connection reset by peer"),
-			expected: true,
+			name:     "prerelease build",
+			output:   "buildkite-agent version 3.88.0-beta.1, build 10100",
+			expected: "3.88.0-beta.1",
 		},
 		{
-			name:     "CONNECTION RESET BY PEER uppercase",
-			err:      errors.New("CONNECTION RESET BY PEER"),
-			expected: true,
+			name:    "unexpected output",
+			output:  "command not found",
+			wantErr: true,
 		},
 		{
-			name:     "non-retryable error",
-			err:      errors.New("some other error"),
-			expected: false,
-		},
-		{
-			name:     "authentication error",
-			err:      errors.New("authentication failed"),
-			expected: false,
-		},
-		{
-			name:     "permission denied",
-			err:      errors.New("permission denied"),
-			expected: false,
+			name:    "empty output",
+			output:  "",
+			wantErr: true,
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := parseAgentVersion(tt.output)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+		})
+	}
+}
+
+func TestRetryPolicy_Classify(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		retry  bool
+		reason string
+	}{
+		{name: "success", err: nil, reason: "succeeded"},
+		{name: "network timeout", err: &testTimeoutError{timeout: true}, retry: true, reason: "network timeout"},
+		{name: "wrapped network timeout", err: errors.Join(errors.New("wrapper"), &testTimeoutError{timeout: true}), retry: true, reason: "network timeout"},
+		{name: "network error that isn't a timeout", err: &testNetError{temporary: true}, reason: "not a retryable error"},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET), retry: true, reason: "connection lost"},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, retry: true, reason: "connection lost"},
+		{name: "rate limited", err: &sprites.APIError{StatusCode: http.StatusTooManyRequests}, retry: true, reason: "rate limited by the Sprites API"},
+		{name: "server error", err: &sprites.APIError{StatusCode: http.StatusBadGateway}, retry: true, reason: "Sprites API returned 502"},
+		{name: "unauthorized", err: &sprites.APIError{StatusCode: http.StatusUnauthorized}, reason: "Sprites API returned 401"},
+		{name: "sprite went away", err: &websocket.CloseError{Code: websocket.CloseGoingAway}, retry: true, reason: "connection closed with code 1001"},
+		{name: "policy violation", err: &websocket.CloseError{Code: websocket.ClosePolicyViolation}, reason: "connection closed with code 1008"},
+		{name: "agent exited", err: &sprites.ExitError{Code: 1}, reason: "command exited with status 1"},
+		{name: "agent exited after starting", err: &StartError{Err: &sprites.ExitError{Code: 127}}, reason: "command exited with status 127"},
+		{name: "command didn't start", err: &StartError{Err: errors.New("failed to connect: bad handshake")}, retry: true, reason: "command didn't start"},
+		{name: "rejected before starting", err: &StartError{Err: &sprites.APIError{StatusCode: http.StatusForbidden}}, reason: "Sprites API returned 403"},
+		{name: "timed out", err: fmt.Errorf("waiting: %w", context.DeadlineExceeded), reason: "cancelled or timed out"},
+		{name: "unknown error", err: errors.New("connection reset by peer"), reason: "not a retryable error"},
+		{name: "job cancelled", err: fmt.Errorf("%w: %w", backend.ErrJobCanceled, &sprites.ExitError{Code: 143}), reason: "the job was cancelled"},
+		{name: "acquire timeout", err: fmt.Errorf("%w: %w", backend.ErrAcquireTimeout, &websocket.CloseError{Code: websocket.CloseAbnormalClosure}), reason: "the agent didn't acquire the job in time"},
+		{name: "job timeout", err: fmt.Errorf("%w: %w", backend.ErrJobTimeout, &testTimeoutError{timeout: true}), reason: "the job ran past its timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retry, reason := DefaultRetryPolicy().Classify(tt.err)
+			assert.Equal(t, tt.retry, retry)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	assert.Equal(t, time.Second, policy.Delay(1, nil))
+	assert.Equal(t, 2*time.Second, policy.Delay(2, nil))
+	assert.Equal(t, 4*time.Second, policy.Delay(3, nil))
+	assert.Equal(t, 5*time.Second, policy.Delay(4, nil), "capped at max delay")
+	assert.Equal(t, 5*time.Second, policy.Delay(100, nil))
+
+	// The Sprites API says how long to back off when rate limiting
+	assert.Equal(t, 20*time.Second, policy.Delay(1, &sprites.APIError{StatusCode: http.StatusTooManyRequests, RetryAfterHeader: 20}))
+
+	policy.Jitter = 0.5
+	for range 100 {
+		d := policy.Delay(2, nil)
+		assert.GreaterOrEqual(t, d, time.Second)
+		assert.LessOrEqual(t, d, 3*time.Second)
+	}
+}
+
+func TestAgentSprite_RunJob_Cancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s, the agent shouldn't be started", r.URL.Path)
+	}))
+	defer server.Close()
+
+	h := &backend.Handle{}
+	h.Cancel(time.Second)
+	spr := &AgentSprite{
+		Name:   "bk-1",
+		Client: sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+	}
+
+	assert.ErrorIs(t, spr.RunJob(backend.Job{UUID: "job-1", Handle: h}, time.Time{}), backend.ErrJobCanceled)
+}
+
+func TestAgentSprite_RunJob_Retried(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	spr := &AgentSprite{
+		Name:        "bk-1",
+		Client:      sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+		RetryPolicy: &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}
+
+	err := spr.RunJob(backend.Job{UUID: "job-1"}, time.Time{})
+
+	var runErr *backend.RunError
+	require.True(t, errors.As(err, &runErr))
+	assert.Equal(t, int32(2), requests.Load())
+	require.Len(t, runErr.Attempts, 2)
+	for i, attempt := range runErr.Attempts {
+		assert.Equal(t, i+1, attempt.Number)
+		assert.Error(t, attempt.Err)
+		assert.True(t, attempt.Retry, "attempt %d", attempt.Number)
+		assert.NotEmpty(t, attempt.Reason)
+	}
+	assert.Equal(t, time.Millisecond, runErr.Attempts[0].Delay)
+	assert.Zero(t, runErr.Attempts[1].Delay)
+}
+
+func TestAgentSprite_RunJob_DeadlineBeforeRetry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	spr := &AgentSprite{
+		Name:        "bk-1",
+		Client:      sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour},
+	}
+
+	// The attempt made before giving up is still reported
+	err := spr.RunJob(backend.Job{UUID: "job-1"}, time.Now().Add(time.Minute))
+	assert.ErrorIs(t, err, backend.ErrDispatchDeadline)
+
+	var runErr *backend.RunError
+	require.True(t, errors.As(err, &runErr))
+	require.Len(t, runErr.Attempts, 1)
+	assert.True(t, runErr.Attempts[0].Retry)
+}
+
+func TestAgentSprite_AttachJob_Failed(t *testing.T) {
+	tests := []struct {
+		name         string
+		output       [][]byte // binary frames the session sends once attached
+		job          backend.Job
+		wantErr      error
+		wantCategory backend.Category
+		wantExitCode int
+		wantStderr   []string
+	}{
 		{
-			name:     "network timeout from net package",
-			err:      &testNetError{timeout: true, temporary: true},
-			expected: true,
+			name:         "agent failed",
+			output:       [][]byte{append([]byte{2}, "job exploded\n"...), {3, 3}},
+			wantCategory: backend.CategoryAgentFailed,
+			wantExitCode: 3,
+			wantStderr:   []string{"job exploded"},
 		},
 		{
-			name:     "non-timeout network error",
-			err:      &testNetError{timeout: false, temporary: true},
-			expected: false,
+			name:         "job timeout",
+			job:          backend.Job{JobTimeout: 50 * time.Millisecond},
+			wantErr:      backend.ErrJobTimeout,
+			wantCategory: backend.CategoryTimeout,
+			wantExitCode: -1,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := isRetryableRunError(tt.err)
-			assert.Equal(t, tt.expected, result)
+			upgrader := websocket.Upgrader{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"session_info","tty":false,"session_id":"session-1"}`))
+				for _, frame := range tt.output {
+					_ = conn.WriteMessage(websocket.BinaryMessage, frame)
+				}
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}))
+			defer server.Close()
+
+			spr := &AgentSprite{
+				Name:   "bk-1",
+				Client: sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+			}
+
+			job := tt.job
+			job.UUID = "job-1"
+			err := spr.AttachJob(context.Background(), job, "session-1")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+
+			var runErr *backend.RunError
+			require.True(t, errors.As(err, &runErr))
+			assert.Equal(t, tt.wantCategory, runErr.Category)
+			assert.Equal(t, tt.wantExitCode, runErr.ExitCode)
+			assert.Equal(t, tt.wantStderr, runErr.Stderr)
+			assert.Len(t, runErr.Attempts, 1)
 		})
 	}
 }
 
-func TestIsRetryableRunError_WrappedErrors(t *testing.T) {
-	// Test wrapped timeout error
-	baseErr := &testTimeoutError{timeout: true}
-	wrappedErr := errors.Join(errors.New("wrapper"), baseErr)
+func TestCategorize(t *testing.T) {
+	acquired := func() bool { return true }
+	notAcquired := func() bool { return false }
+
+	tests := []struct {
+		name     string
+		err      error
+		acquired func() bool
+		want     backend.Category
+	}{
+		{name: "couldn't connect", err: &StartError{Err: errors.New("failed to connect: bad handshake")}, want: backend.CategorySpriteUnreachable},
+		{name: "sprite not found", err: &StartError{Err: &sprites.APIError{StatusCode: http.StatusNotFound}}, want: backend.CategorySpriteUnreachable},
+		{name: "connection dropped", err: &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, want: backend.CategorySpriteUnreachable},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET), want: backend.CategorySpriteUnreachable},
+		{name: "agent not found", err: &sprites.ExitError{Code: 127}, acquired: notAcquired, want: backend.CategoryAgentMissing},
+		{name: "agent not executable", err: &sprites.ExitError{Code: 126}, want: backend.CategoryAgentMissing},
+		{name: "acquire rejected", err: &sprites.ExitError{Code: 1}, acquired: notAcquired, want: backend.CategoryAcquireRejected},
+		{name: "agent failed after acquiring", err: &sprites.ExitError{Code: 1}, acquired: acquired, want: backend.CategoryAgentFailed},
+		{name: "acquisition unknown", err: &sprites.ExitError{Code: 1}, want: backend.CategoryAgentFailed},
+		{name: "job timeout", err: fmt.Errorf("%w: %w", backend.ErrJobTimeout, &sprites.ExitError{Code: 137}), want: backend.CategoryTimeout},
+		{name: "acquire timeout", err: fmt.Errorf("%w: %w", backend.ErrAcquireTimeout, errors.New("closed")), want: backend.CategoryTimeout},
+		{name: "unknown", err: errors.New("something else"), want: backend.CategoryAgentFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Categorize(tt.err, tt.acquired))
+		})
+	}
+}
 
-	result := isRetryableRunError(wrappedErr)
-	assert.True(t, result)
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 127, ExitCode(&backend.RunError{Err: fmt.Errorf("running: %w", &sprites.ExitError{Code: 127})}))
+	assert.Equal(t, -1, ExitCode(&StartError{Err: errors.New("failed to connect")}))
+	assert.Equal(t, -1, ExitCode(nil))
 }
 
 func TestConstants(t *testing.T) {
 	// Verify the constants are set to expected values
-	assert.Equal(t, 5*time.Minute, spriteCommandTimeout)
-	assert.Equal(t, 3, spriteRunMaxAttempts)
-	assert.Equal(t, 2*time.Second, spriteRetryDelay)
+	assert.Equal(t, 5*time.Minute, backend.DefaultAcquireTimeout)
+	assert.Equal(t, RetryPolicy{MaxAttempts: 3, BaseDelay: 2 * time.Second, MaxDelay: 30 * time.Second, Jitter: 0.2}, DefaultRetryPolicy())
 }
 
 // Mock types for testing
@@ -195,3 +394,210 @@ func (e *testNetError) Temporary() bool {
 // Ensure our test types implement net.Error
 var _ net.Error = (*testTimeoutError)(nil)
 var _ net.Error = (*testNetError)(nil)
+
+func TestAgentSprite_Destroy(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "deleted", status: http.StatusNoContent},
+		{name: "already gone", status: http.StatusNotFound},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.Method + " " + r.URL.Path
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			spr := &AgentSprite{
+				Name:   "bk-job-1234",
+				Client: sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+			}
+
+			err := spr.Destroy(context.Background())
+			assert.Equal(t, "DELETE /v1/sprites/bk-job-1234", gotPath)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestBackend_Provision_Failed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	b := &Backend{Handler: &SpriteHandler{
+		Client: sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+	}}
+
+	err := b.Provision(context.Background(), "bk-job-1234", nil, nil)
+
+	var runErr *backend.RunError
+	require.True(t, errors.As(err, &runErr))
+	assert.Equal(t, backend.CategorySpriteUnreachable, runErr.Category)
+	assert.Equal(t, -1, runErr.ExitCode)
+}
+
+func TestAgentSprite_RestoreCheckpoint(t *testing.T) {
+	checkpoints := `[
+		{"id": "v1", "create_time": "2026-01-01T00:00:00Z", "comment": "golden"},
+		{"id": "v2", "create_time": "2026-01-02T00:00:00Z", "comment": "golden"},
+		{"id": "v3", "create_time": "2026-01-03T00:00:00Z", "comment": "other"}
+	]`
+
+	tests := []struct {
+		name        string
+		checkpoint  string
+		stream      string
+		wantRestore string
+		wantErr     error
+		wantErrText string
+	}{
+		{
+			name:        "restores the newest matching checkpoint",
+			checkpoint:  "golden",
+			stream:      `{"type": "info", "data": "restoring"}` + "\n" + `{"type": "complete"}`,
+			wantRestore: "/v1/sprites/bk-1/checkpoints/v2/restore",
+		},
+		{
+			name:        "missing checkpoint",
+			checkpoint:  "missing",
+			wantErr:     ErrCheckpointNotFound,
+			wantErrText: "checkpoint not found: missing on sprite bk-1",
+		},
+		{
+			name:        "error in the stream",
+			checkpoint:  "golden",
+			stream:      `{"type": "error", "error": "disk busy"}`,
+			wantRestore: "/v1/sprites/bk-1/checkpoints/v2/restore",
+			wantErrText: "restoring checkpoint golden (v2): disk busy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var restored string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					w.Header().Set("Content-Type", "application/json")
+					_, _ = w.Write([]byte(checkpoints))
+					return
+				}
+				restored = r.URL.Path
+				_, _ = w.Write([]byte(tt.stream))
+			}))
+			defer server.Close()
+
+			spr := &AgentSprite{
+				Name:   "bk-1",
+				Client: sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+			}
+
+			err := spr.RestoreCheckpoint(context.Background(), tt.checkpoint)
+			assert.Equal(t, tt.wantRestore, restored)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+			if tt.wantErrText != "" {
+				assert.EqualError(t, err, tt.wantErrText)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAgentSprite_CheckCheckpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/sprites/bk-1/checkpoints", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[{"id": "v1", "create_time": "2026-01-01T00:00:00Z", "comment": "golden"}]`))
+	}))
+	defer server.Close()
+
+	spr := &AgentSprite{
+		Name:   "bk-1",
+		Client: sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+	}
+
+	assert.NoError(t, spr.CheckCheckpoint(context.Background(), "golden"))
+	assert.ErrorIs(t, spr.CheckCheckpoint(context.Background(), "missing"), ErrCheckpointNotFound)
+}
+
+func TestParseFreeDisk(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    int64
+		wantErr bool
+	}{
+		{
+			name: "df output",
+			out: "Filesystem     1024-blocks    Used Available Capacity Mounted on\n" +
+				"/dev/vdb          98304000 1234567  97069433       2% /home/sprite\n",
+			want: 97069433 << 10,
+		},
+		{name: "no output", out: "", wantErr: true},
+		{name: "not a number", out: "Filesystem 1024-blocks Used Available\n/dev/vdb 1 1 lots\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFreeDisk(tt.out)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAgentSprite_CheckHealth_SpriteStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/sprites/bk-linux-1", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name": "bk-linux-1", "status": "error"}`))
+	}))
+	defer server.Close()
+
+	spr := &AgentSprite{
+		Name:   "bk-linux-1",
+		Client: sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+	}
+	assert.EqualError(t, spr.CheckHealth(context.Background()), "sprite status is error")
+}
+
+func TestAgentSprite_CheckHealth_Unreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error": "unavailable"}`))
+	}))
+	defer server.Close()
+
+	spr := &AgentSprite{
+		Name:   "bk-linux-1",
+		Client: sprites.New("test-token", sprites.WithBaseURL(server.URL), sprites.WithDisableControl()),
+	}
+	assert.True(t, backend.Unreachable(spr.CheckHealth(context.Background())))
+}
+
+func TestSameAgentVersion(t *testing.T) {
+	assert.True(t, SameAgentVersion("3.112.0", "3.112.0"))
+	assert.True(t, SameAgentVersion("3.112.0", "v3.112.0"))
+	assert.False(t, SameAgentVersion("3.112.0", "3.112.1"))
+	assert.False(t, SameAgentVersion("3.112.0", ""))
+}
@@ -2,6 +2,8 @@ package store
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/charmbracelet/log"
 	"github.com/jeremybumsted/bksprites/internal/types"
@@ -11,6 +13,7 @@ type Job interface {
 	Set(id string, j types.Job) error
 	Get(id string) (types.Job, bool, error)
 	Delete(id string) error
+	List() (map[string]types.Job, error)
 }
 
 type JobStore struct {
@@ -47,6 +50,22 @@ func (js *JobStore) Get(id string) (types.Job, bool, error) {
 	return j, true, nil
 }
 
+// List returns every stored job keyed by its uuid
+func (js *JobStore) List() (map[string]types.Job, error) {
+	jobs := make(map[string]types.Job)
+	for _, key := range js.store.Keys("job:") {
+		id := strings.TrimPrefix(key, "job:")
+		j, ok, err := js.Get(id)
+		if err != nil {
+			return nil, fmt.Errorf("reading job %s: %w", id, err)
+		}
+		if ok {
+			jobs[id] = j
+		}
+	}
+	return jobs, nil
+}
+
 func (js *JobStore) Delete(id string) error {
 	log.Info("Deleted job", "uuid", id)
 	return js.store.Delete("job:" + id)
@@ -245,3 +245,33 @@ func TestJobStore_SetWithCircularReference(t *testing.T) {
 	err = jobStore.Set("job-2", job2)
 	assert.ErrorIs(t, err, ErrStoreFull)
 }
+
+func TestJobStore_List(t *testing.T) {
+	store := NewStore()
+	jobStore := NewJobStore(store)
+
+	// Empty store
+	jobs, err := jobStore.List()
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	require.NoError(t, jobStore.Set("job-1", types.Job{Sprite: "sprite-1", Priority: 1}))
+	require.NoError(t, jobStore.Set("job-2", types.Job{Sprite: "sprite-2", Priority: 2}))
+	require.NoError(t, store.Set("other:1", "not a job", 0))
+
+	jobs, err = jobStore.List()
+	require.NoError(t, err)
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, "sprite-1", jobs["job-1"].Sprite)
+	assert.Equal(t, "sprite-2", jobs["job-2"].Sprite)
+}
+
+func TestJobStore_ListInvalidJSON(t *testing.T) {
+	store := NewStore()
+	jobStore := NewJobStore(store)
+
+	require.NoError(t, store.Set("job:bad", "invalid json {", 0))
+
+	_, err := jobStore.List()
+	assert.Error(t, err)
+}
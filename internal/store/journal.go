@@ -0,0 +1,209 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	journalFile = "store.log"
+
+	// compactMinRecords stops small journals from being rewritten on every write
+	compactMinRecords = 1000
+)
+
+// record is a single line in the journal
+type record struct {
+	Op        string    `json:"op"` // "set" or "delete"
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// journal is an append-only log of every change made to a Store. Each
+// record is synced to disk before the change is applied in memory, so the
+// store can be rebuilt after a crash by replaying the log.
+type journal struct {
+	dir     string
+	file    *os.File
+	records int // records in the log, used to decide when to compact
+}
+
+// NewFileStore returns a Store that persists its data to dir, replaying
+// anything written by a previous process
+func NewFileStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating state directory: %w", err)
+	}
+
+	s := NewStore()
+	j := &journal{dir: dir}
+
+	if err := j.replay(s.data); err != nil {
+		return nil, err
+	}
+
+	// Start from a compacted log so expired and deleted keys don't pile up across restarts
+	if err := j.compact(s.data); err != nil {
+		return nil, err
+	}
+
+	s.journal = j
+	return s, nil
+}
+
+func (j *journal) path() string {
+	return filepath.Join(j.dir, journalFile)
+}
+
+// replay loads the journal into data. A partially written final record,
+// e.g. from the process being killed mid-write, is ignored.
+func (j *journal) replay(data map[string]entry) error {
+	f, err := os.Open(j.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening journal: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	now := time.Now()
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Warn("Ignoring incomplete record at the end of the journal", "path", j.path())
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading journal: %w", err)
+		}
+
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			log.Warn("Ignoring corrupt record in the journal", "path", j.path(), "error", err)
+			continue
+		}
+
+		switch r.Op {
+		case "set":
+			if !r.ExpiresAt.IsZero() && now.After(r.ExpiresAt) {
+				delete(data, r.Key)
+				continue
+			}
+			data[r.Key] = entry{value: r.Value, expiresAt: r.ExpiresAt}
+		case "delete":
+			delete(data, r.Key)
+		}
+	}
+}
+
+// append writes a record to the journal and syncs it to disk
+func (j *journal) append(r record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if _, err := j.file.Write(b); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	j.records++
+	return nil
+}
+
+// shouldCompact reports whether the journal has grown enough past the
+// live data that it's worth rewriting
+func (j *journal) shouldCompact(live int) bool {
+	return j.records > compactMinRecords && j.records > 2*live
+}
+
+// compact atomically replaces the journal with one set record per live key
+func (j *journal) compact(data map[string]entry) error {
+	tmpPath := j.path() + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating compacted journal: %w", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	now := time.Now()
+	records := 0
+	for key, e := range data {
+		if !e.expiresAt.IsZero() && now.After(e.expiresAt) {
+			continue
+		}
+		b, err := json.Marshal(record{Op: "set", Key: key, Value: e.value, ExpiresAt: e.expiresAt})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			tmp.Close()
+			return fmt.Errorf("writing compacted journal: %w", err)
+		}
+		records++
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing compacted journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing compacted journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, j.path()); err != nil {
+		return fmt.Errorf("replacing journal: %w", err)
+	}
+	if err := syncDir(j.dir); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path(), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening journal: %w", err)
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	j.records = records
+	return nil
+}
+
+func (j *journal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
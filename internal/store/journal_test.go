@@ -0,0 +1,184 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jeremybumsted/bksprites/internal/types"
+)
+
+func TestNewFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.NotNil(t, store.journal)
+	assert.FileExists(t, filepath.Join(dir, journalFile))
+}
+
+func TestFileStore_SurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("keep", "value", 0))
+	require.NoError(t, store.Set("update", "old", 0))
+	require.NoError(t, store.Set("update", "new", 0))
+	require.NoError(t, store.Set("delete", "value", 0))
+	require.NoError(t, store.Delete("delete"))
+
+	// Simulate a crash by not closing the store before reopening it
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	value, ok := reopened.Get("keep")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+
+	value, ok = reopened.Get("update")
+	assert.True(t, ok)
+	assert.Equal(t, "new", value)
+
+	_, ok = reopened.Get("delete")
+	assert.False(t, ok)
+}
+
+func TestFileStore_TTL(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("short", "value", 50*time.Millisecond))
+	require.NoError(t, store.Set("long", "value", time.Hour))
+	require.NoError(t, store.Close())
+
+	time.Sleep(100 * time.Millisecond)
+
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	_, ok := reopened.Get("short")
+	assert.False(t, ok)
+
+	_, ok = reopened.Get("long")
+	assert.True(t, ok)
+
+	// Expired keys are dropped from the journal entirely
+	_, exists := reopened.data["short"]
+	assert.False(t, exists)
+}
+
+func TestFileStore_IncompleteRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("complete", "value", 0))
+	require.NoError(t, store.Close())
+
+	// A process killed mid-write leaves a partial line at the end of the journal
+	f, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"set","key":"partial","val`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	value, ok := reopened.Get("complete")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+
+	_, ok = reopened.Get("partial")
+	assert.False(t, ok)
+
+	// New writes land after the recovered data
+	require.NoError(t, reopened.Set("after", "value", 0))
+	require.NoError(t, reopened.Close())
+
+	again, err := NewFileStore(dir)
+	require.NoError(t, err)
+	defer again.Close()
+
+	_, ok = again.Get("complete")
+	assert.True(t, ok)
+	_, ok = again.Get("after")
+	assert.True(t, ok)
+}
+
+func TestFileStore_CorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	journal := "{\"op\":\"set\",\"key\":\"a\",\"value\":\"1\"}\nnot json\n{\"op\":\"set\",\"key\":\"b\",\"value\":\"2\"}\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, journalFile), []byte(journal), 0o600))
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, ok := store.Get("a")
+	assert.True(t, ok)
+	_, ok = store.Get("b")
+	assert.True(t, ok)
+}
+
+func TestFileStore_Compaction(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	// Churn a handful of keys until the journal compacts itself
+	for i := 0; i < compactMinRecords*2; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key-%d", i%5), fmt.Sprintf("value-%d", i), 0))
+	}
+	assert.LessOrEqual(t, store.journal.records, compactMinRecords+1)
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	assert.Equal(t, 5, reopened.journal.records)
+	value, ok := reopened.Get("key-4")
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("value-%d", compactMinRecords*2-1), value)
+}
+
+func TestFileStore_JobStore(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	job := types.Job{
+		Sprite:   "test-sprite",
+		Priority: 5,
+		Pipeline: types.Pipeline{Slug: "my-pipeline", UUID: "pipe-123"},
+	}
+	require.NoError(t, NewJobStore(store).Set("job-1", job))
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	retrieved, ok, err := NewJobStore(reopened).Get("job-1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, job.Sprite, retrieved.Sprite)
+	assert.Equal(t, job.Pipeline, retrieved.Pipeline)
+}
@@ -4,8 +4,11 @@ package store
 
 import (
 	"errors"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/charmbracelet/log"
 )
 
 var ErrStoreFull = errors.New("storage full")
@@ -15,6 +18,7 @@ type Store struct {
 	data    map[string]entry
 	maxKeys int
 	ttl     time.Duration
+	journal *journal // nil for an in-memory store
 }
 
 type entry struct {
@@ -47,7 +51,14 @@ func (s *Store) Set(key, value string, ttl time.Duration) error {
 		e.expiresAt = time.Now().Add(ttl)
 	}
 
+	if s.journal != nil {
+		if err := s.journal.append(record{Op: "set", Key: key, Value: value, ExpiresAt: e.expiresAt}); err != nil {
+			return err
+		}
+	}
+
 	s.data[key] = e
+	s.maybeCompact()
 	return nil
 }
 
@@ -73,6 +84,59 @@ func (s *Store) Delete(key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+
+	if s.journal != nil {
+		if err := s.journal.append(record{Op: "delete", Key: key}); err != nil {
+			return err
+		}
+	}
+
 	delete(s.data, key)
+	s.maybeCompact()
 	return nil
 }
+
+// Keys returns every live key that starts with prefix
+func (s *Store) Keys(prefix string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var keys []string
+	for key, e := range s.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if !e.expiresAt.IsZero() && now.After(e.expiresAt) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close releases the files held by a file-backed store
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.close()
+}
+
+// maybeCompact rewrites the journal once it has grown well past the live
+// data. A failed compaction leaves the old journal in place, so it's only logged.
+// Callers must hold s.mu.
+func (s *Store) maybeCompact() {
+	if s.journal == nil || !s.journal.shouldCompact(len(s.data)) {
+		return
+	}
+	if err := s.journal.compact(s.data); err != nil {
+		log.Error("failed to compact the store journal", "error", err)
+	}
+}
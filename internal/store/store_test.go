@@ -204,3 +204,19 @@ func TestStore_ConcurrentAccess(t *testing.T) {
 		<-done
 	}
 }
+
+func TestStore_Keys(t *testing.T) {
+	store := NewStore()
+
+	require.NoError(t, store.Set("job:1", "a", 0))
+	require.NoError(t, store.Set("job:2", "b", 0))
+	require.NoError(t, store.Set("job:expired", "c", time.Nanosecond))
+	require.NoError(t, store.Set("sprite:1", "d", 0))
+
+	time.Sleep(time.Millisecond)
+
+	assert.ElementsMatch(t, []string{"job:1", "job:2"}, store.Keys("job:"))
+	assert.ElementsMatch(t, []string{"sprite:1"}, store.Keys("sprite:"))
+	assert.Len(t, store.Keys(""), 3)
+	assert.Empty(t, store.Keys("missing:"))
+}
@@ -5,13 +5,17 @@ package types
 import "time"
 
 type Job struct {
+	Queue           string    `json:"queue,omitempty"` // The cluster queue the job was reserved from
 	Sprite          string    `json:"sprite,omitempty"`
+	Pool            string    `json:"pool,omitempty"`      // The pool the sprite belongs to
+	Ephemeral       bool      `json:"ephemeral,omitempty"` // The sprite was created for the job and is destroyed after it
 	Priority        int       `json:"priority"`
 	AgentQueryRules []string  `json:"agent_query_rules"`
 	ScheduledAt     time.Time `json:"scheduled_at"`
 	Pipeline        Pipeline  `json:"pipeline"`
 	Build           Build     `json:"build"`
 	Step            Step      `json:"step"`
+	StartedAt       time.Time `json:"started_at,omitzero"` // When the agent was started on the sprite
 }
 
 type Pipeline struct {
@@ -7,8 +7,10 @@ import "time"
 // it is primarily used by the create command to provision a new sprite.
 type AgentSprite struct {
 	Name         string
+	URL          string
 	Organization string
 	ConfigFile   string
+	Checkpoint   string // checkpoint restored after every job, if any
 	MaxAgents    int
 	MinAgents    int
 
@@ -21,4 +23,5 @@ type AgentSprite struct {
 type BuildkiteAgent struct {
 	Version string
 	Name    string
+	Flags   []string // extra flags passed to buildkite-agent start
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jeremybumsted/bksprites/cmd/controller"
 	"github.com/jeremybumsted/bksprites/cmd/create"
+	"github.com/jeremybumsted/bksprites/cmd/healthcheck"
 	"github.com/jeremybumsted/bksprites/cmd/version"
 )
 
@@ -16,9 +17,10 @@ var (
 )
 
 var cli struct {
-	Controller controller.ControllerCmd `cmd:"" help:"start an instance of the sprite stack controller"`
-	Create     create.CreateCmd         `cmd:"" help:"create a new pre-configured sprite"`
-	Version    version.VersionCmd       `cmd:"" help:"show version information"`
+	Controller  controller.ControllerCmd   `cmd:"" help:"start an instance of the sprite stack controller"`
+	Create      create.CreateCmd           `cmd:"" help:"create a new pre-configured sprite"`
+	Healthcheck healthcheck.HealthcheckCmd `cmd:"" help:"check the health of a running controller, exiting non-zero if it is unhealthy"`
+	Version     version.VersionCmd         `cmd:"" help:"show version information"`
 }
 
 func main() {